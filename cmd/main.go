@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/feed"
+	"github.com/aulaga/aufs/src/tus"
 	"github.com/aulaga/aufs/src/webdav"
 	"github.com/go-chi/chi/v5"
 	"net/http"
@@ -30,6 +32,8 @@ func main() {
 	})
 
 	r.Mount("/dav", webdav.Handler())
+	r.Mount("/tus", tus.Handler())
+	r.Handle("/events", feed.Handler())
 
 	err := http.ListenAndServe("0.0.0.0:8080", r)
 	if err != nil {
@@ -2,6 +2,8 @@ package aufs
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"golang.org/x/net/webdav"
 	"io/fs"
 	"path/filepath"
@@ -17,11 +19,48 @@ func Context(ctx context.Context, spec FileSystemSpec) context.Context {
 type StorageSpec struct {
 	Id  string
 	Uri string
+	// AtomicWrites makes written files replace their path only once closed successfully, a failed or interrupted write
+	// leaving the previous content in place. Staging objects orphaned by crashes are removed when the storage is
+	// provided.
+	AtomicWrites bool
+	// PartSize is the size of the parts uploaded to storages supporting multipart uploads, 8MiB when not set.
+	PartSize int64
+}
+
+// MountMode restricts the operations allowed on a mounted storage.
+type MountMode int
+
+const (
+	// MountReadWrite allows every operation, it is the default mode.
+	MountReadWrite MountMode = iota
+	// MountReadOnly rejects any change to the mounted storage.
+	MountReadOnly
+	// MountAppendOnly allows creating files and directories and writing files in place, but never deleting or replacing
+	// them: existing files cannot be truncated, nor overwritten by a copy or a move.
+	MountAppendOnly
+	// MountWriteOnce allows creating new files and directories, existing files are never modified or deleted.
+	MountWriteOnce
+)
+
+func (m MountMode) String() string {
+	switch m {
+	case MountReadWrite:
+		return "read-write"
+	case MountReadOnly:
+		return "read-only"
+	case MountAppendOnly:
+		return "append-only"
+	case MountWriteOnce:
+		return "write-once"
+	}
+
+	return fmt.Sprintf("MountMode(%d)", int(m))
 }
 
 type MountSpec struct {
 	Storage    StorageSpec
 	MountPoint string
+	Mode       MountMode
 }
 
 type FileSystemSpec interface {
@@ -30,12 +69,119 @@ type FileSystemSpec interface {
 	Listener() EventListener
 }
 
+// WebhookSpec configures the delivery of filesystem events to an HTTP endpoint, see package webhook. Zero values
+// fall back to the webhook package defaults.
+type WebhookSpec struct {
+	Url    string
+	Secret string
+	// BatchSize is the maximum number of events sent in a single request.
+	BatchSize int
+	// FlushInterval is the longest an event waits for its batch to fill up.
+	FlushInterval time.Duration
+	// MaxRetries is how many times a failed batch is retried before being spooled, none when negative.
+	MaxRetries int
+	// SpoolDir keeps undelivered batches across restarts, they are dropped when empty.
+	SpoolDir string
+	// MaxPending is the number of events held in memory waiting for delivery. Past it the oldest batch is spooled,
+	// or new events are dropped when SpoolDir is empty.
+	MaxPending int
+}
+
+// WebhookFileSystemSpec is optionally implemented by a FileSystemSpec to deliver its events to webhooks.
+type WebhookFileSystemSpec interface {
+	FileSystemSpec
+	Webhooks() []WebhookSpec
+}
+
+// JournalSpec configures the event journal of a filesystem, see package journal. Zero values fall back to the journal
+// package defaults.
+type JournalSpec struct {
+	Dir string
+	// SegmentSize is the size in bytes after which the journal starts a new segment file.
+	SegmentSize int64
+	// MaxSize is the total size in bytes of segments kept, older segments are compacted away.
+	MaxSize int64
+	// MaxAge is how long segments are kept after their last write, 0 keeps them regardless of age. Ages are checked on
+	// rotation and periodically, the segment being written is kept.
+	MaxAge time.Duration
+	// NoSync stops syncing every append to disk. Appends get faster but the last events written may be lost when the
+	// host crashes, they still survive a crash of the process.
+	NoSync bool
+}
+
+// JournalFileSystemSpec is optionally implemented by a FileSystemSpec to journal its events, enabling replays.
+type JournalFileSystemSpec interface {
+	FileSystemSpec
+	Journal() JournalSpec
+}
+
+// MoveJournalSpec configures the journal of the moves across storages of a filesystem. Moves left unfinished in Dir
+// by a crash are resumed or rolled back when the filesystem is provided.
+type MoveJournalSpec struct {
+	Dir string
+	// Checksum verifies moved files by comparing their content on both storages, not only their sizes.
+	Checksum bool
+}
+
+// MoveJournalFileSystemSpec is optionally implemented by a FileSystemSpec to journal its moves across storages.
+type MoveJournalFileSystemSpec interface {
+	FileSystemSpec
+	MoveJournal() MoveJournalSpec
+}
+
+// EventListener only receives the paths of changes, EventHandler receives the full Event.
 type EventListener interface {
 	Moved(src string, dst string)
 	Changed(path string) // modified or created
 	Deleted(path string)
 }
 
+// MountListener is optionally implemented by an EventListener to be notified of runtime mount changes.
+type MountListener interface {
+	Mounted(point string)
+	Unmounted(point string)
+}
+
+// OverflowPolicy decides what happens to an event published while a listener queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the publisher wait until the listener catches up.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued event to make room for the new one.
+	OverflowDropOldest
+	// OverflowDropNewest discards the event being published.
+	OverflowDropNewest
+)
+
+// ListenerOptions configure how events are delivered to a listener. Each listener gets its own background worker
+// receiving events in publication order.
+type ListenerOptions struct {
+	QueueSize int
+	Overflow  OverflowPolicy
+
+	// Include limits events to paths matching any of these glob patterns, "**" matching any number of directories.
+	// Patterns without a slash match the base name, e.g. "*.jpg". Moves match on either of their paths.
+	Include []string
+	// Exclude drops events whose paths match any of these glob patterns, even when included.
+	Exclude []string
+	// Kinds limits events to the given kinds, all kinds when empty.
+	Kinds []EventKind
+	// Mounts limits events to the given mount points, "/" being the filesystem root.
+	Mounts []string
+	// Debounce collapses the events of a path published within this window into the single effective one, e.g. a
+	// creation followed by modifications is delivered as a creation, a creation followed by a deletion is not
+	// delivered at all. Events of different paths may then be delivered out of publication order.
+	Debounce time.Duration
+}
+
+func DefaultListenerOptions() ListenerOptions {
+	return ListenerOptions{
+		QueueSize: 1024,
+		Overflow:  OverflowBlock,
+	}
+}
+
 type Node interface {
 	Path() string
 	Storage() Storage
@@ -46,15 +192,55 @@ type File interface {
 	webdav.File
 }
 
+// Aborter is optionally implemented by a File opened for writing. Abort closes the file discarding what was written,
+// instead of committing it like Close. It fails with a NotSupported Error, leaving the file open, when the writes of
+// the file cannot be discarded.
+type Aborter interface {
+	Abort() error
+}
+
 type Filesystem interface {
-	Storage
+	ContextStorage
+	MountForPath(path string) (Mount, string)
+	Mount(spec MountSpec) error
+	Unmount(point string, force bool) error
 	AddEventListener(listener EventListener)
-	FlushEvents()
+	AddEventHandler(handler EventHandler, options ListenerOptions)
+	// Replay delivers journaled events from fromSeq to handler, then keeps delivering new events like AddEventHandler.
+	// It fails when the filesystem has no journal.
+	Replay(fromSeq uint64, handler EventHandler, options ListenerOptions) error
+	// Begin starts a transaction, events of its operations are attributed to the actor and request id of ctx.
+	Begin(ctx context.Context) Transaction
+	// DroppedEvents returns how many events listeners missed because their queue overflowed.
+	DroppedEvents() uint64
+	// Shutdown waits for pending events to be delivered to listeners, or for ctx to be done.
+	Shutdown(ctx context.Context) error
+	// Walk calls fn for root and every node below it, descending into the storages mounted under root.
+	Walk(root string, fn WalkFunc, options WalkOptions) error
+	WalkWithContext(ctx context.Context, root string, fn WalkFunc, options WalkOptions) error
+	// CopyWithOptions copies srcPath to dstPath like Copy, reporting its progress and the files it failed to copy
+	// instead of stopping at the first failure. It only fails when the copy could not run, or was stopped by ctx.
+	CopyWithOptions(ctx context.Context, srcPath string, dstPath string, options CopyOptions) (*CopyReport, error)
+}
+
+// Transaction is a view of a Filesystem holding back the events of the operations done through it. Listeners receive
+// them once committed, discarding the transaction drops them. Files opened through the transaction and closed after it
+// was committed publish their events right away.
+type Transaction interface {
+	ContextStorage
+	Commit()
+	Discard()
 }
 
 type Storage interface {
 	Id() string
+	// Open opens path for reading and writing, creating it if missing, like OpenFile(path, os.O_RDWR|os.O_CREATE).
 	Open(path string) (File, error)
+	// OpenFile opens path following the os.OpenFile flags. It fails with fs.ErrNotExist for a missing path without
+	// os.O_CREATE, with fs.ErrExist for an existing path with os.O_CREATE|os.O_EXCL, and writes to handles opened
+	// read-only fail. Writes replace the content of the file unless os.O_APPEND is given. A file created or truncated
+	// by the flags is written when closed, even if nothing was written to it.
+	OpenFile(path string, flag int) (File, error)
 	Stat(path string) (NodeInfo, error)
 	Delete(path string) error
 	Copy(srcPath string, dstPath string) error
@@ -63,9 +249,23 @@ type Storage interface {
 	MkDir(path string) (NodeInfo, error)
 }
 
+// ContextStorage is a Storage whose operations stop when their context is cancelled or past its deadline. Files
+// opened with a context keep using it for their reads and writes.
+type ContextStorage interface {
+	Storage
+	OpenFileWithContext(ctx context.Context, path string, flag int) (File, error)
+	StatWithContext(ctx context.Context, path string) (NodeInfo, error)
+	DeleteWithContext(ctx context.Context, path string) error
+	CopyWithContext(ctx context.Context, srcPath string, dstPath string) error
+	MoveWithContext(ctx context.Context, srcPath string, dstPath string) error
+	ListDirWithContext(ctx context.Context, path string, recursive bool) ([]NodeInfo, error)
+	MkDirWithContext(ctx context.Context, path string) (NodeInfo, error)
+}
+
 type Mount interface {
 	Storage() Storage
 	Point() string
+	Mode() MountMode
 }
 
 type StorageProvider interface {
@@ -73,6 +273,138 @@ type StorageProvider interface {
 	ProvideStorage(StorageSpec) (Storage, error)
 }
 
+// ListSort orders the nodes of a listing.
+type ListSort int
+
+const (
+	// ListUnsorted keeps the order of the storage, object storages usually list nodes by name.
+	ListUnsorted ListSort = iota
+	// ListSortByName sorts nodes by name, which reads the whole listing before returning the first page.
+	ListSortByName
+)
+
+// ListOptions configure a directory listing.
+type ListOptions struct {
+	// PageSize is the maximum number of nodes returned by each NodeIterator.Next call, 1000 when not set.
+	PageSize int
+	// StartAfter only lists the nodes whose name sorts after it, the name of the last node of a page being the cursor
+	// of the next one.
+	StartAfter string
+	Sort       ListSort
+}
+
+// NodeIterator returns the nodes of a listing a page at a time.
+type NodeIterator interface {
+	// Next returns the next page of nodes, or io.EOF once all nodes were returned.
+	Next() ([]NodeInfo, error)
+	Close() error
+}
+
+// Lister is optionally implemented by a Storage listing directories without loading them in memory at once.
+type Lister interface {
+	List(path string, options ListOptions) (NodeIterator, error)
+	ListWithContext(ctx context.Context, path string, options ListOptions) (NodeIterator, error)
+}
+
+// WalkFunc is called by Filesystem.Walk for each node, like filepath.WalkFunc. When root cannot be read info is nil,
+// when a directory cannot be listed fn is called a second time for it with the error. Returning SkipDir skips the
+// directory, or the remaining nodes of the parent directory of a file, returning SkipAll stops the walk. Any other
+// error stops the walk and is returned by Walk.
+type WalkFunc func(path string, info NodeInfo, err error) error
+
+// SkipDir is returned by a WalkFunc to skip a directory.
+var SkipDir = fs.SkipDir
+
+// SkipAll is returned by a WalkFunc to stop the walk without failing it.
+var SkipAll = errors.New("skip everything and stop the walk")
+
+// WalkOptions configure a Filesystem.Walk.
+type WalkOptions struct {
+	// Parallelism is the number of directories listed concurrently, 1 when not set. Calls of the WalkFunc never run
+	// concurrently, but with more than one directory listed at a time their order is no longer lexical.
+	Parallelism int
+}
+
+// ConflictPolicy decides what a copy does with the files already existing at its destination. Directories are always
+// merged.
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing file, once its copy is complete.
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip keeps the existing file and skips the copy.
+	ConflictSkip
+	// ConflictRename copies the file next to the existing one, naming it like "name (1).ext".
+	ConflictRename
+	// ConflictFail keeps the existing file and fails the copy of the file with an AlreadyExists Error.
+	ConflictFail
+)
+
+// CopyProgress is the state of a copy when a file progressed. Bytes and Files count the skipped and failed files too,
+// so they reach TotalBytes and TotalFiles once the copy is done.
+type CopyProgress struct {
+	// Path and DstPath are the source and destination of the file that progressed, FileBytes of its FileSize being
+	// copied so far.
+	Path      string
+	DstPath   string
+	FileBytes int64
+	FileSize  int64
+	// FileDone is set once the file was copied, skipped or failed, then FileErr is its failure.
+	FileDone bool
+	FileErr  error
+
+	Bytes      int64
+	TotalBytes int64
+	Files      int
+	TotalFiles int
+	Elapsed    time.Duration
+	// ETA is the estimated time left, 0 until some bytes were copied.
+	ETA time.Duration
+}
+
+// CopyOptions configure a Filesystem.CopyWithOptions.
+type CopyOptions struct {
+	// Parallelism is the number of files copied concurrently, 4 when not set.
+	Parallelism int
+	Conflict    ConflictPolicy
+	// Checksum verifies every copied file by reading it back and comparing its content with what was read from the
+	// source. Copied files are always verified to have the size read from the source.
+	Checksum bool
+	// OnFileProgress is called as the bytes of each file are copied, and once the file is done. OnProgress is only
+	// called once each file is done. Calls never run concurrently, slow callbacks slow the copy down.
+	OnFileProgress func(progress CopyProgress)
+	OnProgress     func(progress CopyProgress)
+}
+
+// CopyFailure is a file or directory a copy failed to copy.
+type CopyFailure struct {
+	Path string
+	Err  error
+}
+
+// CopyReport is the outcome of a copy.
+type CopyReport struct {
+	// Files and Bytes are the files copied and their size.
+	Files int
+	Bytes int64
+	// Skipped are the source paths of files left alone because of the ConflictSkip policy.
+	Skipped []string
+	// Failed are sorted by path.
+	Failed []CopyFailure
+}
+
+// Err returns the failure of the copy as an error, nil when nothing failed.
+func (r *CopyReport) Err() error {
+	switch len(r.Failed) {
+	case 0:
+		return nil
+	case 1:
+		return r.Failed[0].Err
+	}
+
+	return fmt.Errorf("failed to copy %d files, first '%s', %w", len(r.Failed), r.Failed[0].Path, r.Failed[0].Err)
+}
+
 type NodeInfo interface {
 	fs.FileInfo
 	webdav.ContentTyper
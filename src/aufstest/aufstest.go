@@ -0,0 +1,480 @@
+// Package aufstest verifies aufs.Storage implementations behave like the storages of this module. A backend runs the
+// suite from its own tests:
+//
+//	func TestStorage(t *testing.T) {
+//		aufstest.Run(t, func(t *testing.T) aufs.Storage {
+//			return newMyStorage(t.TempDir())
+//		})
+//	}
+package aufstest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/storager"
+	"go.beyondstorage.io/v5/services"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Factory returns an empty storage for a test, resources it needs can be released with t.Cleanup.
+type Factory func(t *testing.T) aufs.Storage
+
+// StoragerFactory returns a Factory of storages over the beyondstorage service of the connection string returned by
+// uri, e.g. "fs://" + t.TempDir() or "memory://".
+func StoragerFactory(uri func(t *testing.T) string) Factory {
+	return func(t *testing.T) aufs.Storage {
+		connStr := uri(t)
+		s, err := services.NewStoragerFromString(connStr)
+		if err != nil {
+			t.Fatalf("failed to create storager '%s', %s", connStr, err.Error())
+		}
+
+		return storager.NewStorager(t.Name(), s)
+	}
+}
+
+type behavior struct {
+	name string
+	test func(t *testing.T, s aufs.Storage)
+}
+
+var behaviors = []behavior{
+	{"WriteRead", testWriteRead},
+	{"Overwrite", testOverwrite},
+	{"Append", testAppend},
+	{"OpenExclusive", testOpenExclusive},
+	{"Seek", testSeek},
+	{"StatFile", testStatFile},
+	{"StatMissing", testStatMissing},
+	{"MkDir", testMkDir},
+	{"DeleteFile", testDeleteFile},
+	{"DeleteNested", testDeleteNested},
+	{"CopyFile", testCopyFile},
+	{"CopyDir", testCopyDir},
+	{"MoveFile", testMoveFile},
+	{"MoveDir", testMoveDir},
+	{"ListDir", testListDir},
+	{"ListDirRecursive", testListDirRecursive},
+	{"List", testList},
+	{"SpecialNames", testSpecialNames},
+	{"ConcurrentWrites", testConcurrentWrites},
+	{"ConcurrentReads", testConcurrentReads},
+}
+
+// Run runs every behavioral test as a subtest of t, each on a new storage from factory. Tests of optional operations,
+// appending, copying and moving within the storage, are skipped when the storage fails them with a NotSupported error.
+func Run(t *testing.T, factory Factory) {
+	for _, b := range behaviors {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			b.test(t, factory(t))
+		})
+	}
+}
+
+// check fails t when err is not nil.
+func check(t *testing.T, err error, format string, args ...interface{}) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s failed, %s", fmt.Sprintf(format, args...), err.Error())
+	}
+}
+
+// checkOptional fails t when err is not nil, skipping it when err is a NotSupported error. It only checks operations
+// storages may not support.
+func checkOptional(t *testing.T, err error, format string, args ...interface{}) {
+	t.Helper()
+	if aufs.CodeOf(err) == aufs.NotSupported {
+		t.Skipf("%s not supported, %s", fmt.Sprintf(format, args...), err.Error())
+	}
+	check(t, err, format, args...)
+}
+
+func writeFile(t *testing.T, s aufs.Storage, filePath string, content string) {
+	t.Helper()
+	check(t, internal.CreateFile(s, filePath, strings.NewReader(content)), "write '%s'", filePath)
+}
+
+func readFile(t *testing.T, s aufs.Storage, filePath string) string {
+	t.Helper()
+	file, err := s.OpenFile(filePath, os.O_RDONLY)
+	check(t, err, "open '%s'", filePath)
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	check(t, err, "read '%s'", filePath)
+	return string(content)
+}
+
+func mkDir(t *testing.T, s aufs.Storage, dirPath string) {
+	t.Helper()
+	_, err := s.MkDir(dirPath)
+	check(t, err, "mkdir '%s'", dirPath)
+}
+
+func expectContent(t *testing.T, s aufs.Storage, filePath string, want string) {
+	t.Helper()
+	got := readFile(t, s, filePath)
+	if got != want {
+		t.Fatalf("content of '%s' is %q, want %q", filePath, got, want)
+	}
+}
+
+func expectMissing(t *testing.T, s aufs.Storage, filePath string) {
+	t.Helper()
+	_, err := s.Stat(filePath)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat of '%s' returned %v, want an error matching fs.ErrNotExist", filePath, err)
+	}
+}
+
+// names returns the cleaned paths of infos, sorted.
+func names(infos []aufs.NodeInfo) []string {
+	paths := make([]string, 0, len(infos))
+	for _, info := range infos {
+		paths = append(paths, strings.Trim(path.Clean("/"+info.Path()), "/"))
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func expectPaths(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("%s lists %q, want %q", what, got, want)
+	}
+}
+
+func testWriteRead(t *testing.T, s aufs.Storage) {
+	writeFile(t, s, "file.txt", "hello aufs")
+	expectContent(t, s, "file.txt", "hello aufs")
+
+	writeFile(t, s, "empty.txt", "")
+	expectContent(t, s, "empty.txt", "")
+}
+
+func testOverwrite(t *testing.T, s aufs.Storage) {
+	writeFile(t, s, "file.txt", "a much longer first version")
+	writeFile(t, s, "file.txt", "short")
+	expectContent(t, s, "file.txt", "short")
+}
+
+func testAppend(t *testing.T, s aufs.Storage) {
+	writeFile(t, s, "file.txt", "hello")
+
+	file, err := s.OpenFile("file.txt", os.O_WRONLY|os.O_APPEND)
+	checkOptional(t, err, "open 'file.txt' to append")
+	_, err = file.Write([]byte(" world"))
+	check(t, err, "append to 'file.txt'")
+	check(t, file.Close(), "close 'file.txt'")
+
+	expectContent(t, s, "file.txt", "hello world")
+}
+
+func testOpenExclusive(t *testing.T, s aufs.Storage) {
+	writeFile(t, s, "file.txt", "content")
+
+	_, err := s.OpenFile("file.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("exclusive open of existing file returned %v, want an error matching fs.ErrExist", err)
+	}
+
+	_, err = s.OpenFile("missing.txt", os.O_RDONLY)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("open of missing file returned %v, want an error matching fs.ErrNotExist", err)
+	}
+}
+
+// testSeek checks files follow io.Seeker semantics, which HTTP range requests rely on.
+func testSeek(t *testing.T, s aufs.Storage) {
+	writeFile(t, s, "file.txt", "0123456789")
+	file, err := s.OpenFile("file.txt", os.O_RDONLY)
+	check(t, err, "open 'file.txt'")
+	defer file.Close()
+
+	seek := func(offset int64, whence int, want int64) {
+		t.Helper()
+		got, err := file.Seek(offset, whence)
+		check(t, err, "seek %d from %d", offset, whence)
+		if got != want {
+			t.Fatalf("seek %d from %d returned %d, want %d", offset, whence, got, want)
+		}
+	}
+	read := func(n int, want string, wantErr error) {
+		t.Helper()
+		buf := make([]byte, n)
+		got, err := io.ReadFull(file, buf)
+		if string(buf[:got]) != want || !errors.Is(err, wantErr) {
+			t.Fatalf("read of %d returned %q and %v, want %q and %v", n, buf[:got], err, want, wantErr)
+		}
+	}
+
+	seek(-3, io.SeekEnd, 7)
+	read(3, "789", nil)
+	read(1, "", io.EOF)
+
+	seek(2, io.SeekStart, 2)
+	read(4, "2345", nil)
+	seek(-1, io.SeekCurrent, 5)
+	read(2, "56", nil)
+
+	seek(20, io.SeekStart, 20)
+	read(1, "", io.EOF)
+
+	_, err = file.Seek(-11, io.SeekEnd)
+	if err == nil {
+		t.Fatalf("seek before the start of the file succeeded")
+	}
+}
+
+func testStatFile(t *testing.T, s aufs.Storage) {
+	writeFile(t, s, "file.txt", "12345")
+
+	info, err := s.Stat("file.txt")
+	check(t, err, "stat 'file.txt'")
+	if info.Name() != "file.txt" || info.Size() != 5 || info.IsDir() {
+		t.Fatalf("stat of 'file.txt' returned name %q, size %d and dir %t", info.Name(), info.Size(), info.IsDir())
+	}
+}
+
+func testStatMissing(t *testing.T, s aufs.Storage) {
+	expectMissing(t, s, "missing.txt")
+	expectMissing(t, s, "missing/nested.txt")
+}
+
+func testMkDir(t *testing.T, s aufs.Storage) {
+	mkDir(t, s, "dir")
+
+	info, err := s.Stat("dir")
+	check(t, err, "stat 'dir'")
+	if !info.IsDir() {
+		t.Fatalf("stat of created directory is not a directory")
+	}
+
+	writeFile(t, s, "dir/file.txt", "content")
+	expectContent(t, s, "dir/file.txt", "content")
+}
+
+func testDeleteFile(t *testing.T, s aufs.Storage) {
+	writeFile(t, s, "file.txt", "content")
+	check(t, s.Delete("file.txt"), "delete 'file.txt'")
+	expectMissing(t, s, "file.txt")
+}
+
+// testDeleteNested removes a tree the way the filesystem does, with internal.ManualDelete.
+func testDeleteNested(t *testing.T, s aufs.Storage) {
+	mkDir(t, s, "dir")
+	mkDir(t, s, "dir/sub")
+	writeFile(t, s, "dir/a.txt", "a")
+	writeFile(t, s, "dir/sub/b.txt", "b")
+	writeFile(t, s, "kept.txt", "kept")
+
+	check(t, internal.ManualDelete(s, "dir"), "delete 'dir'")
+	expectMissing(t, s, "dir/sub/b.txt")
+	expectMissing(t, s, "dir/a.txt")
+	expectMissing(t, s, "dir")
+	expectContent(t, s, "kept.txt", "kept")
+}
+
+func testCopyFile(t *testing.T, s aufs.Storage) {
+	writeFile(t, s, "src.txt", "content")
+	checkOptional(t, s.Copy("src.txt", "dst.txt"), "copy 'src.txt'")
+	expectContent(t, s, "src.txt", "content")
+	expectContent(t, s, "dst.txt", "content")
+}
+
+func testCopyDir(t *testing.T, s aufs.Storage) {
+	mkDir(t, s, "src")
+	mkDir(t, s, "src/sub")
+	writeFile(t, s, "src/a.txt", "a")
+	writeFile(t, s, "src/sub/b.txt", "b")
+
+	check(t, internal.ManualCopy(s, s, "src", "dst"), "copy 'src'")
+	expectContent(t, s, "dst/a.txt", "a")
+	expectContent(t, s, "dst/sub/b.txt", "b")
+	expectContent(t, s, "src/sub/b.txt", "b")
+
+	checkOptional(t, s.Copy("src", "other"), "copy 'src'")
+	expectContent(t, s, "other/sub/b.txt", "b")
+}
+
+func testMoveFile(t *testing.T, s aufs.Storage) {
+	writeFile(t, s, "src.txt", "content")
+	checkOptional(t, s.Move("src.txt", "dst.txt"), "move 'src.txt'")
+	expectMissing(t, s, "src.txt")
+	expectContent(t, s, "dst.txt", "content")
+}
+
+func testMoveDir(t *testing.T, s aufs.Storage) {
+	mkDir(t, s, "src")
+	writeFile(t, s, "src/a.txt", "a")
+
+	checkOptional(t, s.Move("src", "dst"), "move 'src'")
+	expectMissing(t, s, "src/a.txt")
+	expectContent(t, s, "dst/a.txt", "a")
+}
+
+func listFixture(t *testing.T, s aufs.Storage) {
+	mkDir(t, s, "list")
+	mkDir(t, s, "list/dir")
+	writeFile(t, s, "list/a.txt", "a")
+	writeFile(t, s, "list/b.txt", "b")
+	writeFile(t, s, "list/dir/c.txt", "c")
+}
+
+func testListDir(t *testing.T, s aufs.Storage) {
+	listFixture(t, s)
+
+	infos, err := s.ListDir("list", false)
+	check(t, err, "list 'list'")
+	expectPaths(t, "'list'", names(infos), "list/a.txt", "list/b.txt", "list/dir")
+
+	for _, info := range infos {
+		if info.IsDir() != (info.Name() == "dir") {
+			t.Fatalf("listed '%s' with dir %t", info.Path(), info.IsDir())
+		}
+	}
+}
+
+func testListDirRecursive(t *testing.T, s aufs.Storage) {
+	listFixture(t, s)
+
+	infos, err := s.ListDir("list", true)
+	check(t, err, "list 'list' recursively")
+	expectPaths(t, "'list' recursively", names(infos), "list/a.txt", "list/b.txt", "list/dir", "list/dir/c.txt")
+}
+
+func testList(t *testing.T, s aufs.Storage) {
+	lister, ok := s.(aufs.Lister)
+	if !ok {
+		t.Skip("storage is not an aufs.Lister")
+	}
+
+	mkDir(t, s, "list")
+	var want []string
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("list/f%02d.txt", i)
+		writeFile(t, s, name, name)
+		want = append(want, name)
+	}
+
+	iterator, err := lister.List("list", aufs.ListOptions{PageSize: 10, Sort: aufs.ListSortByName})
+	check(t, err, "list 'list'")
+	defer iterator.Close()
+
+	var got []aufs.NodeInfo
+	for {
+		page, err := iterator.Next()
+		if err == io.EOF {
+			break
+		}
+		check(t, err, "list page of 'list'")
+		if len(page) > 10 {
+			t.Fatalf("page of %d nodes exceeds the page size of 10", len(page))
+		}
+		got = append(got, page...)
+	}
+
+	expectPaths(t, "'list' by pages", names(got), want...)
+}
+
+func testSpecialNames(t *testing.T, s aufs.Storage) {
+	mkDir(t, s, "special")
+	fileNames := []string{
+		"ünïcødé 文件.txt",
+		"with space.txt",
+		"a+b&c=d#e%f.txt",
+		"quote'and\"double.txt",
+		"emoji-🙂.txt",
+	}
+
+	var want []string
+	for _, name := range fileNames {
+		filePath := "special/" + name
+		writeFile(t, s, filePath, name)
+		expectContent(t, s, filePath, name)
+
+		info, err := s.Stat(filePath)
+		check(t, err, "stat '%s'", filePath)
+		if info.Name() != name {
+			t.Fatalf("stat of '%s' returned name %q", filePath, info.Name())
+		}
+		want = append(want, filePath)
+	}
+
+	infos, err := s.ListDir("special", false)
+	check(t, err, "list 'special'")
+	expectPaths(t, "'special'", names(infos), want...)
+}
+
+func testConcurrentWrites(t *testing.T, s aufs.Storage) {
+	const writers = 16
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("file%02d.txt", i)
+			errs <- internal.CreateFile(s, name, strings.NewReader(strings.Repeat(name, 100)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		check(t, err, "concurrent write")
+	}
+
+	for i := 0; i < writers; i++ {
+		name := fmt.Sprintf("file%02d.txt", i)
+		expectContent(t, s, name, strings.Repeat(name, 100))
+	}
+}
+
+func testConcurrentReads(t *testing.T, s aufs.Storage) {
+	const readers = 16
+	content := strings.Repeat("0123456789", 10000)
+	writeFile(t, s, "file.txt", content)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, err := s.OpenFile("file.txt", os.O_RDONLY)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer file.Close()
+
+			var buf bytes.Buffer
+			_, err = io.Copy(&buf, file)
+			if err == nil && buf.String() != content {
+				err = fmt.Errorf("read %d bytes differing from the %d written", buf.Len(), len(content))
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		check(t, err, "concurrent read")
+	}
+}
@@ -0,0 +1,191 @@
+package aufs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"syscall"
+)
+
+// PermissionError is the cause of the PermissionDenied Error of an operation rejected by the mode of the mount it
+// targets, see NewPermissionError.
+type PermissionError struct {
+	Mode MountMode
+}
+
+// NewPermissionError returns the Error of op on path rejected by a mount of the given mode.
+func NewPermissionError(op string, path string, mode MountMode) *Error {
+	return NewError(PermissionDenied, op, path, &PermissionError{Mode: mode})
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("mount is %s", e.Mode)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return fs.ErrPermission
+}
+
+// ErrorCode classifies the failures of storage operations.
+type ErrorCode int
+
+const (
+	Unknown ErrorCode = iota
+	NotFound
+	AlreadyExists
+	PermissionDenied
+	NotSupported
+	QuotaExceeded
+	Conflict
+	StorageUnavailable
+)
+
+var (
+	ErrNotSupported       = errors.New("operation not supported")
+	ErrQuotaExceeded      = errors.New("quota exceeded")
+	ErrConflict           = errors.New("conflicting operation")
+	ErrStorageUnavailable = errors.New("storage unavailable")
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	Unknown:            "unknown error",
+	NotFound:           "not found",
+	AlreadyExists:      "already exists",
+	PermissionDenied:   "permission denied",
+	NotSupported:       "not supported",
+	QuotaExceeded:      "quota exceeded",
+	Conflict:           "conflict",
+	StorageUnavailable: "storage unavailable",
+}
+
+func (c ErrorCode) String() string {
+	name, ok := errorCodeNames[c]
+	if !ok {
+		return fmt.Sprintf("error code %d", int(c))
+	}
+
+	return name
+}
+
+// sentinel returns the error errors.Is matches errors of code c against.
+func (c ErrorCode) sentinel() error {
+	switch c {
+	case NotFound:
+		return fs.ErrNotExist
+	case AlreadyExists:
+		return fs.ErrExist
+	case PermissionDenied:
+		return fs.ErrPermission
+	case NotSupported:
+		return ErrNotSupported
+	case QuotaExceeded:
+		return ErrQuotaExceeded
+	case Conflict:
+		return ErrConflict
+	case StorageUnavailable:
+		return ErrStorageUnavailable
+	}
+
+	return nil
+}
+
+// Error is a classified failure of an operation on a path. It matches the sentinel of its code with errors.Is, e.g.
+// fs.ErrNotExist for NotFound or ErrStorageUnavailable for StorageUnavailable, and unwraps to the underlying error.
+type Error struct {
+	Code ErrorCode
+	Op   string
+	Path string
+	Err  error
+}
+
+func NewError(code ErrorCode, op string, path string, err error) *Error {
+	return &Error{
+		Code: code,
+		Op:   op,
+		Path: path,
+		Err:  err,
+	}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s '%s' failed, %s", e.Op, e.Path, e.Code)
+	}
+
+	return fmt.Sprintf("%s '%s' failed, %s: %s", e.Op, e.Path, e.Code, e.Err.Error())
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	sentinel := e.Code.sentinel()
+	return sentinel != nil && target == sentinel
+}
+
+// CodeOf classifies err, looking for an Error in its chain first and then for well-known errors.
+func CodeOf(err error) ErrorCode {
+	var typed *Error
+	if errors.As(err, &typed) {
+		return typed.Code
+	}
+
+	switch {
+	case err == nil:
+		return Unknown
+	case errors.Is(err, fs.ErrNotExist):
+		return NotFound
+	case errors.Is(err, fs.ErrExist):
+		return AlreadyExists
+	case errors.Is(err, fs.ErrPermission):
+		return PermissionDenied
+	case errors.Is(err, ErrNotSupported):
+		return NotSupported
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, syscall.ENOSPC):
+		return QuotaExceeded
+	case errors.Is(err, ErrConflict):
+		return Conflict
+	case errors.Is(err, ErrStorageUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return StorageUnavailable
+	}
+
+	return Unknown
+}
+
+// HTTPStatus returns the HTTP status answering a request that failed with an error of code c.
+func (c ErrorCode) HTTPStatus() int {
+	switch c {
+	case NotFound:
+		return http.StatusNotFound
+	case AlreadyExists, Conflict:
+		return http.StatusConflict
+	case PermissionDenied:
+		return http.StatusForbidden
+	case NotSupported:
+		return http.StatusMethodNotAllowed
+	case QuotaExceeded:
+		return http.StatusInsufficientStorage
+	case StorageUnavailable:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+// WrapError classifies err as an Error of op on path, errors already classified or not recognized are returned as-is.
+func WrapError(op string, path string, err error) error {
+	var typed *Error
+	if err == nil || errors.As(err, &typed) {
+		return err
+	}
+
+	code := CodeOf(err)
+	if code == Unknown {
+		return err
+	}
+
+	return NewError(code, op, path, err)
+}
@@ -0,0 +1,220 @@
+package aufs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type EventKind int
+
+const (
+	EventCreated EventKind = iota + 1
+	EventModified
+	EventDeleted
+	EventMoved
+	EventCopied
+	EventDirCreated
+	EventMounted
+	EventUnmounted
+)
+
+func (k EventKind) String() string {
+	name, ok := eventKindNames[k]
+	if !ok {
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+
+	return name
+}
+
+var eventKindNames = map[EventKind]string{
+	EventCreated:    "created",
+	EventModified:   "modified",
+	EventDeleted:    "deleted",
+	EventMoved:      "moved",
+	EventCopied:     "copied",
+	EventDirCreated: "dir-created",
+	EventMounted:    "mounted",
+	EventUnmounted:  "unmounted",
+}
+
+// ParseEventKind returns the kind named name, as returned by EventKind.String.
+func ParseEventKind(name string) (EventKind, error) {
+	for kind, kindName := range eventKindNames {
+		if kindName == name {
+			return kind, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown event kind '%s'", name)
+}
+
+// Event describes a change done through a Filesystem.
+type Event struct {
+	// Seq increases monotonically with every event of a filesystem, it survives restarts when events are journaled.
+	Seq  uint64
+	Kind EventKind
+	// Path is the filesystem path of the changed node, the destination of moves and copies, or the mount point.
+	Path string
+	// OldPath is the source of moves and copies, empty otherwise.
+	OldPath string
+	// StorageId is the id of the storage Path resolved to.
+	StorageId string
+	// Info is the state of the node after the operation, nil when deleted or when the storage could not tell.
+	Info NodeInfo
+	Time time.Time
+	// Actor and RequestId identify who and which request caused the change, when known from the operation context.
+	Actor     string
+	RequestId string
+}
+
+type jsonNodeInfo struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	IsDir    bool      `json:"is_dir"`
+	MimeType string    `json:"mime_type,omitempty"`
+	ETag     string    `json:"etag,omitempty"`
+}
+
+type jsonEvent struct {
+	Seq       uint64        `json:"seq,omitempty"`
+	Kind      string        `json:"kind"`
+	Path      string        `json:"path"`
+	OldPath   string        `json:"old_path,omitempty"`
+	StorageId string        `json:"storage_id,omitempty"`
+	Info      *jsonNodeInfo `json:"info,omitempty"`
+	Time      time.Time     `json:"time"`
+	Actor     string        `json:"actor,omitempty"`
+	RequestId string        `json:"request_id,omitempty"`
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	event := jsonEvent{
+		Seq:       e.Seq,
+		Kind:      e.Kind.String(),
+		Path:      e.Path,
+		OldPath:   e.OldPath,
+		StorageId: e.StorageId,
+		Time:      e.Time,
+		Actor:     e.Actor,
+		RequestId: e.RequestId,
+	}
+
+	if e.Info != nil {
+		event.Info = &jsonNodeInfo{
+			Path:     e.Info.Path(),
+			Size:     e.Info.Size(),
+			ModTime:  e.Info.ModTime(),
+			IsDir:    e.Info.IsDir(),
+			MimeType: e.Info.MimeType(),
+			ETag:     e.Info.ETag(),
+		}
+	}
+
+	return json.Marshal(event)
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var event jsonEvent
+	err := json.Unmarshal(data, &event)
+	if err != nil {
+		return err
+	}
+
+	kind, err := ParseEventKind(event.Kind)
+	if err != nil {
+		return err
+	}
+
+	*e = Event{
+		Seq:       event.Seq,
+		Kind:      kind,
+		Path:      event.Path,
+		OldPath:   event.OldPath,
+		StorageId: event.StorageId,
+		Time:      event.Time,
+		Actor:     event.Actor,
+		RequestId: event.RequestId,
+	}
+
+	if event.Info != nil {
+		info := event.Info
+		e.Info = NewNodeInfo(info.Path, info.Size, info.ModTime, info.IsDir, info.MimeType, info.ETag)
+	}
+
+	return nil
+}
+
+// EventHandler receives the events of a Filesystem.
+type EventHandler interface {
+	HandleEvent(event Event)
+}
+
+type EventHandlerFunc func(event Event)
+
+func (f EventHandlerFunc) HandleEvent(event Event) {
+	f(event)
+}
+
+// EventJournal durably records events, numbering them.
+type EventJournal interface {
+	// Append records event and returns its sequence number.
+	Append(event Event) (uint64, error)
+	// Replay delivers the recorded events from fromSeq on, in order.
+	Replay(fromSeq uint64, handler EventHandler) error
+}
+
+type legacyListener struct {
+	listener EventListener
+}
+
+// LegacyListener adapts an EventListener to receive the events of an EventHandler. Creations, modifications and copies
+// are reported as changes, mount changes only reach listeners implementing MountListener.
+func LegacyListener(listener EventListener) EventHandler {
+	return &legacyListener{listener: listener}
+}
+
+func (l *legacyListener) HandleEvent(event Event) {
+	switch event.Kind {
+	case EventCreated, EventModified, EventCopied, EventDirCreated:
+		l.listener.Changed(event.Path)
+	case EventDeleted:
+		l.listener.Deleted(event.Path)
+	case EventMoved:
+		l.listener.Moved(event.OldPath, event.Path)
+	case EventMounted:
+		if mountListener, ok := l.listener.(MountListener); ok {
+			mountListener.Mounted(event.Path)
+		}
+	case EventUnmounted:
+		if mountListener, ok := l.listener.(MountListener); ok {
+			mountListener.Unmounted(event.Path)
+		}
+	}
+}
+
+type actorContextKey struct{}
+type requestIdContextKey struct{}
+
+// WithActor returns a context attributing the operations done with it to actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorContextKey{}).(string)
+	return actor
+}
+
+// WithRequestId returns a context attributing the operations done with it to the request id.
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey{}, requestId)
+}
+
+func RequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey{}).(string)
+	return requestId
+}
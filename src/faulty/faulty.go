@@ -0,0 +1,274 @@
+package faulty
+
+import (
+	"context"
+	"errors"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Op names the operations faults are injected in.
+type Op string
+
+const (
+	OpOpen   Op = "open"
+	OpStat   Op = "stat"
+	OpDelete Op = "delete"
+	OpCopy   Op = "copy"
+	OpMove   Op = "move"
+	OpList   Op = "list"
+	OpMkDir  Op = "mkdir"
+	OpRead   Op = "read"
+	OpWrite  Op = "write"
+	OpClose  Op = "close"
+)
+
+// ErrInjected is the default error of faults configured by uri.
+var ErrInjected = errors.New("injected fault")
+
+// Fault describes the failure of the calls it matches. A fault matching a call applies its latency, then hangs, cuts
+// reads and writes short or fails as configured.
+type Fault struct {
+	// Op limits the fault to an operation, any operation when empty. File reads, writes and closes are operations of
+	// their own.
+	Op Op
+	// Path limits the fault to paths matching this glob pattern, "**" matching any number of directories. Copies and
+	// moves match on their source path.
+	Path string
+
+	// OnCall only faults the Nth call matching Op and Path, counting from 1, every call when 0.
+	OnCall int
+	// Rate is the probability of faulting a matching call, every call when 0.
+	Rate float64
+	// Times is the number of calls faulted before the fault is disarmed, unlimited when 0.
+	Times int
+
+	// Err is returned by faulted calls, classified like errors of storages, e.g. fs.ErrNotExist fails calls with a
+	// NotFound aufs.Error. Faulted calls succeed when nil.
+	Err error
+	// Latency delays faulted calls.
+	Latency time.Duration
+	// Hang blocks faulted calls until their context is done, or until the faults are reset for calls without context.
+	Hang bool
+	// Partial limits faulted reads and writes to this many bytes. Short writes fail with io.ErrShortWrite when Err is
+	// nil.
+	Partial int
+}
+
+type rule struct {
+	Fault
+	calls  int
+	faults int
+}
+
+// Storage injects faults in the operations of the storage it wraps, to test how failures are handled.
+type Storage struct {
+	id      string
+	storage aufs.ContextStorage
+
+	mu      sync.Mutex
+	rules   []*rule
+	rand    *rand.Rand
+	release chan struct{}
+}
+
+var _ aufs.ContextStorage = &Storage{}
+
+func New(id string, storage aufs.Storage) *Storage {
+	return &Storage{
+		id:      id,
+		storage: internal.WithContext(storage),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *Storage) Id() string {
+	return s.id
+}
+
+// Inject adds a fault, faults are checked in the order they were injected and the first one faulting a call applies.
+func (s *Storage) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules = append(s.rules, &rule{Fault: fault})
+}
+
+// Reset removes every fault and releases the calls hanging.
+func (s *Storage) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules = nil
+	close(s.release)
+	s.release = make(chan struct{})
+}
+
+// fault returns the fault of the first rule faulting a call of op on path, nil when none does.
+func (s *Storage) fault(op Op, path string) (*Fault, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.rules {
+		if r.Op != "" && r.Op != op {
+			continue
+		}
+		if r.Path != "" && !internal.MatchGlob(r.Path, path) {
+			continue
+		}
+
+		r.calls++
+		if r.OnCall > 0 && r.calls != r.OnCall {
+			continue
+		}
+		if r.Times > 0 && r.faults >= r.Times {
+			continue
+		}
+		if r.Rate > 0 && s.rand.Float64() >= r.Rate {
+			continue
+		}
+
+		r.faults++
+		fault := r.Fault
+		return &fault, s.release
+	}
+
+	return nil, nil
+}
+
+// apply runs the fault of a call of op on path, if any, and returns the error the call fails with.
+func (s *Storage) apply(ctx context.Context, op Op, path string) (*Fault, error) {
+	fault, release := s.fault(op, path)
+	if fault == nil {
+		return nil, nil
+	}
+
+	if fault.Latency > 0 {
+		timer := time.NewTimer(fault.Latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fault, ctx.Err()
+		}
+	}
+
+	if fault.Hang {
+		select {
+		case <-ctx.Done():
+			return fault, ctx.Err()
+		case <-release:
+		}
+	}
+
+	if fault.Err == nil {
+		return fault, nil
+	}
+
+	return fault, aufs.WrapError(string(op), path, fault.Err)
+}
+
+func (s *Storage) Open(path string) (aufs.File, error) {
+	return s.OpenFileWithContext(context.Background(), path, os.O_RDWR|os.O_CREATE)
+}
+
+func (s *Storage) OpenFile(path string, flag int) (aufs.File, error) {
+	return s.OpenFileWithContext(context.Background(), path, flag)
+}
+
+func (s *Storage) OpenFileWithContext(ctx context.Context, path string, flag int) (aufs.File, error) {
+	_, err := s.apply(ctx, OpOpen, path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := s.storage.OpenFileWithContext(ctx, path, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultyFile{File: file, ctx: ctx, storage: s, path: path}, nil
+}
+
+func (s *Storage) Stat(path string) (aufs.NodeInfo, error) {
+	return s.StatWithContext(context.Background(), path)
+}
+
+func (s *Storage) StatWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
+	_, err := s.apply(ctx, OpStat, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.storage.StatWithContext(ctx, path)
+}
+
+func (s *Storage) Delete(path string) error {
+	return s.DeleteWithContext(context.Background(), path)
+}
+
+func (s *Storage) DeleteWithContext(ctx context.Context, path string) error {
+	_, err := s.apply(ctx, OpDelete, path)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.DeleteWithContext(ctx, path)
+}
+
+func (s *Storage) Copy(srcPath string, dstPath string) error {
+	return s.CopyWithContext(context.Background(), srcPath, dstPath)
+}
+
+func (s *Storage) CopyWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	_, err := s.apply(ctx, OpCopy, srcPath)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.CopyWithContext(ctx, srcPath, dstPath)
+}
+
+func (s *Storage) Move(srcPath string, dstPath string) error {
+	return s.MoveWithContext(context.Background(), srcPath, dstPath)
+}
+
+func (s *Storage) MoveWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	_, err := s.apply(ctx, OpMove, srcPath)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.MoveWithContext(ctx, srcPath, dstPath)
+}
+
+func (s *Storage) ListDir(path string, recursive bool) ([]aufs.NodeInfo, error) {
+	return s.ListDirWithContext(context.Background(), path, recursive)
+}
+
+func (s *Storage) ListDirWithContext(ctx context.Context, path string, recursive bool) ([]aufs.NodeInfo, error) {
+	_, err := s.apply(ctx, OpList, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.storage.ListDirWithContext(ctx, path, recursive)
+}
+
+func (s *Storage) MkDir(path string) (aufs.NodeInfo, error) {
+	return s.MkDirWithContext(context.Background(), path)
+}
+
+func (s *Storage) MkDirWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
+	_, err := s.apply(ctx, OpMkDir, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.storage.MkDirWithContext(ctx, path)
+}
@@ -0,0 +1,166 @@
+package faulty_test
+
+import (
+	"context"
+	"errors"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/faulty"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/storager"
+	"go.beyondstorage.io/v5/services"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFaultyStorage returns a faulty storage over a memory storage holding "a.txt" and "dir/sub/b.txt".
+func newFaultyStorage(t *testing.T) *faulty.Storage {
+	s, err := services.NewStoragerFromString("memory://")
+	if err != nil {
+		t.Fatalf("failed to create storager, %s", err.Error())
+	}
+
+	storage := storager.NewStorager("memory", s)
+	for _, filePath := range []string{"a.txt", "dir/sub/b.txt"} {
+		err = internal.CreateFile(storage, filePath, strings.NewReader("hello"))
+		if err != nil {
+			t.Fatalf("failed to write '%s', %s", filePath, err.Error())
+		}
+	}
+
+	return faulty.New("faulty", storage)
+}
+
+func TestFaultMatching(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		fault faulty.Fault
+		paths []string
+		want  []bool
+	}{
+		{"every call", faulty.Fault{}, []string{"a.txt", "a.txt", "a.txt"}, []bool{true, true, true}},
+		{"on call", faulty.Fault{OnCall: 2}, []string{"a.txt", "a.txt", "a.txt"}, []bool{false, true, false}},
+		{"times", faulty.Fault{Times: 2}, []string{"a.txt", "a.txt", "a.txt"}, []bool{true, true, false}},
+		{"on call once", faulty.Fault{OnCall: 1, Times: 1}, []string{"a.txt", "a.txt"}, []bool{true, false}},
+		{"other op", faulty.Fault{Op: faulty.OpOpen}, []string{"a.txt", "a.txt"}, []bool{false, false}},
+		{"stat op", faulty.Fault{Op: faulty.OpStat}, []string{"a.txt"}, []bool{true}},
+		{"path", faulty.Fault{Path: "dir/**"}, []string{"a.txt", "dir/sub/b.txt"}, []bool{false, true}},
+		{"rate of 1", faulty.Fault{Rate: 1}, []string{"a.txt", "a.txt"}, []bool{true, true}},
+	} {
+		s := newFaultyStorage(t)
+		test.fault.Err = faulty.ErrInjected
+		s.Inject(test.fault)
+
+		for i, filePath := range test.paths {
+			_, err := s.Stat(filePath)
+			if errors.Is(err, faulty.ErrInjected) != test.want[i] {
+				t.Fatalf("%s: stat %d of '%s' returned %v, want faulted %t", test.name, i+1, filePath, err, test.want[i])
+			}
+			if err != nil && !test.want[i] {
+				t.Fatalf("%s: stat %d of '%s' failed, %s", test.name, i+1, filePath, err.Error())
+			}
+		}
+	}
+}
+
+func TestFaultRate(t *testing.T) {
+	s := newFaultyStorage(t)
+	s.Inject(faulty.Fault{Rate: 0.5, Err: faulty.ErrInjected})
+
+	faulted := 0
+	for i := 0; i < 1000; i++ {
+		_, err := s.Stat("a.txt")
+		if errors.Is(err, faulty.ErrInjected) {
+			faulted++
+		}
+	}
+	if faulted < 350 || faulted > 650 {
+		t.Fatalf("rate of 0.5 faulted %d calls of 1000", faulted)
+	}
+}
+
+func TestFaultClassified(t *testing.T) {
+	s := newFaultyStorage(t)
+	s.Inject(faulty.Fault{Err: aufs.ErrStorageUnavailable})
+
+	_, err := s.Stat("a.txt")
+	if aufs.CodeOf(err) != aufs.StorageUnavailable {
+		t.Fatalf("faulted stat returned %v, want a StorageUnavailable error", err)
+	}
+}
+
+func TestFaultPartial(t *testing.T) {
+	s := newFaultyStorage(t)
+	s.Inject(faulty.Fault{Op: faulty.OpRead, Partial: 2})
+	s.Inject(faulty.Fault{Op: faulty.OpWrite, Partial: 2})
+
+	file, err := s.OpenFile("a.txt", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("failed to open 'a.txt', %s", err.Error())
+	}
+	p := make([]byte, 5)
+	n, err := file.Read(p)
+	_ = file.Close()
+	if n != 2 || err != nil {
+		t.Fatalf("partial read returned %d bytes and %v, want 2 bytes", n, err)
+	}
+
+	file, err = s.OpenFile("c.txt", os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		t.Fatalf("failed to open 'c.txt', %s", err.Error())
+	}
+	n, err = file.Write([]byte("hello"))
+	_ = file.Close()
+	if n != 2 || !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("partial write returned %d bytes and %v, want 2 bytes and a short write", n, err)
+	}
+}
+
+func TestFaultHang(t *testing.T) {
+	s := newFaultyStorage(t)
+	s.Inject(faulty.Fault{Op: faulty.OpStat, Hang: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := s.StatWithContext(ctx, "a.txt")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("hanging stat returned %v, want the context error", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Stat("a.txt")
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("hanging stat without context returned %v before the reset", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.Reset()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("released stat failed, %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("hanging stat was not released by the reset")
+	}
+}
+
+func TestFaultLatency(t *testing.T) {
+	s := newFaultyStorage(t)
+	s.Inject(faulty.Fault{Op: faulty.OpStat, Latency: 30 * time.Millisecond})
+
+	started := time.Now()
+	_, err := s.Stat("a.txt")
+	if err != nil {
+		t.Fatalf("delayed stat failed, %s", err.Error())
+	}
+	if elapsed := time.Since(started); elapsed < 30*time.Millisecond {
+		t.Fatalf("stat was delayed %s, want at least 30ms", elapsed)
+	}
+}
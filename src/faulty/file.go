@@ -0,0 +1,108 @@
+package faulty
+
+import (
+	"context"
+	aufs "github.com/aulaga/aufs/src"
+	"io"
+	"io/fs"
+)
+
+// faultyFile injects the read, write and close faults of its storage.
+type faultyFile struct {
+	aufs.File
+	ctx     context.Context
+	storage *Storage
+	path    string
+}
+
+var _ aufs.File = &faultyFile{}
+
+func (f *faultyFile) Storage() aufs.Storage {
+	return f.storage
+}
+
+func (f *faultyFile) Read(p []byte) (int, error) {
+	fault, err := f.storage.apply(f.ctx, OpRead, f.path)
+	if fault == nil {
+		return f.File.Read(p)
+	}
+	if fault.Partial <= 0 {
+		if err != nil {
+			return 0, err
+		}
+		return f.File.Read(p)
+	}
+
+	if len(p) > fault.Partial {
+		p = p[:fault.Partial]
+	}
+	n, readErr := f.File.Read(p)
+	if readErr != nil {
+		return n, readErr
+	}
+
+	return n, err
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	fault, err := f.storage.apply(f.ctx, OpWrite, f.path)
+	if fault == nil {
+		return f.File.Write(p)
+	}
+	if fault.Partial <= 0 {
+		if err != nil {
+			return 0, err
+		}
+		return f.File.Write(p)
+	}
+
+	short := len(p) > fault.Partial
+	if short {
+		p = p[:fault.Partial]
+	}
+	n, writeErr := f.File.Write(p)
+	if writeErr != nil {
+		return n, writeErr
+	}
+	if err == nil && short {
+		err = io.ErrShortWrite
+	}
+
+	return n, err
+}
+
+// Abort discards the writes of the file when the wrapped file can, close faults do not apply.
+func (f *faultyFile) Abort() error {
+	aborter, ok := f.File.(aufs.Aborter)
+	if !ok {
+		return aufs.NewError(aufs.NotSupported, "abort", f.path, nil)
+	}
+
+	return aborter.Abort()
+}
+
+// Close closes the wrapped file. A faulted Close discards the writes like a failed commit would, when the wrapped file
+// can abort them. Otherwise the wrapped file is still closed so faults do not leak files, which commits its writes: the
+// fault then only fails the report of the commit, like a lost acknowledgement.
+func (f *faultyFile) Close() error {
+	_, err := f.storage.apply(f.ctx, OpClose, f.path)
+	if err == nil {
+		return f.File.Close()
+	}
+
+	aborter, ok := f.File.(aufs.Aborter)
+	if !ok || aborter.Abort() != nil {
+		_ = f.File.Close()
+	}
+
+	return err
+}
+
+func (f *faultyFile) Stat() (fs.FileInfo, error) {
+	_, err := f.storage.apply(f.ctx, OpStat, f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.File.Stat()
+}
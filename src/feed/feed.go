@@ -0,0 +1,260 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/storager"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bufferSize        = 4096
+	heartbeatInterval = 15 * time.Second
+	// resetEvent tells clients events were missed since their cursor, they should reload their views.
+	resetEvent = "reset"
+)
+
+// Feed streams the events of the filesystem in the request context, as Server-Sent Events or over a WebSocket when
+// the request asks for an upgrade.
+//
+// The "prefix" query parameter restricts the feed to events under a path. Clients resume from the Last-Event-ID
+// header, or the "last_event_id" query parameter, as long as the events are still in the feed buffer.
+type Feed struct {
+	provider aufs.StorageProvider
+
+	mu   sync.Mutex
+	hubs map[aufs.Filesystem]*hub
+}
+
+// Handler returns a feed over the default storage provider, the one used by webdav.Handler.
+func Handler() http.Handler {
+	return HandlerWithProvider(storager.Default())
+}
+
+// HandlerWithProvider returns a feed over provider, it must be the provider the filesystems are modified through.
+func HandlerWithProvider(provider aufs.StorageProvider) http.Handler {
+	return &Feed{
+		provider: provider,
+		hubs:     map[aufs.Filesystem]*hub{},
+	}
+}
+
+func (f *Feed) hubFromContext(ctx context.Context) (*hub, error) {
+	fsSpec, ok := ctx.Value(aufs.SpecContextKey).(aufs.FileSystemSpec)
+	if !ok {
+		return nil, fmt.Errorf("aulaga filesystem not in context")
+	}
+
+	fs, err := f.provider.ProvideFileSystem(fsSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	h, ok := f.hubs[fs]
+	if !ok {
+		h = newHub(bufferSize)
+		// A feed must never slow down the filesystem, clients falling behind get a reset instead
+		fs.AddEventHandler(h, aufs.ListenerOptions{QueueSize: bufferSize, Overflow: aufs.OverflowDropOldest})
+		f.hubs[fs] = h
+	}
+
+	return h, nil
+}
+
+func (f *Feed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, err := f.hubFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+
+	sub := &subscription{
+		hub:    h,
+		prefix: cleanPrefix(r.URL.Query().Get("prefix")),
+	}
+	if lastEventId != "" {
+		cursor, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid last event id '%s'", lastEventId), http.StatusBadRequest)
+			return
+		}
+		sub.cursor = &cursor
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{Handler: sub.serveWebSocket}.ServeHTTP(w, r)
+		return
+	}
+
+	sub.serveSSE(w, r)
+}
+
+type subscription struct {
+	hub    *hub
+	prefix string
+	cursor *uint64
+}
+
+// cleanPrefix returns prefix as an absolute path without trailing slash, empty for the root.
+func cleanPrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" {
+		return ""
+	}
+
+	return prefix
+}
+
+func (s *subscription) matches(event aufs.Event) bool {
+	if s.prefix == "" {
+		return true
+	}
+
+	return s.under(event.Path) || (event.OldPath != "" && s.under(event.OldPath))
+}
+
+// under matches the prefix path itself and the paths below it, "/a" does not match "/ab".
+func (s *subscription) under(eventPath string) bool {
+	return eventPath == s.prefix || strings.HasPrefix(eventPath, s.prefix+"/")
+}
+
+// stream calls send for every event after the cursor until ctx is done or send fails, reset is called when events
+// were missed. heartbeat is called when the feed has been idle for a while.
+func (s *subscription) stream(ctx context.Context, send func(entry) error, reset func(seq uint64) error, heartbeat func() error) error {
+	wake, latest := s.hub.subscribe()
+	defer s.hub.unsubscribe(wake)
+
+	cursor := latest
+	if s.cursor != nil {
+		cursor = *s.cursor
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		entries, missed := s.hub.since(cursor)
+		if missed {
+			cursor = s.hub.latest()
+			err := reset(cursor)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, e := range entries {
+			cursor = e.Seq
+			if !s.matches(e.Event) {
+				continue
+			}
+
+			err := send(e)
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		case <-ticker.C:
+			err := heartbeat()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *subscription) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(e entry) error {
+		data, err := json.Marshal(e.Event)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Event.Kind, data)
+		flusher.Flush()
+		return err
+	}
+	reset := func(seq uint64) error {
+		_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: {}\n\n", seq, resetEvent)
+		flusher.Flush()
+		return err
+	}
+	heartbeat := func() error {
+		_, err := fmt.Fprint(w, ": heartbeat\n\n")
+		flusher.Flush()
+		return err
+	}
+
+	_ = s.stream(r.Context(), send, reset, heartbeat)
+}
+
+type websocketMessage struct {
+	Id    uint64      `json:"id"`
+	Type  string      `json:"type"`
+	Event *aufs.Event `json:"event,omitempty"`
+}
+
+func (s *subscription) serveWebSocket(conn *websocket.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(conn.Request().Context())
+	defer cancel()
+
+	// Clients are not expected to send anything, reading only detects when they go away
+	go func() {
+		defer cancel()
+		var discard []byte
+		for websocket.Message.Receive(conn, &discard) == nil {
+		}
+	}()
+
+	send := func(e entry) error {
+		event := e.Event
+		return websocket.JSON.Send(conn, websocketMessage{Id: e.Seq, Type: "event", Event: &event})
+	}
+	reset := func(seq uint64) error {
+		return websocket.JSON.Send(conn, websocketMessage{Id: seq, Type: resetEvent})
+	}
+	heartbeat := func() error {
+		return websocket.JSON.Send(conn, websocketMessage{Type: "heartbeat"})
+	}
+
+	_ = s.stream(ctx, send, reset, heartbeat)
+}
@@ -0,0 +1,30 @@
+package feed
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"testing"
+)
+
+func TestSubscriptionMatches(t *testing.T) {
+	for _, test := range []struct {
+		prefix  string
+		event   aufs.Event
+		matches bool
+	}{
+		{"", aufs.Event{Path: "/a/b.txt"}, true},
+		{"/", aufs.Event{Path: "/a/b.txt"}, true},
+		{"/a", aufs.Event{Path: "/a"}, true},
+		{"/a", aufs.Event{Path: "/a/b.txt"}, true},
+		{"/a/", aufs.Event{Path: "/a/b.txt"}, true},
+		{"a", aufs.Event{Path: "/a/b.txt"}, true},
+		{"/a", aufs.Event{Path: "/ab.txt"}, false},
+		{"/a", aufs.Event{Path: "/ab/c.txt"}, false},
+		{"/a", aufs.Event{Path: "/b.txt", OldPath: "/a/b.txt"}, true},
+		{"/a", aufs.Event{Path: "/b.txt", OldPath: "/ab.txt"}, false},
+	} {
+		sub := &subscription{prefix: cleanPrefix(test.prefix)}
+		if sub.matches(test.event) != test.matches {
+			t.Fatalf("prefix '%s' matching %+v returned %t", test.prefix, test.event, !test.matches)
+		}
+	}
+}
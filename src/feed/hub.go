@@ -0,0 +1,99 @@
+package feed
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"sync"
+)
+
+// entry is an event with its position in the feed, used as SSE event id.
+type entry struct {
+	Seq   uint64     `json:"id"`
+	Event aufs.Event `json:"event"`
+}
+
+// hub keeps the latest events of a filesystem in a ring buffer and wakes up subscribers when new ones arrive.
+type hub struct {
+	mu          sync.Mutex
+	seq         uint64
+	ring        []entry
+	next        int
+	subscribers map[chan struct{}]struct{}
+}
+
+var _ aufs.EventHandler = &hub{}
+
+func newHub(size int) *hub {
+	return &hub{
+		ring:        make([]entry, 0, size),
+		subscribers: map[chan struct{}]struct{}{},
+	}
+}
+
+func (h *hub) HandleEvent(event aufs.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	e := entry{Seq: h.seq, Event: event}
+	if len(h.ring) < cap(h.ring) {
+		h.ring = append(h.ring, e)
+	} else {
+		h.ring[h.next] = e
+		h.next = (h.next + 1) % len(h.ring)
+	}
+
+	for wake := range h.subscribers {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel signaled on new events, and the sequence of the latest event.
+func (h *hub) subscribe() (chan struct{}, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	wake := make(chan struct{}, 1)
+	h.subscribers[wake] = struct{}{}
+	return wake, h.seq
+}
+
+func (h *hub) unsubscribe(wake chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, wake)
+}
+
+func (h *hub) latest() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.seq
+}
+
+// since returns the buffered entries after seq, in order. missed tells that entries after seq were already evicted
+// from the ring buffer, or that seq is unknown to the hub.
+func (h *hub) since(seq uint64) (entries []entry, missed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if seq > h.seq {
+		return nil, true
+	}
+	if seq == h.seq {
+		return nil, false
+	}
+
+	for i := 0; i < len(h.ring); i++ {
+		e := h.ring[(h.next+i)%len(h.ring)]
+		if e.Seq > seq {
+			entries = append(entries, e)
+		}
+	}
+
+	missed = len(entries) == 0 || entries[0].Seq != seq+1
+	return entries, missed
+}
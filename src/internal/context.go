@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	aufs "github.com/aulaga/aufs/src"
+	"io"
+	"os"
+)
+
+// WithContext returns storage as a ContextStorage. Storages not supporting contexts are adapted, their operations
+// are then only prevented from starting once the context is done.
+func WithContext(storage aufs.Storage) aufs.ContextStorage {
+	contextStorage, ok := storage.(aufs.ContextStorage)
+	if ok {
+		return contextStorage
+	}
+
+	return contextAdapter{Storage: storage}
+}
+
+type contextAdapter struct {
+	aufs.Storage
+}
+
+func (a contextAdapter) OpenFileWithContext(ctx context.Context, path string, flag int) (aufs.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return a.OpenFile(path, flag)
+}
+
+func (a contextAdapter) StatWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return a.Stat(path)
+}
+
+func (a contextAdapter) DeleteWithContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return a.Delete(path)
+}
+
+func (a contextAdapter) CopyWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return a.Copy(srcPath, dstPath)
+}
+
+func (a contextAdapter) MoveWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return a.Move(srcPath, dstPath)
+}
+
+func (a contextAdapter) ListDirWithContext(ctx context.Context, path string, recursive bool) ([]aufs.NodeInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return a.ListDir(path, recursive)
+}
+
+func (a contextAdapter) MkDirWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return a.MkDir(path)
+}
+
+// Bind returns a view of storage running its plain operations with ctx, so code written against aufs.Storage
+// honors the cancellation of ctx.
+func Bind(ctx context.Context, storage aufs.Storage) aufs.ContextStorage {
+	return boundStorage{ContextStorage: WithContext(storage), ctx: ctx}
+}
+
+type boundStorage struct {
+	aufs.ContextStorage
+	ctx context.Context
+}
+
+func (b boundStorage) Open(path string) (aufs.File, error) {
+	return b.OpenFileWithContext(b.ctx, path, os.O_RDWR|os.O_CREATE)
+}
+
+func (b boundStorage) OpenFile(path string, flag int) (aufs.File, error) {
+	return b.OpenFileWithContext(b.ctx, path, flag)
+}
+
+func (b boundStorage) Stat(path string) (aufs.NodeInfo, error) {
+	return b.StatWithContext(b.ctx, path)
+}
+
+func (b boundStorage) Delete(path string) error {
+	return b.DeleteWithContext(b.ctx, path)
+}
+
+func (b boundStorage) Copy(srcPath string, dstPath string) error {
+	return b.CopyWithContext(b.ctx, srcPath, dstPath)
+}
+
+func (b boundStorage) Move(srcPath string, dstPath string) error {
+	return b.MoveWithContext(b.ctx, srcPath, dstPath)
+}
+
+func (b boundStorage) ListDir(path string, recursive bool) ([]aufs.NodeInfo, error) {
+	return b.ListDirWithContext(b.ctx, path, recursive)
+}
+
+func (b boundStorage) MkDir(path string) (aufs.NodeInfo, error) {
+	return b.MkDirWithContext(b.ctx, path)
+}
+
+// ContextReader stops reading from reader once ctx is done.
+func ContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	return contextReader{ctx: ctx, reader: reader}
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.reader.Read(p)
+}
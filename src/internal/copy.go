@@ -0,0 +1,397 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/google/uuid"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCopyParallelism = 4
+	// maxRenameAttempts bounds the names tried by the ConflictRename policy
+	maxRenameAttempts = 1000
+	// copyTempPrefix names the staged copies overwriting a file until they are complete
+	copyTempPrefix = "copy-"
+)
+
+type copyJob struct {
+	srcPath string
+	dstPath string
+	size    int64
+}
+
+// copyEngine copies the files of a tree with a pool of workers, once its directories were created.
+type copyEngine struct {
+	ctx     context.Context
+	src     aufs.ContextStorage
+	dst     aufs.ContextStorage
+	options aufs.CopyOptions
+	started time.Time
+	jobs    []copyJob
+
+	mu       sync.Mutex // serializes the progress callbacks and the report
+	report   *aufs.CopyReport
+	progress aufs.CopyProgress
+}
+
+// CopyTree copies srcPath from srcStorage to dstPath in dstStorage, see aufs.Filesystem.CopyWithOptions.
+func CopyTree(ctx context.Context, srcStorage aufs.Storage, dstStorage aufs.Storage, srcPath string, dstPath string, options aufs.CopyOptions) (*aufs.CopyReport, error) {
+	if options.Parallelism <= 0 {
+		options.Parallelism = defaultCopyParallelism
+	}
+
+	e := &copyEngine{
+		ctx:     ctx,
+		src:     WithContext(srcStorage),
+		dst:     WithContext(dstStorage),
+		options: options,
+		started: time.Now(),
+		report:  &aufs.CopyReport{},
+	}
+
+	info, err := e.src.StatWithContext(ctx, srcPath)
+	if err != nil {
+		return e.report, err
+	}
+
+	if info.IsDir() {
+		e.scan(srcPath, dstPath)
+	} else {
+		e.jobs = append(e.jobs, copyJob{srcPath: srcPath, dstPath: dstPath, size: info.Size()})
+	}
+
+	for _, job := range e.jobs {
+		e.progress.TotalBytes += job.size
+	}
+	e.progress.TotalFiles = len(e.jobs)
+
+	jobs := make(chan copyJob)
+	var workers sync.WaitGroup
+	for i := 0; i < options.Parallelism && i < len(e.jobs); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				// Files not started before ctx is done are neither copied nor reported
+				if ctx.Err() == nil {
+					e.copyFile(job)
+				}
+			}
+		}()
+	}
+
+	for _, job := range e.jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- job
+	}
+	close(jobs)
+	workers.Wait()
+
+	sort.Slice(e.report.Failed, func(i, k int) bool {
+		return e.report.Failed[i].Path < e.report.Failed[k].Path
+	})
+	sort.Strings(e.report.Skipped)
+
+	return e.report, ctx.Err()
+}
+
+// scan creates the directories of the tree at srcPath in the destination and collects the files to copy. Directories
+// that cannot be listed or created are reported as failed, without their content.
+func (e *copyEngine) scan(srcPath string, dstPath string) {
+	if e.ctx.Err() != nil {
+		return
+	}
+
+	err := e.mkDir(dstPath)
+	if err != nil {
+		e.fail(srcPath, err)
+		return
+	}
+
+	infos, err := e.src.ListDirWithContext(e.ctx, srcPath, false)
+	if err != nil {
+		e.fail(srcPath, err)
+		return
+	}
+
+	dstPath = strings.TrimRight(dstPath, "/\\")
+	srcDir := strings.TrimRight(srcPath, "/\\")
+	for _, info := range infos {
+		name := strings.TrimLeft(strings.TrimPrefix(info.Path(), srcDir), "/\\")
+		dstFilePath := fmt.Sprintf("%s/%s", dstPath, name)
+		if info.IsDir() {
+			e.scan(info.Path(), dstFilePath)
+			continue
+		}
+
+		e.jobs = append(e.jobs, copyJob{srcPath: info.Path(), dstPath: dstFilePath, size: info.Size()})
+	}
+}
+
+// mkDir creates the directory at path, unless it already exists.
+func (e *copyEngine) mkDir(path string) error {
+	info, err := e.dst.StatWithContext(e.ctx, path)
+	if err == nil {
+		if !info.IsDir() {
+			return aufs.NewError(aufs.AlreadyExists, "copy", path, fmt.Errorf("a file exists there"))
+		}
+		return nil
+	}
+	if aufs.CodeOf(err) != aufs.NotFound {
+		return err
+	}
+
+	_, err = e.dst.MkDirWithContext(e.ctx, path)
+	return err
+}
+
+func (e *copyEngine) fail(path string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.report.Failed = append(e.report.Failed, aufs.CopyFailure{Path: path, Err: err})
+}
+
+func (e *copyEngine) copyFile(job copyJob) {
+	dstPath, exists, err := e.resolveConflict(job.dstPath)
+	if err != nil {
+		e.done(job, dstPath, 0, false, err)
+		return
+	}
+	if dstPath == "" {
+		e.done(job, job.dstPath, 0, true, nil)
+		return
+	}
+
+	// Existing files are only replaced once their copy is complete, a failed copy leaves them untouched
+	writePath := dstPath
+	if exists {
+		writePath = NewStagingPath(copyTempPrefix + uuid.New().String())
+	}
+
+	written, err := e.transfer(job, writePath, dstPath)
+	if err == nil && exists {
+		err = e.replace(writePath, dstPath)
+	}
+	if err != nil {
+		// Files created by the failed copy are not left behind half written, even when it stopped because ctx is done
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		_ = deleteIfExists(ctx, e.dst, writePath)
+		cancel()
+	}
+
+	e.done(job, dstPath, written, false, err)
+}
+
+// replace moves the complete copy at tempPath over dstPath, copying it there when the storage cannot move.
+func (e *copyEngine) replace(tempPath string, dstPath string) error {
+	err := e.dst.MoveWithContext(e.ctx, tempPath, dstPath)
+	if aufs.CodeOf(err) != aufs.NotSupported {
+		return err
+	}
+
+	err = e.dst.CopyWithContext(e.ctx, tempPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	return e.dst.DeleteWithContext(e.ctx, tempPath)
+}
+
+// resolveConflict returns where the file at dstPath is copied following the conflict policy, empty when the file is
+// skipped, and whether the file exists there.
+func (e *copyEngine) resolveConflict(dstPath string) (string, bool, error) {
+	_, err := e.dst.StatWithContext(e.ctx, dstPath)
+	if aufs.CodeOf(err) == aufs.NotFound {
+		return dstPath, false, nil
+	}
+	if err != nil {
+		return dstPath, false, err
+	}
+
+	switch e.options.Conflict {
+	case aufs.ConflictSkip:
+		return "", true, nil
+	case aufs.ConflictFail:
+		return dstPath, true, aufs.NewError(aufs.AlreadyExists, "copy", dstPath, nil)
+	case aufs.ConflictRename:
+		ext := path.Ext(dstPath)
+		base := strings.TrimSuffix(dstPath, ext)
+		for i := 1; i <= maxRenameAttempts; i++ {
+			renamed := fmt.Sprintf("%s (%d)%s", base, i, ext)
+			_, err := e.dst.StatWithContext(e.ctx, renamed)
+			if aufs.CodeOf(err) == aufs.NotFound {
+				return renamed, false, nil
+			}
+			if err != nil {
+				return dstPath, true, err
+			}
+		}
+		return dstPath, true, aufs.NewError(aufs.AlreadyExists, "copy", dstPath, fmt.Errorf("no free name to rename the copy to"))
+	}
+
+	return dstPath, true, nil
+}
+
+// transfer copies the file of job to writePath and verifies the copy, returning the bytes written. Its progress is
+// reported for dstPath.
+func (e *copyEngine) transfer(job copyJob, writePath string, dstPath string) (int64, error) {
+	srcFile, err := e.src.OpenFileWithContext(e.ctx, job.srcPath, os.O_RDONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := e.dst.OpenFileWithContext(e.ctx, writePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, err
+	}
+
+	var srcHash hash.Hash
+	var reader io.Reader = ContextReader(e.ctx, srcFile)
+	if e.options.Checksum {
+		srcHash = sha256.New()
+		reader = io.TeeReader(reader, srcHash)
+	}
+
+	writer := &progressWriter{writer: dstFile, engine: e, job: job, dstPath: dstPath}
+	written, err := io.Copy(writer, reader)
+	if err != nil {
+		// Storages that can abort never commit the partial copy
+		aborter, ok := dstFile.(aufs.Aborter)
+		if !ok || aborter.Abort() != nil {
+			_ = dstFile.Close()
+		}
+		return written, err
+	}
+	err = dstFile.Close()
+	if err != nil {
+		return written, err
+	}
+
+	info, err := e.dst.StatWithContext(e.ctx, writePath)
+	if err != nil {
+		return written, err
+	}
+	if info.Size() != written {
+		return written, fmt.Errorf("copy of '%s' has %d bytes instead of %d", job.srcPath, info.Size(), written)
+	}
+	if srcHash == nil {
+		return written, nil
+	}
+
+	dstSum, err := e.sum(writePath)
+	if err != nil {
+		return written, err
+	}
+	if !bytes.Equal(srcHash.Sum(nil), dstSum) {
+		return written, fmt.Errorf("copy of '%s' differs from its source", job.srcPath)
+	}
+
+	return written, nil
+}
+
+func (e *copyEngine) sum(path string) ([]byte, error) {
+	file, err := e.dst.OpenFileWithContext(e.ctx, path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dstHash := sha256.New()
+	_, err = io.Copy(dstHash, ContextReader(e.ctx, file))
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum '%s', %s", path, err.Error())
+	}
+
+	return dstHash.Sum(nil), nil
+}
+
+// advance reports n more bytes of job were copied.
+func (e *copyEngine) advance(job copyJob, dstPath string, fileBytes int64, n int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.progress.Bytes += n
+	if e.options.OnFileProgress != nil {
+		e.options.OnFileProgress(e.fileProgress(job, dstPath, fileBytes))
+	}
+}
+
+// done reports job was copied, skipped or failed.
+func (e *copyEngine) done(job copyJob, dstPath string, written int64, skipped bool, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case err != nil:
+		e.report.Failed = append(e.report.Failed, aufs.CopyFailure{Path: job.srcPath, Err: err})
+	case skipped:
+		e.report.Skipped = append(e.report.Skipped, job.srcPath)
+	default:
+		e.report.Files++
+		e.report.Bytes += written
+	}
+
+	// Skipped and failed files count as processed, the bytes they did not copy included
+	if written < job.size {
+		e.progress.Bytes += job.size - written
+	}
+	e.progress.Files++
+
+	progress := e.fileProgress(job, dstPath, written)
+	progress.FileDone = true
+	progress.FileErr = err
+	if e.options.OnFileProgress != nil {
+		e.options.OnFileProgress(progress)
+	}
+	if e.options.OnProgress != nil {
+		e.options.OnProgress(progress)
+	}
+}
+
+// fileProgress returns the progress of the copy, with the file fields of job. It must be called with the lock held.
+func (e *copyEngine) fileProgress(job copyJob, dstPath string, fileBytes int64) aufs.CopyProgress {
+	progress := e.progress
+	progress.Path = job.srcPath
+	progress.DstPath = dstPath
+	progress.FileBytes = fileBytes
+	progress.FileSize = job.size
+	progress.Elapsed = time.Since(e.started)
+	if progress.Bytes > 0 && progress.TotalBytes > progress.Bytes {
+		progress.ETA = time.Duration(float64(progress.Elapsed) * float64(progress.TotalBytes-progress.Bytes) / float64(progress.Bytes))
+	}
+
+	return progress
+}
+
+type progressWriter struct {
+	writer  io.Writer
+	engine  *copyEngine
+	job     copyJob
+	dstPath string
+	written int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	if n > 0 {
+		w.engine.advance(w.job, w.dstPath, w.written, int64(n))
+	}
+
+	return n, err
+}
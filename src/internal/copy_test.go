@@ -0,0 +1,157 @@
+package internal_test
+
+import (
+	"context"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/faulty"
+	"github.com/aulaga/aufs/src/internal"
+	"testing"
+)
+
+func TestCopyTreeOverwrite(t *testing.T) {
+	src, dst := newMemoryStorage(t), newMemoryStorage(t)
+	writeFile(t, src, "a.txt", "new content")
+	writeFile(t, dst, "a.txt", "old")
+
+	report, err := internal.CopyTree(context.Background(), src, dst, "a.txt", "a.txt", aufs.CopyOptions{Checksum: true})
+	if err == nil {
+		err = report.Err()
+	}
+	if err != nil {
+		t.Fatalf("copy failed, %s", err.Error())
+	}
+
+	if content := readFile(t, dst, "a.txt"); content != "new content" {
+		t.Fatalf("overwritten file holds %q", content)
+	}
+	infos, _ := dst.ListDir("", false)
+	if len(infos) != 1 {
+		t.Fatalf("copy left %d files at the destination", len(infos))
+	}
+}
+
+func TestCopyTreeFailedOverwrite(t *testing.T) {
+	src, dst := newMemoryStorage(t), newMemoryStorage(t)
+	writeFile(t, src, "a.txt", "new content")
+	writeFile(t, dst, "a.txt", "old")
+
+	faultyDst := faulty.New("faulty", dst)
+	faultyDst.Inject(faulty.Fault{Op: faulty.OpWrite, Partial: 3})
+
+	report, err := internal.CopyTree(context.Background(), src, faultyDst, "a.txt", "a.txt", aufs.CopyOptions{})
+	if err != nil {
+		t.Fatalf("copy failed to run, %s", err.Error())
+	}
+	if len(report.Failed) != 1 {
+		t.Fatalf("copy with failing writes reported %d failures", len(report.Failed))
+	}
+
+	if content := readFile(t, dst, "a.txt"); content != "old" {
+		t.Fatalf("file holds %q after a failed overwrite", content)
+	}
+	infos, _ := dst.ListDir("", false)
+	if len(infos) != 1 {
+		t.Fatalf("failed copy left %d files at the destination", len(infos))
+	}
+}
+
+// closeRecordingStorage records how the files it opens are closed.
+type closeRecordingStorage struct {
+	aufs.Storage
+	closed  int
+	aborted int
+}
+
+type closeRecordingFile struct {
+	aufs.File
+	storage *closeRecordingStorage
+}
+
+func (s *closeRecordingStorage) OpenFile(path string, flag int) (aufs.File, error) {
+	file, err := s.Storage.OpenFile(path, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &closeRecordingFile{File: file, storage: s}, nil
+}
+
+func (f *closeRecordingFile) Close() error {
+	f.storage.closed++
+	return f.File.Close()
+}
+
+func (f *closeRecordingFile) Abort() error {
+	f.storage.aborted++
+	return f.File.(aufs.Aborter).Abort()
+}
+
+func TestCopyTreeFailedWriteAborted(t *testing.T) {
+	for _, exists := range []bool{false, true} {
+		src, dst := newMemoryStorage(t), newAtomicMemoryStorage(t)
+		writeFile(t, src, "a.txt", "new content")
+		if exists {
+			writeFile(t, dst, "a.txt", "old")
+		}
+
+		faultyDst := faulty.New("faulty", dst)
+		faultyDst.Inject(faulty.Fault{Op: faulty.OpWrite, Partial: 3})
+		recordingDst := &closeRecordingStorage{Storage: faultyDst}
+
+		report, err := internal.CopyTree(context.Background(), src, recordingDst, "a.txt", "a.txt", aufs.CopyOptions{})
+		if err != nil {
+			t.Fatalf("copy failed to run, %s", err.Error())
+		}
+		if len(report.Failed) != 1 {
+			t.Fatalf("copy with failing writes reported %d failures", len(report.Failed))
+		}
+		if recordingDst.closed != 0 || recordingDst.aborted != 1 {
+			t.Fatalf("failed copy closed %d files and aborted %d, want only an abort", recordingDst.closed, recordingDst.aborted)
+		}
+
+		infos, _ := dst.ListDir(internal.StagingDir, false)
+		if len(infos) != 0 {
+			t.Fatalf("failed copy left %d staged files", len(infos))
+		}
+	}
+}
+
+func TestCopyWithOptionsInTransaction(t *testing.T) {
+	for _, commit := range []bool{false, true} {
+		storage := newMemoryStorage(t)
+		writeFile(t, storage, "a.txt", "a")
+		fs, err := internal.NewFilesystem("fs", storage, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create filesystem, %s", err.Error())
+		}
+
+		var events []aufs.Event
+		fs.AddEventHandler(aufs.EventHandlerFunc(func(event aufs.Event) {
+			events = append(events, event)
+		}), aufs.DefaultListenerOptions())
+
+		tx := fs.Begin(context.Background()).(*internal.Transaction)
+		_, err = tx.CopyWithOptions(context.Background(), "/a.txt", "/b.txt", aufs.CopyOptions{})
+		if err != nil {
+			t.Fatalf("copy failed, %s", err.Error())
+		}
+		if commit {
+			tx.Commit()
+		} else {
+			tx.Discard()
+		}
+
+		err = fs.Shutdown(context.Background())
+		if err != nil {
+			t.Fatalf("shutdown failed, %s", err.Error())
+		}
+
+		want := 0
+		if commit {
+			want = 1
+		}
+		if len(events) != want {
+			t.Fatalf("transaction committed %t published %d events, want %d", commit, len(events), want)
+		}
+	}
+}
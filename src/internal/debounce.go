@@ -0,0 +1,168 @@
+package internal
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pendingEvent is the effective event of a path, held until the debounce window opened by its first event closes.
+type pendingEvent struct {
+	event Event
+	due   time.Time
+	order uint64
+}
+
+// debouncer collapses the creations, modifications and deletions of a path happening within a window. Other events
+// flush the pending events of the paths they involve and are delivered right away.
+type debouncer struct {
+	handler aufs.EventHandler
+	window  time.Duration
+
+	// mu is held while delivering too, so the worker and the timer goroutines deliver one at a time
+	mu      sync.Mutex
+	pending map[string]*pendingEvent
+	order   uint64
+	timer   *time.Timer
+	closed  bool
+}
+
+func newDebouncer(handler aufs.EventHandler, window time.Duration) *debouncer {
+	return &debouncer{
+		handler: handler,
+		window:  window,
+		pending: map[string]*pendingEvent{},
+	}
+}
+
+func (d *debouncer) HandleEvent(event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		deliverEvent(d.handler, event)
+		return
+	}
+
+	switch event.Kind {
+	case aufs.EventCreated, aufs.EventModified, aufs.EventDeleted:
+		d.coalesce(event)
+		return
+	}
+
+	flushed := d.take(event.Path, event.OldPath)
+	d.deliver(append(flushed, event))
+}
+
+// coalesce merges event into the pending event of its path.
+func (d *debouncer) coalesce(event Event) {
+	pending, ok := d.pending[event.Path]
+	if !ok {
+		d.order++
+		d.pending[event.Path] = &pendingEvent{event: event, due: time.Now().Add(d.window), order: d.order}
+		d.schedule()
+		return
+	}
+
+	previous := pending.event.Kind
+	pending.event = event
+	switch {
+	case previous == aufs.EventCreated && event.Kind == aufs.EventDeleted:
+		// Nothing happened as far as listeners are concerned
+		delete(d.pending, event.Path)
+	case previous == aufs.EventCreated:
+		pending.event.Kind = aufs.EventCreated
+	case previous == aufs.EventDeleted && event.Kind == aufs.EventCreated:
+		pending.event.Kind = aufs.EventModified
+	}
+}
+
+// take removes and returns the pending events of paths, in the order they were first published.
+func (d *debouncer) take(paths ...string) []Event {
+	var taken []*pendingEvent
+	for _, p := range paths {
+		pending, ok := d.pending[p]
+		if !ok {
+			continue
+		}
+
+		delete(d.pending, p)
+		taken = append(taken, pending)
+	}
+
+	return sortPending(taken)
+}
+
+func sortPending(taken []*pendingEvent) []Event {
+	sort.Slice(taken, func(i, j int) bool {
+		return taken[i].order < taken[j].order
+	})
+
+	events := make([]Event, 0, len(taken))
+	for _, pending := range taken {
+		events = append(events, pending.event)
+	}
+
+	return events
+}
+
+// schedule arms the timer for the earliest pending event, if not armed yet.
+func (d *debouncer) schedule() {
+	if d.timer != nil || d.closed || len(d.pending) == 0 {
+		return
+	}
+
+	var earliest time.Time
+	for _, pending := range d.pending {
+		if earliest.IsZero() || pending.due.Before(earliest) {
+			earliest = pending.due
+		}
+	}
+
+	d.timer = time.AfterFunc(time.Until(earliest), d.flushDue)
+}
+
+func (d *debouncer) flushDue() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.timer = nil
+
+	now := time.Now()
+	var due []*pendingEvent
+	for p, pending := range d.pending {
+		if !pending.due.After(now) {
+			due = append(due, pending)
+			delete(d.pending, p)
+		}
+	}
+
+	d.schedule()
+	d.deliver(sortPending(due))
+}
+
+// flush delivers every pending event, events handled afterwards are delivered without debouncing.
+func (d *debouncer) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	all := make([]*pendingEvent, 0, len(d.pending))
+	for _, pending := range d.pending {
+		all = append(all, pending)
+	}
+	d.pending = map[string]*pendingEvent{}
+	d.deliver(sortPending(all))
+}
+
+func (d *debouncer) deliver(events []Event) {
+	for _, event := range events {
+		deliverEvent(d.handler, event)
+	}
+}
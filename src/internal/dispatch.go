@@ -0,0 +1,137 @@
+package internal
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"log"
+	"sync"
+)
+
+// listenerWorker delivers events to a single listener from a bounded queue, in the order they were published.
+type listenerWorker struct {
+	handler   aufs.EventHandler
+	options   aufs.ListenerOptions
+	filter    *eventFilter
+	debouncer *debouncer // nil unless options.Debounce is set
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled whenever the queue or the closed flag change
+	queue   []Event
+	closed  bool
+	dropped uint64
+	done    chan struct{}
+}
+
+func newListenerWorker(handler aufs.EventHandler, options aufs.ListenerOptions, filter *eventFilter) *listenerWorker {
+	if options.QueueSize <= 0 {
+		options.QueueSize = aufs.DefaultListenerOptions().QueueSize
+	}
+
+	w := &listenerWorker{
+		handler: handler,
+		options: options,
+		filter:  filter,
+		done:    make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	if options.Debounce > 0 {
+		w.debouncer = newDebouncer(handler, options.Debounce)
+	}
+
+	return w
+}
+
+func (w *listenerWorker) enqueue(event Event) {
+	// Filtered out events do not take room in the queue
+	if !w.filter.matches(event) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for !w.closed && len(w.queue) >= w.options.QueueSize {
+		switch w.options.Overflow {
+		case aufs.OverflowDropOldest:
+			w.queue = w.queue[1:]
+			w.dropped++
+		case aufs.OverflowDropNewest:
+			w.dropped++
+			return
+		default:
+			w.cond.Wait()
+		}
+	}
+
+	if w.closed {
+		w.dropped++
+		return
+	}
+
+	w.queue = append(w.queue, event)
+	w.cond.Broadcast()
+}
+
+func (w *listenerWorker) run() {
+	defer close(w.done)
+
+	w.mu.Lock()
+	for {
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			if w.debouncer != nil {
+				w.debouncer.flush()
+			}
+			return
+		}
+
+		event := w.queue[0]
+		w.queue[0] = Event{}
+		w.queue = w.queue[1:]
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		w.deliver(event)
+
+		w.mu.Lock()
+	}
+}
+
+func (w *listenerWorker) deliver(event Event) {
+	if w.debouncer != nil {
+		w.debouncer.HandleEvent(event)
+		return
+	}
+
+	deliverEvent(w.handler, event)
+}
+
+// deliverEvent hands event to handler, a panicking handler does not take its worker down.
+func deliverEvent(handler aufs.EventHandler, event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("event listener panicked: %v\n", r)
+		}
+	}()
+
+	handler.HandleEvent(event)
+}
+
+// close makes the worker exit once the queue is drained, events enqueued afterwards are dropped.
+func (w *listenerWorker) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+func (w *listenerWorker) droppedCount() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.dropped
+}
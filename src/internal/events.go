@@ -1,16 +1,28 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	aufs "github.com/aulaga/aufs/src"
+	"io"
 	"io/fs"
+	"log"
+	"sync"
+	"time"
 )
 
 type EventFile struct {
-	file       aufs.File
-	path       string
-	propagator *EventPropagator
-	changed    bool
+	ctx     context.Context
+	file    aufs.File
+	path    string
+	events  eventSink
+	changed bool
+	created bool // the file did not exist when opened
+	release func()
+
+	// writeGuard, when set, is checked once before the first write goes through
+	writeGuard func() error
+	writeErr   error
 }
 
 func (e *EventFile) Path() string {
@@ -22,17 +34,67 @@ func (e *EventFile) Storage() aufs.Storage {
 }
 
 func (e *EventFile) Close() error {
-	if e.changed {
-		e.propagator.AddEvent(ChangedEvent(e.path))
+	if e.release != nil {
+		defer e.release()
+	}
+
+	err := e.file.Close()
+	if err != nil || !e.changed {
+		return err
+	}
+
+	kind := aufs.EventModified
+	if e.created {
+		kind = aufs.EventCreated
+	}
+	storage := e.file.Storage()
+	e.events.Emit(withInfo(e.ctx, newEvent(kind, e.path, storage), storage, e.file.Path(), nil))
+
+	return nil
+}
+
+// Abort discards the writes of the file when it is an aufs.Aborter, without publishing any event.
+func (e *EventFile) Abort() error {
+	aborter, ok := e.file.(aufs.Aborter)
+	if !ok {
+		return aufs.NewError(aufs.NotSupported, "abort", e.path, nil)
+	}
+
+	err := aborter.Abort()
+	if aufs.CodeOf(err) == aufs.NotSupported {
+		return err
+	}
+
+	if e.release != nil {
+		e.release()
 	}
 
-	return e.file.Close()
+	return err
 }
 
 func (e *EventFile) Read(p []byte) (n int, err error) {
 	return e.file.Read(p)
 }
 
+func (e *EventFile) ReadAt(p []byte, off int64) (int, error) {
+	readerAt, ok := e.file.(io.ReaderAt)
+	if !ok {
+		return 0, aufs.NewError(aufs.NotSupported, "read", e.path, fmt.Errorf("file cannot be read at an offset"))
+	}
+
+	return readerAt.ReadAt(p, off)
+}
+
+// WriteTo writes the file to w, through its own WriterTo when it has one.
+func (e *EventFile) WriteTo(w io.Writer) (int64, error) {
+	writerTo, ok := e.file.(io.WriterTo)
+	if ok {
+		return writerTo.WriteTo(w)
+	}
+
+	return io.Copy(w, struct{ io.Reader }{e.file})
+}
+
 func (e *EventFile) Seek(offset int64, whence int) (int64, error) {
 	return e.file.Seek(offset, whence)
 }
@@ -46,62 +108,319 @@ func (e *EventFile) Stat() (fs.FileInfo, error) {
 }
 
 func (e *EventFile) Write(p []byte) (n int, err error) {
+	if e.writeGuard != nil {
+		e.writeErr = e.writeGuard()
+		e.writeGuard = nil
+	}
+	if e.writeErr != nil {
+		return 0, e.writeErr
+	}
+
 	if len(p) > 0 {
 		e.changed = true
 	}
 	return e.file.Write(p)
 }
 
-type Event interface {
-	Publish(listener aufs.EventListener)
+// Event is the unit published to listeners.
+type Event = aufs.Event
+
+// eventSink collects the events produced by filesystem operations.
+type eventSink interface {
+	Emit(event Event)
 }
 
-type simpleEvent struct {
-	eventAction func(listener aufs.EventListener)
+// discardEvents drops the events of the operations on staging paths, which are hidden.
+type discardEvents struct{}
+
+func (discardEvents) Emit(Event) {}
+
+func newEvent(kind aufs.EventKind, path string, storage aufs.Storage) Event {
+	return Event{
+		Kind:      kind,
+		Path:      path,
+		StorageId: storage.Id(),
+		Time:      time.Now(),
+	}
 }
 
-func (e *simpleEvent) Publish(listener aufs.EventListener) {
-	e.eventAction(listener)
+// withInfo sets the post-operation info of event, stated in the storage with the context of the operation when info
+// is nil.
+func withInfo(ctx context.Context, event Event, storage aufs.Storage, relPath string, info aufs.NodeInfo) Event {
+	if info == nil {
+		info, _ = WithContext(storage).StatWithContext(ctx, relPath)
+	}
+
+	event.Info = info
+	return event
 }
 
-func MovedEvent(src string, dst string) Event {
-	return &simpleEvent{eventAction: func(listener aufs.EventListener) {
-		listener.Moved(src, dst)
-	}}
+type EventPropagator struct {
+	mountPoint func(path string) string
+
+	mu        sync.Mutex
+	listeners []*listenerWorker
+	closed    bool
+
+	// publishMu orders the events by sequence number, pending holds them until the dispatcher enqueues them to the
+	// listener queues in that order
+	publishMu  sync.Mutex
+	seq        uint64
+	journal    aufs.EventJournal
+	pending    []publication
+	wake       chan struct{} // signals the dispatcher that publications are pending, nil until it is started
+	delivering chan struct{} // closed once the pending publications were delivered, nil when none are
+	stopped    bool
 }
 
-func ChangedEvent(path string) Event {
-	return &simpleEvent{eventAction: func(listener aufs.EventListener) {
-		listener.Changed(path)
-	}}
+// publication is a batch of sequenced events and the listeners registered when they were published.
+type publication struct {
+	events    []Event
+	listeners []*listenerWorker
 }
 
-func DeletedEvent(path string) Event {
-	return &simpleEvent{eventAction: func(listener aufs.EventListener) {
-		listener.Deleted(path)
-	}}
+var _ eventSink = &EventPropagator{}
+
+// NewEventPropagator returns a propagator resolving the mount points of events with mountPoint, for listeners filtering
+// events by mount.
+func NewEventPropagator(mountPoint func(path string) string) *EventPropagator {
+	return &EventPropagator{mountPoint: mountPoint}
 }
 
-type EventPropagator struct {
-	listeners []aufs.EventListener
-	events    []Event
+// SetJournal makes the propagator record events to journal before delivering them, the journal then assigns their
+// sequence numbers.
+func (e *EventPropagator) SetJournal(journal aufs.EventJournal) {
+	e.publishMu.Lock()
+	defer e.publishMu.Unlock()
+
+	e.journal = journal
 }
 
-func (e *EventPropagator) Publish() {
-	fmt.Println("Propagator publishing events...", len(e.events))
-	for _, event := range e.events {
-		for _, listener := range e.listeners {
-			event.Publish(listener)
+// Publish numbers events and hands them over to the dispatcher, it never waits for listeners nor their queues. Events
+// are numbered under the publish lock, the dispatcher enqueues them in that order so every listener receives them in
+// sequence order, and a full queue only blocks the dispatcher.
+func (e *EventPropagator) Publish(events []Event) {
+	e.publishMu.Lock()
+	defer e.publishMu.Unlock()
+
+	e.mu.Lock()
+	listeners := e.listeners
+	e.mu.Unlock()
+
+	sequenced := make([]Event, len(events))
+	for i, event := range events {
+		sequenced[i] = e.sequence(event)
+	}
+	if e.stopped {
+		// Journaled for replays, the listeners are gone
+		return
+	}
+
+	e.pending = append(e.pending, publication{events: sequenced, listeners: listeners})
+	if e.delivering == nil {
+		e.delivering = make(chan struct{})
+	}
+	if e.wake == nil {
+		e.wake = make(chan struct{}, 1)
+		go e.dispatch(e.wake)
+	}
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+		// The dispatcher is woken up already
+	}
+}
+
+// dispatch enqueues the pending publications in order each time it is woken up, until wake is closed.
+func (e *EventPropagator) dispatch(wake chan struct{}) {
+	for range wake {
+		for {
+			e.publishMu.Lock()
+			pending := e.pending
+			e.pending = nil
+			if len(pending) == 0 {
+				if e.delivering != nil {
+					close(e.delivering)
+					e.delivering = nil
+				}
+				e.publishMu.Unlock()
+				break
+			}
+			e.publishMu.Unlock()
+
+			for _, publication := range pending {
+				for _, event := range publication.events {
+					for _, listener := range publication.listeners {
+						listener.enqueue(event)
+					}
+				}
+			}
 		}
 	}
+}
+
+func (e *EventPropagator) sequence(event Event) Event {
+	if e.journal == nil {
+		e.seq++
+		event.Seq = e.seq
+		return event
+	}
+
+	seq, err := e.journal.Append(event)
+	if err != nil {
+		log.Printf("failed to journal %s event of '%s', %s\n", event.Kind, event.Path, err)
+		return event
+	}
 
-	e.events = nil
+	event.Seq = seq
+	return event
+}
+
+// PublishEvent hands a single event over to the listener workers.
+func (e *EventPropagator) PublishEvent(event Event) {
+	e.Publish([]Event{event})
+}
+
+// Emit publishes event right away, the propagator acts as the sink of operations done outside a transaction.
+func (e *EventPropagator) Emit(event Event) {
+	e.PublishEvent(event)
 }
 
 func (e *EventPropagator) AddEventListener(listener aufs.EventListener) {
-	e.listeners = append(e.listeners, listener)
+	e.AddEventHandler(aufs.LegacyListener(listener), aufs.DefaultListenerOptions())
+}
+
+// AddEventHandler registers handler with its own delivery worker and queue configured by options.
+func (e *EventPropagator) AddEventHandler(handler aufs.EventHandler, options aufs.ListenerOptions) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return
+	}
+
+	worker := newListenerWorker(handler, options, newEventFilter(options, e.mountPoint))
+	go worker.run()
+
+	// Listeners are copied on write so publishers can iterate them without holding the lock
+	listeners := make([]*listenerWorker, len(e.listeners), len(e.listeners)+1)
+	copy(listeners, e.listeners)
+	e.listeners = append(listeners, worker)
 }
 
-func (e *EventPropagator) AddEvent(event Event) {
-	e.events = append(e.events, event)
+// Replay delivers the journaled events from fromSeq to handler, then registers it for the events published afterwards
+// without missing or repeating any. Journaled events are delivered on the calling goroutine.
+func (e *EventPropagator) Replay(fromSeq uint64, handler aufs.EventHandler, options aufs.ListenerOptions) error {
+	e.publishMu.Lock()
+	journal := e.journal
+	e.publishMu.Unlock()
+
+	if journal == nil {
+		return fmt.Errorf("cannot replay events, no journal configured")
+	}
+
+	// Catch up without holding publishers, then replay what was published meanwhile before registering the handler
+	filter := newEventFilter(options, e.mountPoint)
+	next := fromSeq
+	replay := func(event Event) {
+		if filter.matches(event) {
+			handler.HandleEvent(event)
+		}
+		next = event.Seq + 1
+	}
+
+	err := journal.Replay(next, aufs.EventHandlerFunc(replay))
+	if err != nil {
+		return err
+	}
+
+	e.publishMu.Lock()
+	defer e.publishMu.Unlock()
+
+	err = journal.Replay(next, aufs.EventHandlerFunc(replay))
+	if err != nil {
+		return err
+	}
+
+	e.AddEventHandler(handler, options)
+	return nil
+}
+
+// Dropped returns how many events were discarded by listener queues overflowing.
+func (e *EventPropagator) Dropped() uint64 {
+	e.mu.Lock()
+	listeners := e.listeners
+	e.mu.Unlock()
+
+	var dropped uint64
+	for _, listener := range listeners {
+		dropped += listener.droppedCount()
+	}
+
+	return dropped
+}
+
+// Shutdown stops accepting listeners and waits for the workers to deliver the events already queued, or for ctx to
+// be done. Handlers having a Shutdown(context.Context) error method are shut down last.
+func (e *EventPropagator) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	e.closed = true
+	listeners := e.listeners
+	e.mu.Unlock()
+
+	// Events published before are queued first, the dispatcher stops afterwards
+	e.publishMu.Lock()
+	delivering := e.delivering
+	e.publishMu.Unlock()
+	if delivering != nil {
+		select {
+		case <-delivering:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	e.publishMu.Lock()
+	e.stopped = true
+	if e.wake != nil {
+		close(e.wake)
+		e.wake = nil
+	}
+	e.publishMu.Unlock()
+
+	for _, listener := range listeners {
+		listener.close()
+	}
+
+	for _, listener := range listeners {
+		select {
+		case <-listener.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Handlers buffering events on their own get to flush them
+	for _, listener := range listeners {
+		shutdowner, ok := listener.handler.(interface{ Shutdown(context.Context) error })
+		if !ok {
+			continue
+		}
+
+		err := shutdowner.Shutdown(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.publishMu.Lock()
+	defer e.publishMu.Unlock()
+
+	closer, ok := e.journal.(io.Closer)
+	if ok {
+		return closer.Close()
+	}
+
+	return nil
 }
@@ -0,0 +1,63 @@
+package internal_test
+
+import (
+	"context"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublishNotHeldByBlockedListener(t *testing.T) {
+	propagator := internal.NewEventPropagator(func(path string) string {
+		return "/"
+	})
+
+	release := make(chan struct{})
+	propagator.AddEventHandler(aufs.EventHandlerFunc(func(event aufs.Event) {
+		<-release
+	}), aufs.ListenerOptions{QueueSize: 1, Overflow: aufs.OverflowBlock})
+
+	var mu sync.Mutex
+	var seqs []uint64
+	propagator.AddEventHandler(aufs.EventHandlerFunc(func(event aufs.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		seqs = append(seqs, event.Seq)
+	}), aufs.DefaultListenerOptions())
+
+	event := aufs.Event{Kind: aufs.EventCreated, Path: "/a.txt"}
+	// The blocked listener takes the first event and queues the second, the third blocks the dispatcher, never the
+	// publishers
+	published := make(chan struct{})
+	go func() {
+		propagator.Publish([]aufs.Event{event, event, event})
+		time.Sleep(10 * time.Millisecond)
+		propagator.PublishEvent(event)
+		close(published)
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatalf("publish held back by a blocked listener")
+	}
+
+	close(release)
+	err := propagator.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("shutdown failed, %s", err.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seqs) != 4 {
+		t.Fatalf("listener received %d events, want 4", len(seqs))
+	}
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("listener received sequence numbers %v, want them in order", seqs)
+		}
+	}
+}
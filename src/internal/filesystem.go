@@ -1,30 +1,53 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	aufs "github.com/aulaga/aufs/src"
+	"io"
 	"io/fs"
-	"path/filepath"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Filesystem struct {
 	id              string
 	root            aufs.Storage
-	mounts          []aufs.Mount
+	provider        aufs.StorageProvider
 	eventPropagator *EventPropagator
+	moveJournal     *MoveJournal
+
+	mounts    atomic.Pointer[mountTable]
+	mountsMu  sync.Mutex // serializes mount table changes and open file accounting
+	openFiles map[aufs.Mount]int
 }
 
-var _ aufs.Storage = &Filesystem{}
+var _ aufs.Filesystem = &Filesystem{}
+
+// NewFilesystem builds a filesystem over root with the given mounts, failing if any mount point is invalid or duplicated.
+// The provider is used to resolve the storages of mounts attached at runtime.
+func NewFilesystem(id string, root aufs.Storage, mounts []aufs.Mount, provider aufs.StorageProvider) (*Filesystem, error) {
+	table, err := newMountTable(root, mounts)
+	if err != nil {
+		return nil, err
+	}
 
-func NewFilesystem(id string, root aufs.Storage, mounts []aufs.Mount) *Filesystem {
-	return &Filesystem{
-		id:              id,
-		root:            root,
-		mounts:          mounts,
-		eventPropagator: &EventPropagator{events: []Event{}},
+	f := &Filesystem{
+		id:        id,
+		root:      root,
+		provider:  provider,
+		openFiles: map[aufs.Mount]int{},
 	}
+	f.mounts.Store(table)
+	f.eventPropagator = NewEventPropagator(func(path string) string {
+		mount, _ := f.MountForPath(path)
+		return mount.Point()
+	})
+
+	return f, nil
 }
 
 func (f *Filesystem) Id() string {
@@ -35,129 +58,452 @@ func (f *Filesystem) AddEventListener(listener aufs.EventListener) {
 	f.eventPropagator.AddEventListener(listener)
 }
 
-func (f *Filesystem) FlushEvents() {
-	f.eventPropagator.Publish()
+func (f *Filesystem) AddEventHandler(handler aufs.EventHandler, options aufs.ListenerOptions) {
+	f.eventPropagator.AddEventHandler(handler, options)
 }
 
-func (f *Filesystem) StorageForPath(filePath string) (aufs.Storage, string) {
-	filePath = filepath.Clean(filePath)
-
-	for _, mount := range f.mounts {
-		// FIXME clean-up mount-point evaluation
-		relPath, err := filepath.Rel(mount.Point(), filePath)
-		isMountPath := err == nil && !strings.HasPrefix(relPath, "../") && relPath != ".."
-		if isMountPath {
-			return mount.Storage(), relPath
-		}
+// Begin starts a transaction scoping the events of the operations done through it, see Transaction.
+func (f *Filesystem) Begin(ctx context.Context) aufs.Transaction {
+	return newTransaction(f, ctx)
+}
+
+// SetJournal records the events of the filesystem to journal, enabling Replay.
+func (f *Filesystem) SetJournal(journal aufs.EventJournal) {
+	f.eventPropagator.SetJournal(journal)
+}
+
+func (f *Filesystem) Replay(fromSeq uint64, handler aufs.EventHandler, options aufs.ListenerOptions) error {
+	return f.eventPropagator.Replay(fromSeq, handler, options)
+}
+
+func (f *Filesystem) DroppedEvents() uint64 {
+	return f.eventPropagator.Dropped()
+}
+
+func (f *Filesystem) Shutdown(ctx context.Context) error {
+	return f.eventPropagator.Shutdown(ctx)
+}
+
+// MountForPath returns the deepest mount containing filePath and the path relative to it. Paths outside
+// every mount resolve to the root storage, mounted at "/".
+func (f *Filesystem) MountForPath(filePath string) (aufs.Mount, string) {
+	return f.mounts.Load().resolve(filePath)
+}
+
+// Mount attaches the storage described by spec at its mount point. The mount table is swapped atomically, requests
+// in flight keep resolving against the table they started with.
+func (f *Filesystem) Mount(spec aufs.MountSpec) error {
+	if f.provider == nil {
+		return fmt.Errorf("cannot mount '%s', filesystem has no storage provider", spec.MountPoint)
+	}
+
+	f.mountsMu.Lock()
+	defer f.mountsMu.Unlock()
+
+	// The point is validated first so an invalid mount does not leave a storage opened by the provider
+	err := f.mounts.Load().checkPoint(spec.MountPoint)
+	if err != nil {
+		return err
+	}
+
+	storage, err := f.provider.ProvideStorage(spec.Storage)
+	if err != nil {
+		return err
+	}
+
+	mount := NewMount(storage, spec.MountPoint, spec.Mode)
+	table, err := f.mounts.Load().with(mount)
+	if err != nil {
+		return err
+	}
+	f.mounts.Store(table)
+
+	f.eventPropagator.PublishEvent(newEvent(aufs.EventMounted, mount.Point(), storage))
+	return nil
+}
+
+// Unmount detaches the storage mounted at point. It fails while files opened through the mount are still open, unless
+// force is set, in which case those files keep working against the detached storage until closed.
+func (f *Filesystem) Unmount(point string, force bool) error {
+	f.mountsMu.Lock()
+	defer f.mountsMu.Unlock()
+
+	table := f.mounts.Load()
+	mount, ok := table.lookup(point)
+	if !ok {
+		return aufs.NewError(aufs.NotFound, "unmount", point, fmt.Errorf("nothing is mounted there"))
+	}
+
+	if open := f.openFiles[mount]; open > 0 && !force {
+		return aufs.NewError(aufs.Conflict, "unmount", mount.Point(), fmt.Errorf("%d files are still open", open))
+	}
+
+	table, err := table.without(mount)
+	if err != nil {
+		return err
 	}
+	f.mounts.Store(table)
+	delete(f.openFiles, mount)
+
+	f.eventPropagator.PublishEvent(newEvent(aufs.EventUnmounted, mount.Point(), mount.Storage()))
+	return nil
+}
 
-	return f.root, filePath
+// acquireMount resolves filePath and registers an open file on the resulting mount, the returned func releases it.
+func (f *Filesystem) acquireMount(filePath string) (aufs.Mount, string, func()) {
+	f.mountsMu.Lock()
+	defer f.mountsMu.Unlock()
+
+	mount, relPath := f.MountForPath(filePath)
+	f.openFiles[mount]++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			f.mountsMu.Lock()
+			defer f.mountsMu.Unlock()
+
+			if f.openFiles[mount] <= 1 {
+				delete(f.openFiles, mount)
+				return
+			}
+			f.openFiles[mount]--
+		})
+	}
+
+	return mount, relPath, release
+}
+
+func (f *Filesystem) StorageForPath(filePath string) (aufs.Storage, string) {
+	mount, relPath := f.MountForPath(filePath)
+	return mount.Storage(), relPath
 }
 
-func (f *Filesystem) Open(path string) (file aufs.File, err error) {
+func (f *Filesystem) Open(path string) (aufs.File, error) {
+	return f.open(context.Background(), path, os.O_RDWR|os.O_CREATE, f.eventPropagator)
+}
+
+func (f *Filesystem) OpenFile(path string, flag int) (aufs.File, error) {
+	return f.open(context.Background(), path, flag, f.eventPropagator)
+}
+
+func (f *Filesystem) OpenFileWithContext(ctx context.Context, path string, flag int) (aufs.File, error) {
+	return f.open(ctx, path, flag, f.eventPropagator)
+}
+
+func (f *Filesystem) open(ctx context.Context, path string, flag int, events eventSink) (file aufs.File, err error) {
 	isRootPath := strings.TrimLeft(path, "/") == ""
 	if isRootPath {
-		return &fsFile{fs: f}, nil
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, aufs.NewError(aufs.AlreadyExists, "open", path, nil)
+		}
+		dirReader := NewDirReader(func() (aufs.NodeIterator, error) {
+			return f.ListWithContext(ctx, "/", aufs.ListOptions{})
+		})
+		return &fsFile{fs: f, dirReader: dirReader}, nil
 	}
 
-	storage, relPath := f.StorageForPath(path)
-	file, err = storage.Open(relPath)
+	mount, relPath, release := f.acquireMount(path)
+	storage := WithContext(mount.Storage())
+	if IsStagingPath(relPath) {
+		events = discardEvents{}
+	}
+	exists := false
+	if IsWritable(flag) {
+		_, statErr := storage.StatWithContext(ctx, relPath)
+		exists = statErr == nil
+	}
+
+	// Files created or truncated by the flags are written on close, their mount must allow it from the start
+	createOnClose := CreatesOnClose(flag, exists)
+	if createOnClose {
+		err = checkWrite(ctx, mount, relPath, "open", path)
+		if err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	file, err = storage.OpenFileWithContext(ctx, relPath, flag)
 	if err != nil {
+		release()
 		return nil, err
 	}
 
-	file = &EventFile{file: file, propagator: f.eventPropagator, path: path}
+	eventFile := &EventFile{
+		ctx:     ctx,
+		file:    file,
+		events:  events,
+		path:    path,
+		created: !exists,
+		release: release,
+		writeGuard: func() error {
+			return checkModify(ctx, mount, relPath, "write", path)
+		},
+	}
+	switch {
+	case !IsWritable(flag):
+		eventFile.writeGuard = func() error {
+			return HandleModeError("write", path)
+		}
+	case createOnClose:
+		eventFile.changed = true
+		eventFile.writeGuard = nil
+	}
+
+	return eventFile, nil
+}
+
+func (f *Filesystem) MkDir(path string) (aufs.NodeInfo, error) {
+	return f.mkDir(context.Background(), path, f.eventPropagator)
+}
 
-	return file, nil
+func (f *Filesystem) MkDirWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
+	return f.mkDir(ctx, path, f.eventPropagator)
 }
 
-func (f *Filesystem) MkDir(path string) (info aufs.NodeInfo, err error) {
+func (f *Filesystem) mkDir(ctx context.Context, path string, events eventSink) (info aufs.NodeInfo, err error) {
+	mount, relPath := f.MountForPath(path)
 	defer func() {
 		if err == nil {
-			f.eventPropagator.AddEvent(ChangedEvent(path))
+			events.Emit(withInfo(ctx, newEvent(aufs.EventDirCreated, path, mount.Storage()), mount.Storage(), relPath, info))
 		}
 	}()
 
-	storage, path := f.StorageForPath(path)
-	return storage.MkDir(path)
+	err = checkCreateDir(mount, "mkdir", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return WithContext(mount.Storage()).MkDirWithContext(ctx, relPath)
 }
 
 func (f *Filesystem) Stat(path string) (info aufs.NodeInfo, err error) {
+	return f.StatWithContext(context.Background(), path)
+}
+
+func (f *Filesystem) StatWithContext(ctx context.Context, path string) (info aufs.NodeInfo, err error) {
 	storage, path := f.StorageForPath(path)
-	return storage.Stat(path)
+	return WithContext(storage).StatWithContext(ctx, path)
+}
+
+func (f *Filesystem) Delete(path string) error {
+	return f.delete(context.Background(), path, f.eventPropagator)
+}
+
+func (f *Filesystem) DeleteWithContext(ctx context.Context, path string) error {
+	return f.delete(ctx, path, f.eventPropagator)
 }
 
-func (f *Filesystem) Delete(path string) (err error) {
+func (f *Filesystem) delete(ctx context.Context, path string, events eventSink) (err error) {
+	mount, relPath := f.MountForPath(path)
 	defer func() {
-		if err == nil {
-			f.eventPropagator.AddEvent(DeletedEvent(path))
+		if err == nil && !IsStagingPath(relPath) {
+			events.Emit(newEvent(aufs.EventDeleted, path, mount.Storage()))
 		}
 	}()
 
-	storage, path := f.StorageForPath(path)
-	return ManualDelete(storage, path)
+	err = checkDelete(mount, "delete", path)
+	if err != nil {
+		return err
+	}
+
+	return ManualDeleteWithContext(ctx, mount.Storage(), relPath)
+}
+
+func (f *Filesystem) Copy(srcPath string, dstPath string) error {
+	return f.copy(context.Background(), srcPath, dstPath, f.eventPropagator)
+}
+
+func (f *Filesystem) CopyWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	return f.copy(ctx, srcPath, dstPath, f.eventPropagator)
 }
 
-func (f *Filesystem) Copy(srcPath string, dstPath string) (err error) {
+func (f *Filesystem) copy(ctx context.Context, srcPath string, dstPath string, events eventSink) (err error) {
+	srcStorage, srcRelPath := f.StorageForPath(srcPath)
+	dstMount, dstRelPath := f.MountForPath(dstPath)
+	dstStorage := dstMount.Storage()
 	defer func() {
 		if err == nil {
-			f.eventPropagator.AddEvent(ChangedEvent(dstPath))
+			event := newEvent(aufs.EventCopied, dstPath, dstStorage)
+			event.OldPath = srcPath
+			events.Emit(withInfo(ctx, event, dstStorage, dstRelPath, nil))
 		}
 	}()
-	srcStorage, srcRelPath := f.StorageForPath(srcPath)
-	dstStorage, dstRelPath := f.StorageForPath(dstPath)
+
+	err = checkWrite(ctx, dstMount, dstRelPath, "copy", dstPath)
+	if err != nil {
+		return err
+	}
 
 	if srcStorage == dstStorage {
-		return srcStorage.Copy(srcRelPath, dstRelPath)
+		return WithContext(srcStorage).CopyWithContext(ctx, srcRelPath, dstRelPath)
+	}
+
+	return ManualCopyWithContext(ctx, srcStorage, dstStorage, srcRelPath, dstRelPath)
+}
+
+// CopyWithOptions copies srcPath to dstPath file by file, even within a storage, see aufs.Filesystem.
+func (f *Filesystem) CopyWithOptions(ctx context.Context, srcPath string, dstPath string, options aufs.CopyOptions) (*aufs.CopyReport, error) {
+	return f.copyWithOptions(ctx, srcPath, dstPath, options, f.eventPropagator)
+}
+
+func (f *Filesystem) copyWithOptions(ctx context.Context, srcPath string, dstPath string, options aufs.CopyOptions, events eventSink) (*aufs.CopyReport, error) {
+	srcStorage, srcRelPath := f.StorageForPath(srcPath)
+	dstMount, dstRelPath := f.MountForPath(dstPath)
+	dstStorage := dstMount.Storage()
+
+	err := checkWrite(ctx, dstMount, dstRelPath, "copy", dstPath)
+	if err != nil {
+		return nil, err
 	}
 
-	return ManualCopy(srcStorage, dstStorage, srcRelPath, dstRelPath)
+	report, err := CopyTree(ctx, srcStorage, dstStorage, srcRelPath, dstRelPath, options)
+	if report.Files > 0 {
+		event := newEvent(aufs.EventCopied, dstPath, dstStorage)
+		event.OldPath = srcPath
+		events.Emit(withInfo(ctx, event, dstStorage, dstRelPath, nil))
+	}
+
+	return report, err
 }
 
-func (f *Filesystem) Move(srcPath string, dstPath string) (err error) {
+func (f *Filesystem) Move(srcPath string, dstPath string) error {
+	return f.move(context.Background(), srcPath, dstPath, f.eventPropagator)
+}
+
+func (f *Filesystem) MoveWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	return f.move(ctx, srcPath, dstPath, f.eventPropagator)
+}
+
+func (f *Filesystem) move(ctx context.Context, srcPath string, dstPath string, events eventSink) (err error) {
+	srcMount, relSrcPath := f.MountForPath(srcPath)
+	dstMount, relDstPath := f.MountForPath(dstPath)
+	srcStorage, dstStorage := srcMount.Storage(), dstMount.Storage()
+	// Staging files moved into place are published as written there, their staging path is hidden
+	kind := aufs.EventMoved
+	if IsStagingPath(relSrcPath) {
+		kind = aufs.EventCreated
+		_, statErr := WithContext(dstStorage).StatWithContext(ctx, relDstPath)
+		if statErr == nil {
+			kind = aufs.EventModified
+		}
+	}
 	defer func() {
 		if err == nil {
-			f.eventPropagator.AddEvent(MovedEvent(srcPath, dstPath))
+			event := newEvent(kind, dstPath, dstStorage)
+			if kind == aufs.EventMoved {
+				event.OldPath = srcPath
+			}
+			events.Emit(withInfo(ctx, event, dstStorage, relDstPath, nil))
 		}
 	}()
 
-	srcStorage, relSrcPath := f.StorageForPath(srcPath)
-	dstStorage, relDstPath := f.StorageForPath(dstPath)
-
-	if srcStorage == dstStorage {
-		return srcStorage.Move(relSrcPath, relDstPath)
+	err = checkDelete(srcMount, "move", srcPath)
+	if err != nil {
+		return err
 	}
 
-	err = ManualCopy(srcStorage, dstStorage, relSrcPath, relDstPath)
+	err = checkWrite(ctx, dstMount, relDstPath, "move", dstPath)
 	if err != nil {
-		err2 := dstStorage.Delete(relDstPath)
-		if err2 != nil {
-			return fmt.Errorf(
-				"move operation across storages failed dramatically, first failed copying the files (%s), then failed to delete the incomplete move in destination storage (%s)",
-				err.Error(),
-				err2.Error(),
-			)
-		}
-
 		return err
 	}
 
-	return ManualDelete(srcStorage, relSrcPath)
+	if srcStorage == dstStorage {
+		return WithContext(srcStorage).MoveWithContext(ctx, relSrcPath, relDstPath)
+	}
+
+	return f.crossMove(ctx, srcMount, dstMount, srcPath, dstPath, relSrcPath, relDstPath)
 }
 
 func (f *Filesystem) ListDir(path string, recursive bool) (infos []aufs.NodeInfo, err error) {
-	storage, path := f.StorageForPath(path)
-	list, err := storage.ListDir(path, recursive)
+	return f.ListDirWithContext(context.Background(), path, recursive)
+}
+
+func (f *Filesystem) ListDirWithContext(ctx context.Context, path string, recursive bool) (infos []aufs.NodeInfo, err error) {
+	storage, relPath := f.StorageForPath(path)
+	list, err := WithContext(storage).ListDirWithContext(ctx, relPath, recursive)
 	if err != nil {
 		return nil, err
 	}
 
+	// Mount points nested in the listed directory show up as directories, unless the storage already has them
+	listed := map[string]bool{}
+	for _, info := range list {
+		listed[info.Name()] = true
+	}
+
+	for _, mount := range f.mounts.Load().children(path) {
+		info := aufs.NewNodeInfo(mount.Point(), 0, time.Time{}, true, "", "")
+		if !listed[info.Name()] {
+			list = append(list, info)
+		}
+	}
+
 	return list, err
 }
 
+func (f *Filesystem) List(path string, options aufs.ListOptions) (aufs.NodeIterator, error) {
+	return f.ListWithContext(context.Background(), path, options)
+}
+
+// ListWithContext lists path like ListDir, streaming the nodes of the storage and the nested mount points last.
+func (f *Filesystem) ListWithContext(ctx context.Context, path string, options aufs.ListOptions) (aufs.NodeIterator, error) {
+	storage, relPath := f.StorageForPath(path)
+	iterator, err := List(ctx, storage, relPath, aufs.ListOptions{PageSize: options.PageSize})
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoints := map[string]aufs.NodeInfo{}
+	var names []string
+	for _, mount := range f.mounts.Load().children(path) {
+		info := aufs.NewNodeInfo(mount.Point(), 0, time.Time{}, true, "", "")
+		mountPoints[info.Name()] = info
+		names = append(names, info.Name())
+	}
+
+	var page []aufs.NodeInfo
+	storageDone := false
+	next := func() (aufs.NodeInfo, error) {
+		for !storageDone {
+			if len(page) > 0 {
+				info := page[0]
+				page = page[1:]
+				// Mount points the storage already has are listed once
+				delete(mountPoints, info.Name())
+				return info, nil
+			}
+
+			nextPage, err := iterator.Next()
+			if err == io.EOF {
+				storageDone = true
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			page = nextPage
+		}
+
+		for len(names) > 0 {
+			info, ok := mountPoints[names[0]]
+			names = names[1:]
+			if ok {
+				return info, nil
+			}
+		}
+
+		return nil, io.EOF
+	}
+
+	return ApplyListOptions(NewNodeIterator(next, iterator.Close, options.PageSize), options), nil
+}
+
 // Filesystem act as file
 type fsFile struct {
-	fs *Filesystem
+	fs        *Filesystem
+	dirReader *DirReader
 }
 
 func (f fsFile) Path() string {
@@ -169,7 +515,7 @@ func (f fsFile) Storage() aufs.Storage {
 }
 
 func (f fsFile) Close() error {
-	return nil
+	return f.dirReader.Close()
 }
 
 func (f fsFile) Read(p []byte) (n int, err error) {
@@ -181,26 +527,7 @@ func (f fsFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f fsFile) Readdir(count int) ([]fs.FileInfo, error) {
-	infos, err := f.fs.ListDir("/", false)
-	if err != nil {
-		return nil, err
-	}
-
-	for _, mount := range f.fs.mounts {
-		info := aufs.NewNodeInfo(mount.Point(), 0, time.Time{}, true, "", "")
-		infos = append(infos, info)
-	}
-
-	if count <= 0 || count > len(infos) {
-		count = len(infos)
-	}
-
-	fsInfos := make([]fs.FileInfo, count)
-	for i := 0; i < count; i++ {
-		fsInfos[i] = infos[i]
-	}
-
-	return fsInfos, err
+	return f.dirReader.Readdir(count)
 }
 
 func (f fsFile) Stat() (fs.FileInfo, error) {
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"path"
+	"strings"
+)
+
+// eventFilter selects the events a listener is interested in, as configured by its aufs.ListenerOptions.
+type eventFilter struct {
+	include    []string
+	exclude    []string
+	kinds      map[aufs.EventKind]bool
+	mounts     map[string]bool
+	mountPoint func(path string) string
+}
+
+// newEventFilter returns the filter configured by options, nil when options select every event. mountPoint resolves
+// the mount point holding a path.
+func newEventFilter(options aufs.ListenerOptions, mountPoint func(path string) string) *eventFilter {
+	if len(options.Include) == 0 && len(options.Exclude) == 0 && len(options.Kinds) == 0 && len(options.Mounts) == 0 {
+		return nil
+	}
+
+	filter := &eventFilter{
+		include:    options.Include,
+		exclude:    options.Exclude,
+		mountPoint: mountPoint,
+	}
+
+	if len(options.Kinds) > 0 {
+		filter.kinds = map[aufs.EventKind]bool{}
+		for _, kind := range options.Kinds {
+			filter.kinds[kind] = true
+		}
+	}
+
+	if len(options.Mounts) > 0 {
+		filter.mounts = map[string]bool{}
+		for _, point := range options.Mounts {
+			filter.mounts[CleanMountPoint(point)] = true
+		}
+	}
+
+	return filter
+}
+
+func (f *eventFilter) matches(event Event) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.kinds != nil && !f.kinds[event.Kind] {
+		return false
+	}
+
+	if f.mounts != nil && !f.mounts[f.eventMountPoint(event)] {
+		return false
+	}
+
+	paths := []string{event.Path}
+	if event.OldPath != "" {
+		paths = append(paths, event.OldPath)
+	}
+
+	if len(f.include) > 0 && !anyMatch(f.include, paths) {
+		return false
+	}
+
+	return !anyMatch(f.exclude, paths)
+}
+
+func (f *eventFilter) eventMountPoint(event Event) string {
+	// The mount itself is the subject of these events, and is already detached when unmounted
+	if event.Kind == aufs.EventMounted || event.Kind == aufs.EventUnmounted {
+		return CleanMountPoint(event.Path)
+	}
+
+	if f.mountPoint == nil {
+		return "/"
+	}
+
+	return f.mountPoint(event.Path)
+}
+
+func anyMatch(patterns []string, paths []string) bool {
+	for _, pattern := range patterns {
+		for _, p := range paths {
+			if MatchGlob(pattern, p) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// MatchGlob reports whether filePath matches pattern. Segments are matched with path.Match, a "**" segment matches
+// any number of directories. Patterns without a slash are matched against the base name of filePath.
+func MatchGlob(pattern string, filePath string) bool {
+	filePath = path.Clean("/" + filePath)
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(filePath))
+		return ok
+	}
+
+	return matchSegments(splitPath(pattern), splitPath(filePath))
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+
+	return strings.Split(p, "/")
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+
+		ok, _ := path.Match(pattern[0], segments[0])
+		if !ok {
+			return false
+		}
+
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
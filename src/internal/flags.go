@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"io/fs"
+	"os"
+)
+
+// IsWritable tells whether the os.OpenFile flag opens a file for writing.
+func IsWritable(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// IsReadable tells whether the os.OpenFile flag opens a file for reading.
+func IsReadable(flag int) bool {
+	return flag&os.O_WRONLY == 0
+}
+
+// CheckOpenFlags verifies path may be opened in storage with the os.OpenFile flag, returning whether it exists.
+func CheckOpenFlags(storage aufs.Storage, path string, flag int) (bool, error) {
+	_, err := storage.Stat(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	exists := err == nil
+
+	switch {
+	case !exists && flag&os.O_CREATE == 0:
+		return false, aufs.NewError(aufs.NotFound, "open", path, nil)
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return true, aufs.NewError(aufs.AlreadyExists, "open", path, nil)
+	}
+
+	return exists, nil
+}
+
+// CreatesOnClose tells whether opening a file with the os.OpenFile flag creates or truncates it, which storages
+// writing files when closed must do even if nothing was written.
+func CreatesOnClose(flag int, exists bool) bool {
+	if !IsWritable(flag) {
+		return false
+	}
+
+	return (!exists && flag&os.O_CREATE != 0) || (exists && flag&os.O_TRUNC != 0)
+}
+
+// HandleModeError returns the error of doing op on a handle whose open mode does not allow it, like writing to a
+// handle opened read-only.
+func HandleModeError(op string, path string) error {
+	return aufs.NewError(aufs.PermissionDenied, op, path, fmt.Errorf("handle not opened for %s", op))
+}
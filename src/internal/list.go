@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"context"
+	aufs "github.com/aulaga/aufs/src"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+const defaultPageSize = 1000
+
+// List returns an iterator over the nodes of path in storage. Storages not implementing aufs.Lister are listed at
+// once with ListDir.
+func List(ctx context.Context, storage aufs.Storage, path string, options aufs.ListOptions) (aufs.NodeIterator, error) {
+	lister, ok := storage.(aufs.Lister)
+	if ok {
+		return lister.ListWithContext(ctx, path, options)
+	}
+
+	infos, err := WithContext(storage).ListDirWithContext(ctx, path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return ApplyListOptions(NewSliceIterator(infos, options.PageSize), options), nil
+}
+
+// NewNodeIterator returns an iterator paging the nodes pulled one at a time from next, which returns io.EOF once
+// done. closeFn, if any, is called when the iterator is closed.
+func NewNodeIterator(next func() (aufs.NodeInfo, error), closeFn func() error, pageSize int) aufs.NodeIterator {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+
+	return &funcIterator{next: next, closeFn: closeFn, pageSize: pageSize}
+}
+
+type funcIterator struct {
+	next     func() (aufs.NodeInfo, error)
+	closeFn  func() error
+	pageSize int
+	done     bool
+}
+
+func (i *funcIterator) Next() ([]aufs.NodeInfo, error) {
+	if i.done {
+		return nil, io.EOF
+	}
+
+	page := make([]aufs.NodeInfo, 0, i.pageSize)
+	for len(page) < i.pageSize {
+		info, err := i.next()
+		if err == io.EOF {
+			i.done = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		page = append(page, info)
+	}
+
+	if len(page) == 0 {
+		return nil, io.EOF
+	}
+
+	return page, nil
+}
+
+func (i *funcIterator) Close() error {
+	i.done = true
+	if i.closeFn == nil {
+		return nil
+	}
+
+	return i.closeFn()
+}
+
+// NewSliceIterator returns an iterator paging infos.
+func NewSliceIterator(infos []aufs.NodeInfo, pageSize int) aufs.NodeIterator {
+	next := func() (aufs.NodeInfo, error) {
+		if len(infos) == 0 {
+			return nil, io.EOF
+		}
+
+		info := infos[0]
+		infos = infos[1:]
+		return info, nil
+	}
+
+	return NewNodeIterator(next, nil, pageSize)
+}
+
+// ApplyListOptions applies the cursor and the sort order of options to iterator, which lists nodes as the storage
+// returns them.
+func ApplyListOptions(iterator aufs.NodeIterator, options aufs.ListOptions) aufs.NodeIterator {
+	if options.StartAfter == "" && options.Sort == aufs.ListUnsorted {
+		return iterator
+	}
+
+	var page []aufs.NodeInfo
+	var sorted []aufs.NodeInfo
+	sortLoaded := false
+
+	next := func() (aufs.NodeInfo, error) {
+		if options.Sort == aufs.ListSortByName {
+			if !sortLoaded {
+				all, err := drain(iterator)
+				if err != nil {
+					return nil, err
+				}
+
+				sort.Slice(all, func(i, j int) bool {
+					return all[i].Name() < all[j].Name()
+				})
+				sorted, sortLoaded = all, true
+			}
+
+			for len(sorted) > 0 {
+				info := sorted[0]
+				sorted = sorted[1:]
+				if info.Name() > options.StartAfter {
+					return info, nil
+				}
+			}
+
+			return nil, io.EOF
+		}
+
+		for {
+			for len(page) > 0 {
+				info := page[0]
+				page = page[1:]
+				if info.Name() > options.StartAfter {
+					return info, nil
+				}
+			}
+
+			var err error
+			page, err = iterator.Next()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return NewNodeIterator(next, iterator.Close, options.PageSize)
+}
+
+func drain(iterator aufs.NodeIterator) ([]aufs.NodeInfo, error) {
+	var all []aufs.NodeInfo
+	for {
+		page, err := iterator.Next()
+		if err == io.EOF {
+			return all, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, page...)
+	}
+}
+
+// DirReader implements the Readdir contract of files over a listing opened on the first call: a positive count
+// returns the next count nodes at most and io.EOF at the end of the directory, otherwise all remaining nodes are
+// returned at once.
+type DirReader struct {
+	open     func() (aufs.NodeIterator, error)
+	iterator aufs.NodeIterator
+	pending  []aufs.NodeInfo
+	done     bool
+}
+
+func NewDirReader(open func() (aufs.NodeIterator, error)) *DirReader {
+	return &DirReader{open: open}
+}
+
+func (d *DirReader) Readdir(count int) ([]fs.FileInfo, error) {
+	if d.iterator == nil && !d.done {
+		iterator, err := d.open()
+		if err != nil {
+			return nil, err
+		}
+		d.iterator = iterator
+	}
+
+	var infos []fs.FileInfo
+	for count <= 0 || len(infos) < count {
+		if len(d.pending) == 0 {
+			if d.done {
+				break
+			}
+
+			page, err := d.iterator.Next()
+			if err == io.EOF {
+				d.done = true
+				break
+			}
+			if err != nil {
+				return infos, err
+			}
+			d.pending = page
+		}
+
+		take := len(d.pending)
+		if count > 0 && count-len(infos) < take {
+			take = count - len(infos)
+		}
+		for _, info := range d.pending[:take] {
+			infos = append(infos, info)
+		}
+		d.pending = d.pending[take:]
+	}
+
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+
+	return infos, nil
+}
+
+func (d *DirReader) Close() error {
+	if d.iterator == nil {
+		return nil
+	}
+
+	d.done = true
+	return d.iterator.Close()
+}
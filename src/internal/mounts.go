@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type mount struct {
+	storage aufs.Storage
+	point   string
+	mode    aufs.MountMode
+}
+
+func (m mount) Storage() aufs.Storage {
+	return m.storage
+}
+
+func (m mount) Point() string {
+	return m.point
+}
+
+func (m mount) Mode() aufs.MountMode {
+	return m.mode
+}
+
+// NewMount returns a mount of storage at the given point, the point is normalized to the "/point/" form.
+func NewMount(storage aufs.Storage, point string, mode aufs.MountMode) aufs.Mount {
+	return &mount{
+		storage: storage,
+		point:   CleanMountPoint(point),
+		mode:    mode,
+	}
+}
+
+// CleanMountPoint normalizes a mount point to the "/point/" form used by the mount table.
+func CleanMountPoint(point string) string {
+	point = filepath.Clean("/" + point)
+	if point == "/" {
+		return point
+	}
+
+	return point + "/"
+}
+
+// mountTable resolves paths to mounts, always picking the deepest mount point containing a path.
+type mountTable struct {
+	root   aufs.Mount
+	mounts []aufs.Mount // sorted by depth, deepest first
+}
+
+func newMountTable(root aufs.Storage, mounts []aufs.Mount) (*mountTable, error) {
+	seen := map[string]bool{}
+	sorted := make([]aufs.Mount, 0, len(mounts))
+	for _, m := range mounts {
+		point := CleanMountPoint(m.Point())
+		if point == "/" {
+			return nil, fmt.Errorf("invalid mount point '%s', cannot mount over the filesystem root", m.Point())
+		}
+		if seen[point] {
+			return nil, fmt.Errorf("invalid mount point '%s', another storage is already mounted at '%s'", m.Point(), point)
+		}
+		seen[point] = true
+
+		// Mounts already in normalized form are kept as-is so their identity survives table rebuilds
+		if point != m.Point() {
+			m = &mount{storage: m.Storage(), point: point, mode: m.Mode()}
+		}
+		sorted = append(sorted, m)
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return mountDepth(sorted[i].Point()) > mountDepth(sorted[j].Point())
+	})
+
+	return &mountTable{
+		root:   &mount{storage: root, point: "/", mode: aufs.MountReadWrite},
+		mounts: sorted,
+	}, nil
+}
+
+func mountDepth(point string) int {
+	return strings.Count(point, "/")
+}
+
+// resolve returns the deepest mount containing filePath and the path relative to that mount.
+func (t *mountTable) resolve(filePath string) (aufs.Mount, string) {
+	filePath = filepath.Clean("/" + filePath)
+
+	for _, m := range t.mounts {
+		dirPath := filePath + "/"
+		if !strings.HasPrefix(dirPath, m.Point()) {
+			continue
+		}
+
+		relPath := strings.Trim(strings.TrimPrefix(dirPath, m.Point()), "/")
+		if relPath == "" {
+			relPath = "."
+		}
+
+		return m, relPath
+	}
+
+	return t.root, filePath
+}
+
+// lookup returns the mount at exactly the given point, if any.
+func (t *mountTable) lookup(point string) (aufs.Mount, bool) {
+	point = CleanMountPoint(point)
+	for _, m := range t.mounts {
+		if m.Point() == point {
+			return m, true
+		}
+	}
+
+	return nil, false
+}
+
+// checkPoint verifies a storage may be mounted at point, which must be neither the root nor an existing mount point.
+func (t *mountTable) checkPoint(point string) error {
+	clean := CleanMountPoint(point)
+	if clean == "/" {
+		return fmt.Errorf("invalid mount point '%s', cannot mount over the filesystem root", point)
+	}
+	if _, ok := t.lookup(clean); ok {
+		return fmt.Errorf("invalid mount point '%s', another storage is already mounted at '%s'", point, clean)
+	}
+
+	return nil
+}
+
+// with returns a new table including m, leaving t untouched.
+func (t *mountTable) with(m aufs.Mount) (*mountTable, error) {
+	mounts := append([]aufs.Mount{m}, t.mounts...)
+	return newMountTable(t.root.Storage(), mounts)
+}
+
+// without returns a new table excluding m, leaving t untouched.
+func (t *mountTable) without(m aufs.Mount) (*mountTable, error) {
+	mounts := make([]aufs.Mount, 0, len(t.mounts))
+	for _, other := range t.mounts {
+		if other != m {
+			mounts = append(mounts, other)
+		}
+	}
+
+	return newMountTable(t.root.Storage(), mounts)
+}
+
+// children returns the mounts whose point is a direct child of dirPath.
+func (t *mountTable) children(dirPath string) []aufs.Mount {
+	dirPath = CleanMountPoint(dirPath)
+
+	var children []aufs.Mount
+	for _, m := range t.mounts {
+		if !strings.HasPrefix(m.Point(), dirPath) {
+			continue
+		}
+
+		relPoint := strings.Trim(strings.TrimPrefix(m.Point(), dirPath), "/")
+		if relPoint != "" && !strings.Contains(relPoint, "/") {
+			children = append(children, m)
+		}
+	}
+
+	return children
+}
@@ -0,0 +1,51 @@
+package internal_test
+
+import (
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"testing"
+)
+
+// countingProvider provides memory storages and counts them.
+type countingProvider struct {
+	t        *testing.T
+	provided int
+}
+
+func (p *countingProvider) ProvideFileSystem(aufs.FileSystemSpec) (aufs.Filesystem, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (p *countingProvider) ProvideStorage(aufs.StorageSpec) (aufs.Storage, error) {
+	p.provided++
+	return newMemoryStorage(p.t), nil
+}
+
+func TestMountInvalidPointProvidesNoStorage(t *testing.T) {
+	provider := &countingProvider{t: t}
+	fs, err := internal.NewFilesystem("fs", newMemoryStorage(t), []aufs.Mount{
+		internal.NewMount(newMemoryStorage(t), "/data", aufs.MountReadWrite),
+	}, provider)
+	if err != nil {
+		t.Fatalf("failed to create filesystem, %s", err.Error())
+	}
+
+	for _, point := range []string{"/", "/data", "data/"} {
+		err = fs.Mount(aufs.MountSpec{Storage: aufs.StorageSpec{Id: "other", Uri: "memory://"}, MountPoint: point})
+		if err == nil {
+			t.Fatalf("mount at '%s' succeeded", point)
+		}
+	}
+	if provider.provided != 0 {
+		t.Fatalf("invalid mounts provided %d storages", provider.provided)
+	}
+
+	err = fs.Mount(aufs.MountSpec{Storage: aufs.StorageSpec{Id: "other", Uri: "memory://"}, MountPoint: "/other"})
+	if err != nil {
+		t.Fatalf("mount at '/other' failed, %s", err.Error())
+	}
+	if provider.provided != 1 {
+		t.Fatalf("mount provided %d storages, want 1", provider.provided)
+	}
+}
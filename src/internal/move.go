@@ -0,0 +1,345 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/google/uuid"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	moveExtension = ".json"
+	// moveStagingPrefix names the staging copies of moves, next to their destination
+	moveStagingPrefix = ".aufs-move-"
+	// cleanupTimeout bounds the cleanups of failed moves and copies, which run even when their context is done
+	cleanupTimeout = 5 * time.Minute
+)
+
+type movePhase string
+
+const (
+	// moveCopying moves are rolled back, their staging copy is deleted and the source left in place.
+	moveCopying movePhase = "copying"
+	// moveCommitting moves were verified, they are resumed by renaming the staging copy and deleting the source.
+	moveCommitting movePhase = "committing"
+)
+
+type moveRecord struct {
+	Id      string    `json:"id"`
+	Phase   movePhase `json:"phase"`
+	SrcPath string    `json:"src_path"`
+	DstPath string    `json:"dst_path"`
+	// StagingPath is relative to the destination storage, which may not be the storage of its filesystem path when
+	// the destination is a mount point
+	StagingPath string    `json:"staging_path"`
+	SrcStorage  string    `json:"src_storage"`
+	DstStorage  string    `json:"dst_storage"`
+	SrcMount    string    `json:"src_mount"`
+	DstMount    string    `json:"dst_mount"`
+	Started     time.Time `json:"started"`
+}
+
+// MoveJournal records the moves across storages in progress, one file per move in its directory, so moves interrupted
+// by a crash can be recovered. A nil MoveJournal records nothing.
+type MoveJournal struct {
+	spec aufs.MoveJournalSpec
+}
+
+// OpenMoveJournal opens the move journal in spec.Dir, creating it if needed.
+func OpenMoveJournal(spec aufs.MoveJournalSpec) (*MoveJournal, error) {
+	if spec.Dir == "" {
+		return nil, fmt.Errorf("move journal dir is required")
+	}
+
+	err := os.MkdirAll(spec.Dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create move journal dir '%s', %s", spec.Dir, err.Error())
+	}
+
+	return &MoveJournal{spec: spec}, nil
+}
+
+func (j *MoveJournal) checksum() bool {
+	return j != nil && j.spec.Checksum
+}
+
+// save writes record, replacing its previous state atomically.
+func (j *MoveJournal) save(record *moveRecord) error {
+	if j == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	name := record.Id + moveExtension
+	tmpPath := filepath.Join(j.spec.Dir, "."+name)
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to journal move of '%s', %s", record.SrcPath, err.Error())
+	}
+
+	_, err = file.Write(body)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(j.spec.Dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to journal move of '%s', %s", record.SrcPath, err.Error())
+	}
+
+	return nil
+}
+
+func (j *MoveJournal) remove(record *moveRecord) {
+	if j == nil {
+		return
+	}
+
+	err := os.Remove(filepath.Join(j.spec.Dir, record.Id+moveExtension))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove journaled move of '%s', %s\n", record.SrcPath, err)
+	}
+}
+
+// pending returns the moves left unfinished, oldest first.
+func (j *MoveJournal) pending() ([]*moveRecord, error) {
+	names, err := filepath.Glob(filepath.Join(j.spec.Dir, "*"+moveExtension))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*moveRecord
+	for _, name := range names {
+		body, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journaled move '%s', %s", name, err.Error())
+		}
+
+		record := &moveRecord{}
+		err = json.Unmarshal(body, record)
+		if err != nil {
+			return nil, fmt.Errorf("invalid journaled move '%s', %s", name, err.Error())
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, k int) bool {
+		return records[i].Started.Before(records[k].Started)
+	})
+
+	return records, nil
+}
+
+// SetMoveJournal records the moves across storages of the filesystem to journal, see RecoverMoves.
+func (f *Filesystem) SetMoveJournal(journal *MoveJournal) {
+	f.moveJournal = journal
+}
+
+// RecoverMoves finishes the moves the journal recorded as unfinished. Moves interrupted before their copy was verified
+// are rolled back, the others are resumed. Moves whose storages are not mounted at the same points with the same ids
+// anymore are left in the journal.
+func (f *Filesystem) RecoverMoves(ctx context.Context) error {
+	if f.moveJournal == nil {
+		return nil
+	}
+
+	records, err := f.moveJournal.pending()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		srcMount, relSrcPath := f.MountForPath(record.SrcPath)
+		dstMount, relDstPath := f.MountForPath(record.DstPath)
+		srcStorage, dstStorage := srcMount.Storage(), dstMount.Storage()
+		if srcStorage.Id() != record.SrcStorage || srcMount.Point() != record.SrcMount ||
+			dstStorage.Id() != record.DstStorage || dstMount.Point() != record.DstMount {
+			log.Printf("cannot recover move of '%s' to '%s', its storages are not mounted there anymore\n", record.SrcPath, record.DstPath)
+			continue
+		}
+
+		src, dst := WithContext(srcStorage), WithContext(dstStorage)
+		switch record.Phase {
+		case moveCommitting:
+			err = commitMove(ctx, src, dst, relSrcPath, relDstPath, record.StagingPath)
+		default:
+			err = deleteIfExists(ctx, dst, record.StagingPath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to recover move of '%s' to '%s', %s", record.SrcPath, record.DstPath, err.Error())
+		}
+
+		f.moveJournal.remove(record)
+	}
+
+	return nil
+}
+
+// crossMove moves srcPath to dstPath across storages without losing or duplicating data. The source is copied to a
+// staging path next to the destination and verified, before the staging copy is renamed into place and the source is
+// deleted. A failed copy only leaves the source in place, with the destination untouched. Existing directories are
+// not merged with the source, moving onto them fails.
+func (f *Filesystem) crossMove(ctx context.Context, srcMount aufs.Mount, dstMount aufs.Mount, srcPath string, dstPath string, relSrcPath string, relDstPath string) error {
+	src, dst := WithContext(srcMount.Storage()), WithContext(dstMount.Storage())
+	err := checkMoveTarget(ctx, dst, relDstPath)
+	if err != nil {
+		return err
+	}
+
+	id := uuid.New().String()
+	relStagingPath := path.Join(path.Dir(relDstPath), moveStagingPrefix+id)
+	record := &moveRecord{
+		Id:          id,
+		Phase:       moveCopying,
+		SrcPath:     srcPath,
+		DstPath:     dstPath,
+		StagingPath: relStagingPath,
+		SrcStorage:  src.Id(),
+		DstStorage:  dst.Id(),
+		SrcMount:    srcMount.Point(),
+		DstMount:    dstMount.Point(),
+		Started:     time.Now(),
+	}
+
+	err = f.moveJournal.save(record)
+	if err != nil {
+		return err
+	}
+
+	report, err := CopyTree(ctx, src, dst, relSrcPath, relStagingPath, aufs.CopyOptions{Checksum: f.moveJournal.checksum()})
+	if err == nil {
+		err = report.Err()
+	}
+	if err == nil {
+		record.Phase = moveCommitting
+		err = f.moveJournal.save(record)
+	}
+	if err != nil {
+		return f.rollbackMove(record, dst, relStagingPath, err)
+	}
+
+	err = renameInto(ctx, dst, relStagingPath, relDstPath)
+	if err != nil {
+		return f.rollbackMove(record, dst, relStagingPath, err)
+	}
+
+	// The destination is complete, a failure deleting the source is resumed on recovery
+	err = ManualDeleteWithContext(ctx, src, relSrcPath)
+	if err != nil {
+		return fmt.Errorf("moved '%s' to '%s' but failed to delete the source, %s", srcPath, dstPath, err.Error())
+	}
+
+	f.moveJournal.remove(record)
+	return nil
+}
+
+// rollbackMove deletes the staging copy of a failed move, keeping the move journaled when it cannot.
+func (f *Filesystem) rollbackMove(record *moveRecord, dst aufs.ContextStorage, relStagingPath string, cause error) error {
+	// The cleanup must run even when the move stopped because its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	err := deleteIfExists(ctx, dst, relStagingPath)
+	if err != nil {
+		return fmt.Errorf("move of '%s' to '%s' failed (%s), then failed to delete its staging copy '%s' (%s)", record.SrcPath, record.DstPath, cause.Error(), record.StagingPath, err.Error())
+	}
+
+	f.moveJournal.remove(record)
+	return cause
+}
+
+// commitMove renames the staging copy of a verified move into place, unless already done, and deletes the source. The
+// source is only deleted once the destination is found in place.
+func commitMove(ctx context.Context, src aufs.ContextStorage, dst aufs.ContextStorage, srcPath string, dstPath string, stagingPath string) error {
+	_, err := dst.StatWithContext(ctx, stagingPath)
+	if err == nil {
+		err = renameInto(ctx, dst, stagingPath, dstPath)
+		if err != nil {
+			return err
+		}
+	} else if aufs.CodeOf(err) != aufs.NotFound {
+		return err
+	}
+
+	_, err = dst.StatWithContext(ctx, dstPath)
+	if err != nil {
+		return fmt.Errorf("staging copy of '%s' is gone but the destination is missing, %s", srcPath, err.Error())
+	}
+
+	return deleteIfExists(ctx, src, srcPath)
+}
+
+// checkMoveTarget fails when dstPath is an existing directory, which moves do not merge into.
+func checkMoveTarget(ctx context.Context, storage aufs.ContextStorage, dstPath string) error {
+	info, err := storage.StatWithContext(ctx, dstPath)
+	if aufs.CodeOf(err) == aufs.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return aufs.NewError(aufs.AlreadyExists, "move", dstPath, fmt.Errorf("a directory exists there"))
+	}
+
+	return nil
+}
+
+// renameInto moves stagingPath to dstPath within storage, replacing a file there but never an existing directory.
+// Storages that cannot move get the staging copy copied into place and deleted, a failed copy removes what it created.
+func renameInto(ctx context.Context, storage aufs.ContextStorage, stagingPath string, dstPath string) error {
+	err := checkMoveTarget(ctx, storage, dstPath)
+	if err != nil {
+		return err
+	}
+
+	err = storage.MoveWithContext(ctx, stagingPath, dstPath)
+	if aufs.CodeOf(err) != aufs.NotSupported {
+		return err
+	}
+
+	info, err := storage.StatWithContext(ctx, stagingPath)
+	if err != nil {
+		return err
+	}
+
+	err = ManualCopyWithContext(ctx, storage, storage, stagingPath, dstPath)
+	if err != nil {
+		if info.IsDir() {
+			// The directory did not exist before the copy
+			_ = ManualDeleteWithContext(ctx, storage, dstPath)
+		}
+		return err
+	}
+
+	return ManualDeleteWithContext(ctx, storage, stagingPath)
+}
+
+func deleteIfExists(ctx context.Context, storage aufs.ContextStorage, path string) error {
+	_, err := storage.StatWithContext(ctx, path)
+	if aufs.CodeOf(err) == aufs.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return ManualDeleteWithContext(ctx, storage, path)
+}
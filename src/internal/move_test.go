@@ -0,0 +1,267 @@
+package internal_test
+
+import (
+	"context"
+	"encoding/json"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/faulty"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/storager"
+	"go.beyondstorage.io/v5/services"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newMoveFilesystem returns a filesystem with hot and cold mounted at "/hot" and "/cold", journaling its moves to dir.
+func newMoveFilesystem(t *testing.T, hot aufs.Storage, cold aufs.Storage, dir string) *internal.Filesystem {
+	fs, err := internal.NewFilesystem("fs", newMemoryStorage(t), []aufs.Mount{
+		internal.NewMount(hot, "/hot", aufs.MountReadWrite),
+		internal.NewMount(cold, "/cold", aufs.MountReadWrite),
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to create filesystem, %s", err.Error())
+	}
+
+	journal, err := internal.OpenMoveJournal(aufs.MoveJournalSpec{Dir: dir, Checksum: true})
+	if err != nil {
+		t.Fatalf("failed to open move journal, %s", err.Error())
+	}
+	fs.SetMoveJournal(journal)
+
+	return fs
+}
+
+func readFile(t *testing.T, s aufs.Storage, filePath string) string {
+	t.Helper()
+	file, err := s.OpenFile(filePath, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("failed to open '%s', %s", filePath, err.Error())
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("failed to read '%s', %s", filePath, err.Error())
+	}
+
+	return string(content)
+}
+
+func expectMissing(t *testing.T, s aufs.Storage, filePath string) {
+	t.Helper()
+	_, err := s.Stat(filePath)
+	if aufs.CodeOf(err) != aufs.NotFound {
+		t.Fatalf("stat of '%s' returned %v, want a NotFound error", filePath, err)
+	}
+}
+
+func expectJournalEmpty(t *testing.T, dir string) {
+	t.Helper()
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(names) != 0 {
+		t.Fatalf("move journal holds %q", names)
+	}
+}
+
+func writeRecord(t *testing.T, dir string, record map[string]string) {
+	t.Helper()
+	body, _ := json.Marshal(record)
+	err := os.WriteFile(filepath.Join(dir, record["id"]+".json"), body, 0o600)
+	if err != nil {
+		t.Fatalf("failed to write journaled move, %s", err.Error())
+	}
+}
+
+func mountPoint(fs aufs.Filesystem, filePath string) string {
+	mount, _ := fs.MountForPath(filePath)
+	return mount.Point()
+}
+
+func TestCrossMove(t *testing.T) {
+	hot, cold, dir := newMemoryStorage(t), newMemoryStorage(t), t.TempDir()
+	fs := newMoveFilesystem(t, hot, cold, dir)
+	writeFile(t, hot, "a.txt", "new")
+	writeFile(t, cold, "a.txt", "old")
+
+	err := fs.Move("/hot/a.txt", "/cold/a.txt")
+	if err != nil {
+		t.Fatalf("move failed, %s", err.Error())
+	}
+
+	expectMissing(t, hot, "a.txt")
+	if content := readFile(t, cold, "a.txt"); content != "new" {
+		t.Fatalf("moved file holds %q", content)
+	}
+	infos, _ := cold.ListDir("", false)
+	if len(infos) != 1 {
+		t.Fatalf("move left %d files at the destination", len(infos))
+	}
+	expectJournalEmpty(t, dir)
+}
+
+func TestCrossMoveRollback(t *testing.T) {
+	for name, fault := range map[string]faulty.Fault{
+		"Write":  {Op: faulty.OpWrite, Partial: 2},
+		"Close":  {Op: faulty.OpClose, Err: faulty.ErrInjected},
+		"Rename": {Op: faulty.OpMove, Err: aufs.ErrStorageUnavailable},
+	} {
+		fault := fault
+		t.Run(name, func(t *testing.T) {
+			hot, cold, dir := newMemoryStorage(t), newMemoryStorage(t), t.TempDir()
+			faultyCold := faulty.New(cold.Id(), cold)
+			fs := newMoveFilesystem(t, hot, faultyCold, dir)
+			writeFile(t, hot, "a.txt", "new")
+			writeFile(t, cold, "a.txt", "old")
+
+			faultyCold.Inject(fault)
+			err := fs.Move("/hot/a.txt", "/cold/a.txt")
+			if err == nil {
+				t.Fatalf("move with a %s fault succeeded", name)
+			}
+
+			if content := readFile(t, hot, "a.txt"); content != "new" {
+				t.Fatalf("source holds %q after the failed move", content)
+			}
+			if content := readFile(t, cold, "a.txt"); content != "old" {
+				t.Fatalf("destination holds %q after the failed move", content)
+			}
+			infos, _ := cold.ListDir("", false)
+			if len(infos) != 1 {
+				t.Fatalf("failed move left %d files at the destination", len(infos))
+			}
+			expectJournalEmpty(t, dir)
+		})
+	}
+}
+
+func TestCrossMoveOntoDirectory(t *testing.T) {
+	hot, cold, dir := newMemoryStorage(t), newMemoryStorage(t), t.TempDir()
+	fs := newMoveFilesystem(t, hot, cold, dir)
+	writeFile(t, hot, "a.txt", "a")
+	_, err := cold.MkDir("dir")
+	if err != nil {
+		t.Fatalf("failed to create 'dir', %s", err.Error())
+	}
+
+	for _, dstPath := range []string{"/cold/dir", "/cold"} {
+		err = fs.Move("/hot/a.txt", dstPath)
+		if aufs.CodeOf(err) != aufs.AlreadyExists {
+			t.Fatalf("move onto directory '%s' returned %v, want an AlreadyExists error", dstPath, err)
+		}
+	}
+
+	if content := readFile(t, hot, "a.txt"); content != "a" {
+		t.Fatalf("source holds %q after the failed moves", content)
+	}
+	infos, _ := cold.ListDir("", false)
+	dirInfos, _ := cold.ListDir("dir", false)
+	if len(infos) != 1 || len(dirInfos) != 0 {
+		t.Fatalf("failed moves left %d nodes at the destination", len(infos)+len(dirInfos)-1)
+	}
+	expectJournalEmpty(t, dir)
+}
+
+func TestRecoverMoves(t *testing.T) {
+	hot, cold, dir := newMemoryStorage(t), newMemoryStorage(t), t.TempDir()
+	fs := newMoveFilesystem(t, hot, cold, dir)
+
+	// Verified moves are resumed, the others are rolled back
+	writeFile(t, hot, "committed.txt", "committed")
+	writeFile(t, cold, ".aufs-move-1", "committed")
+	writeRecord(t, dir, map[string]string{
+		"id": "1", "phase": "committing", "src_path": "/hot/committed.txt", "dst_path": "/cold/committed.txt",
+		"staging_path": ".aufs-move-1", "src_storage": hot.Id(), "dst_storage": cold.Id(),
+		"src_mount": mountPoint(fs, "/hot"), "dst_mount": mountPoint(fs, "/cold"),
+	})
+	writeFile(t, hot, "copying.txt", "copying")
+	writeFile(t, cold, ".aufs-move-2", "cop")
+	writeRecord(t, dir, map[string]string{
+		"id": "2", "phase": "copying", "src_path": "/hot/copying.txt", "dst_path": "/cold/copying.txt",
+		"staging_path": ".aufs-move-2", "src_storage": hot.Id(), "dst_storage": cold.Id(),
+		"src_mount": mountPoint(fs, "/hot"), "dst_mount": mountPoint(fs, "/cold"),
+	})
+
+	err := fs.RecoverMoves(context.Background())
+	if err != nil {
+		t.Fatalf("recovery failed, %s", err.Error())
+	}
+
+	expectMissing(t, hot, "committed.txt")
+	if content := readFile(t, cold, "committed.txt"); content != "committed" {
+		t.Fatalf("resumed move holds %q", content)
+	}
+	if content := readFile(t, hot, "copying.txt"); content != "copying" {
+		t.Fatalf("rolled back move source holds %q", content)
+	}
+	expectMissing(t, cold, ".aufs-move-1")
+	expectMissing(t, cold, ".aufs-move-2")
+	expectMissing(t, cold, "copying.txt")
+	expectJournalEmpty(t, dir)
+}
+
+func TestRecoverMovesKeepsSourceWithoutDestination(t *testing.T) {
+	hot, cold, dir := newMemoryStorage(t), newMemoryStorage(t), t.TempDir()
+	fs := newMoveFilesystem(t, hot, cold, dir)
+	writeFile(t, hot, "a.txt", "a")
+	writeRecord(t, dir, map[string]string{
+		"id": "1", "phase": "committing", "src_path": "/hot/a.txt", "dst_path": "/cold/a.txt",
+		"staging_path": ".aufs-move-1", "src_storage": hot.Id(), "dst_storage": cold.Id(),
+		"src_mount": mountPoint(fs, "/hot"), "dst_mount": mountPoint(fs, "/cold"),
+	})
+
+	err := fs.RecoverMoves(context.Background())
+	if err == nil {
+		t.Fatalf("recovery of a move without staging copy nor destination succeeded")
+	}
+	if content := readFile(t, hot, "a.txt"); content != "a" {
+		t.Fatalf("source holds %q after the failed recovery", content)
+	}
+}
+
+func TestRecoverMovesRequiresSameMountPoints(t *testing.T) {
+	newStorage := func() aufs.Storage {
+		s, err := services.NewStoragerFromString("memory://")
+		if err != nil {
+			t.Fatalf("failed to create storager, %s", err.Error())
+		}
+		return storager.NewStorager("", s)
+	}
+
+	// Storages without ids, as specs may leave them, where "/hot" is not mounted anymore
+	root, cold, dir := newStorage(), newStorage(), t.TempDir()
+	fs, err := internal.NewFilesystem("fs", root, []aufs.Mount{
+		internal.NewMount(cold, "/cold", aufs.MountReadWrite),
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to create filesystem, %s", err.Error())
+	}
+	journal, err := internal.OpenMoveJournal(aufs.MoveJournalSpec{Dir: dir})
+	if err != nil {
+		t.Fatalf("failed to open move journal, %s", err.Error())
+	}
+	fs.SetMoveJournal(journal)
+
+	writeFile(t, root, "hot/a.txt", "root")
+	writeFile(t, cold, ".aufs-move-1", "hot")
+	writeRecord(t, dir, map[string]string{
+		"id": "1", "phase": "committing", "src_path": "/hot/a.txt", "dst_path": "/cold/a.txt",
+		"staging_path": ".aufs-move-1", "src_storage": "", "dst_storage": "",
+		"src_mount": "/hot/", "dst_mount": mountPoint(fs, "/cold"),
+	})
+
+	err = fs.RecoverMoves(context.Background())
+	if err != nil {
+		t.Fatalf("recovery failed, %s", err.Error())
+	}
+
+	if content := readFile(t, root, "hot/a.txt"); content != "root" {
+		t.Fatalf("file of another storage holds %q after the recovery", content)
+	}
+	expectMissing(t, cold, "a.txt")
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(names) != 1 {
+		t.Fatalf("move journal holds %d moves, want the unrecoverable move kept", len(names))
+	}
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"context"
+	aufs "github.com/aulaga/aufs/src"
+)
+
+// checkWrite verifies relPath may be created or overwritten in mount, path is the filesystem path reported on error.
+// Append-only and write-once mounts only allow creating files, their existing files are never replaced.
+func checkWrite(ctx context.Context, mount aufs.Mount, relPath string, op string, path string) error {
+	switch mount.Mode() {
+	case aufs.MountReadOnly:
+		return aufs.NewPermissionError(op, path, mount.Mode())
+	case aufs.MountAppendOnly, aufs.MountWriteOnce:
+		return checkMissing(ctx, mount, relPath, op, path)
+	}
+
+	return nil
+}
+
+// checkModify verifies the existing file relPath may be written in place in mount, which append-only mounts allow.
+func checkModify(ctx context.Context, mount aufs.Mount, relPath string, op string, path string) error {
+	switch mount.Mode() {
+	case aufs.MountReadOnly:
+		return aufs.NewPermissionError(op, path, mount.Mode())
+	case aufs.MountWriteOnce:
+		return checkMissing(ctx, mount, relPath, op, path)
+	}
+
+	return nil
+}
+
+// checkMissing fails with a permission error when relPath exists in mount.
+func checkMissing(ctx context.Context, mount aufs.Mount, relPath string, op string, path string) error {
+	_, err := WithContext(mount.Storage()).StatWithContext(ctx, relPath)
+	if err == nil {
+		return aufs.NewPermissionError(op, path, mount.Mode())
+	}
+
+	return nil
+}
+
+// checkCreateDir verifies a directory may be created in mount.
+func checkCreateDir(mount aufs.Mount, op string, path string) error {
+	if mount.Mode() == aufs.MountReadOnly {
+		return aufs.NewPermissionError(op, path, mount.Mode())
+	}
+
+	return nil
+}
+
+// checkDelete verifies nodes may be removed from mount, which only read-write mounts allow.
+func checkDelete(mount aufs.Mount, op string, path string) error {
+	if mount.Mode() != aufs.MountReadWrite {
+		return aufs.NewPermissionError(op, path, mount.Mode())
+	}
+
+	return nil
+}
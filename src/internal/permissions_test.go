@@ -0,0 +1,69 @@
+package internal_test
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"os"
+	"testing"
+)
+
+// newModeFilesystem returns a filesystem with "/a.txt" in its root and an append-only and a write-once mount at
+// "/append" and "/once", both holding "/a.txt".
+func newModeFilesystem(t *testing.T) *internal.Filesystem {
+	root, appendOnly, writeOnce := newMemoryStorage(t), newMemoryStorage(t), newMemoryStorage(t)
+	for _, s := range []aufs.Storage{root, appendOnly, writeOnce} {
+		writeFile(t, s, "/a.txt", "original")
+	}
+
+	fs, err := internal.NewFilesystem("fs", root, []aufs.Mount{
+		internal.NewMount(appendOnly, "/append", aufs.MountAppendOnly),
+		internal.NewMount(writeOnce, "/once", aufs.MountWriteOnce),
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to create filesystem, %s", err.Error())
+	}
+
+	return fs
+}
+
+func writeWithFlag(fs aufs.Filesystem, filePath string, flag int) error {
+	file, err := fs.OpenFile(filePath, flag)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write([]byte("changed"))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func TestMountModes(t *testing.T) {
+	fs := newModeFilesystem(t)
+
+	for _, test := range []struct {
+		name    string
+		write   func() error
+		allowed bool
+	}{
+		{"AppendOnlyCreate", func() error { return writeWithFlag(fs, "/append/b.txt", os.O_WRONLY|os.O_CREATE) }, true},
+		{"AppendOnlyWriteInPlace", func() error { return writeWithFlag(fs, "/append/a.txt", os.O_WRONLY) }, true},
+		{"AppendOnlyTruncate", func() error { return writeWithFlag(fs, "/append/a.txt", os.O_WRONLY|os.O_TRUNC) }, false},
+		{"AppendOnlyCopyOnto", func() error { return fs.Copy("/a.txt", "/append/a.txt") }, false},
+		{"WriteOnceCreate", func() error { return writeWithFlag(fs, "/once/b.txt", os.O_WRONLY|os.O_CREATE) }, true},
+		{"WriteOnceWriteInPlace", func() error { return writeWithFlag(fs, "/once/a.txt", os.O_WRONLY) }, false},
+		{"WriteOnceTruncate", func() error { return writeWithFlag(fs, "/once/a.txt", os.O_WRONLY|os.O_TRUNC) }, false},
+		{"WriteOnceCopyOnto", func() error { return fs.Copy("/a.txt", "/once/a.txt") }, false},
+	} {
+		err := test.write()
+		if test.allowed && err != nil {
+			t.Fatalf("%s failed, %s", test.name, err.Error())
+		}
+		if !test.allowed && aufs.CodeOf(err) != aufs.PermissionDenied {
+			t.Fatalf("%s returned %v, want a PermissionDenied error", test.name, err)
+		}
+	}
+}
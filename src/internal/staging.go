@@ -0,0 +1,21 @@
+package internal
+
+import (
+	"path"
+	"strings"
+)
+
+// StagingDir holds the files written before being moved into place, at the root of their storage. It is hidden from
+// listings and its files orphaned by crashes are removed when the storage is provided.
+const StagingDir = ".aufs-staging"
+
+// NewStagingPath returns a staging path for name, relative to the storage.
+func NewStagingPath(name string) string {
+	return StagingDir + "/" + name
+}
+
+// IsStagingPath returns whether p, relative to its storage, is the staging dir or below it.
+func IsStagingPath(p string) bool {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	return p == StagingDir || strings.HasPrefix(p, StagingDir+"/")
+}
@@ -1,100 +1,93 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	aufs "github.com/aulaga/aufs/src"
 	"io"
-	"path/filepath"
-	"strings"
+	"os"
 )
 
 func CreateFile(storage aufs.Storage, path string, reader io.Reader) error {
-	file, err := storage.Open(path)
-	defer file.Close()
-	if err != nil {
-		return err
-	}
-
-	_, err = io.Copy(file, reader)
-	return err
+	return CreateFileWithContext(context.Background(), storage, path, reader)
 }
 
-func copyDir(srcStorage aufs.Storage, dstStorage aufs.Storage, srcPath string, dstPath string) error {
-	infos, err := srcStorage.ListDir(srcPath, false)
+// CreateFileWithContext writes the content of reader to path, stopping when ctx is done. The file is only written once
+// closed successfully, a failed write is aborted when the file can be.
+func CreateFileWithContext(ctx context.Context, storage aufs.Storage, path string, reader io.Reader) error {
+	file, err := WithContext(storage).OpenFileWithContext(ctx, path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
 	if err != nil {
 		return err
 	}
 
-	dstPath = strings.TrimRight(dstPath, "/\\")
-	for _, srcFileInfo := range infos {
-		relPathToFile, err := filepath.Rel(srcPath, srcFileInfo.Path())
-		if err != nil {
-			return err
-		}
-
-		dstFilePath := fmt.Sprintf("%s/%s", dstPath, relPathToFile)
-		err = ManualCopy(srcStorage, dstStorage, srcFileInfo.Path(), dstFilePath)
-		if err != nil {
-			return err
+	_, err = io.Copy(file, ContextReader(ctx, reader))
+	if err != nil {
+		aborter, ok := file.(aufs.Aborter)
+		if !ok || aborter.Abort() != nil {
+			_ = file.Close()
 		}
+		return err
 	}
 
-	return nil
+	return file.Close()
 }
 
 // ManualCopy manually copies a path from srcStorage to dstStorage. This function is storage-agnostic.
 func ManualCopy(srcStorage aufs.Storage, dstStorage aufs.Storage, srcPath string, dstPath string) error {
-	info, err := srcStorage.Stat(srcPath)
-	if err != nil {
-		return err
-	}
-
-	if info.IsDir() {
-		_, err := dstStorage.MkDir(dstPath)
-		if err != nil {
-			return err
-		}
-		return copyDir(srcStorage, dstStorage, srcPath, dstPath)
-	}
+	return ManualCopyWithContext(context.Background(), srcStorage, dstStorage, srcPath, dstPath)
+}
 
-	srcFile, err := srcStorage.Open(srcPath)
+// ManualCopyWithContext is ManualCopy stopping as soon as ctx is done, leaving what was already copied in place.
+// Existing files are overwritten, the files that failed to copy are reported once the others were copied.
+func ManualCopyWithContext(ctx context.Context, srcStorage aufs.Storage, dstStorage aufs.Storage, srcPath string, dstPath string) error {
+	report, err := CopyTree(ctx, srcStorage, dstStorage, srcPath, dstPath, aufs.CopyOptions{})
 	if err != nil {
 		return err
 	}
 
-	return CreateFile(dstStorage, dstPath, srcFile)
+	return report.Err()
 }
 
 func ManualDelete(storage aufs.Storage, path string) error {
+	return ManualDeleteWithContext(context.Background(), storage, path)
+}
+
+// ManualDeleteWithContext is ManualDelete stopping as soon as ctx is done, leaving what was not deleted yet in place.
+func ManualDeleteWithContext(ctx context.Context, storage aufs.Storage, path string) error {
 	if path == "" || path == "." {
 		return fmt.Errorf("cannot delete root of path")
 	}
 
-	info, err := storage.Stat(path)
+	contextStorage := WithContext(storage)
+	info, err := contextStorage.StatWithContext(ctx, path)
 	if err != nil {
 		return err // TODO file doesnt exist?
 	}
 
-	deleteFn := func(storage aufs.Storage, info aufs.NodeInfo) error {
-		return storage.Delete(info.Path())
+	deleteFn := func(storage aufs.ContextStorage, info aufs.NodeInfo) error {
+		return storage.DeleteWithContext(ctx, info.Path())
 	}
 
-	return walkFs(storage, info, deleteFn)
+	return walkFs(ctx, contextStorage, info, deleteFn)
 }
 
-func walkFs(storage aufs.Storage, info aufs.NodeInfo, operationFunc func(aufs.Storage, aufs.NodeInfo) error) error {
+func walkFs(ctx context.Context, storage aufs.ContextStorage, info aufs.NodeInfo, operationFunc func(aufs.ContextStorage, aufs.NodeInfo) error) error {
 	if info.IsDir() {
-		infos, err := storage.ListDir(info.Path(), false)
+		infos, err := storage.ListDirWithContext(ctx, info.Path(), false)
 		if err != nil {
 			return err
 		}
 		for _, info := range infos {
-			err := walkFs(storage, info, operationFunc)
+			err := walkFs(ctx, storage, info, operationFunc)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	return operationFunc(storage, info)
 }
@@ -0,0 +1,49 @@
+package internal_test
+
+import (
+	"errors"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/faulty"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/storager"
+	"github.com/google/uuid"
+	"go.beyondstorage.io/v5/services"
+	"strings"
+	"testing"
+)
+
+func newMemoryStorage(t *testing.T) aufs.Storage {
+	s, err := services.NewStoragerFromString("memory://")
+	if err != nil {
+		t.Fatalf("failed to create storager, %s", err.Error())
+	}
+
+	return storager.NewStorager(uuid.New().String(), s)
+}
+
+func newAtomicMemoryStorage(t *testing.T) aufs.Storage {
+	s, err := services.NewStoragerFromString("memory://")
+	if err != nil {
+		t.Fatalf("failed to create storager, %s", err.Error())
+	}
+
+	return storager.NewAtomicStorager(uuid.New().String(), s)
+}
+
+func writeFile(t *testing.T, s aufs.Storage, filePath string, content string) {
+	t.Helper()
+	err := internal.CreateFile(s, filePath, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("failed to write '%s', %s", filePath, err.Error())
+	}
+}
+
+func TestCreateFileReturnsCloseError(t *testing.T) {
+	storage := faulty.New("faulty", newMemoryStorage(t))
+	storage.Inject(faulty.Fault{Op: faulty.OpClose, Err: faulty.ErrInjected})
+
+	err := internal.CreateFile(storage, "file.txt", strings.NewReader("content"))
+	if !errors.Is(err, faulty.ErrInjected) {
+		t.Fatalf("create with a failing close returned %v, want the close error", err)
+	}
+}
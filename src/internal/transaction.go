@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	aufs "github.com/aulaga/aufs/src"
+	"os"
+	"sync"
+)
+
+type transactionState int
+
+const (
+	transactionOpen transactionState = iota
+	transactionCommitted
+	transactionDiscarded
+)
+
+// Transaction runs filesystem operations collecting their events, instead of publishing them one by one.
+type Transaction struct {
+	*Filesystem
+	actor     string
+	requestId string
+
+	mu     sync.Mutex
+	events []Event
+	state  transactionState
+}
+
+var _ aufs.Transaction = &Transaction{}
+var _ eventSink = &Transaction{}
+
+func newTransaction(fs *Filesystem, ctx context.Context) *Transaction {
+	return &Transaction{
+		Filesystem: fs,
+		actor:      aufs.ActorFromContext(ctx),
+		requestId:  aufs.RequestIdFromContext(ctx),
+	}
+}
+
+func (t *Transaction) Emit(event Event) {
+	event.Actor = t.actor
+	event.RequestId = t.requestId
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case transactionOpen:
+		t.events = append(t.events, event)
+	case transactionCommitted:
+		t.eventPropagator.PublishEvent(event)
+	}
+}
+
+// Commit publishes the collected events, in the order their operations completed.
+func (t *Transaction) Commit() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state != transactionOpen {
+		return
+	}
+
+	t.state = transactionCommitted
+	t.eventPropagator.Publish(t.events)
+	t.events = nil
+}
+
+// Discard drops the collected events and any event produced through the transaction afterwards.
+func (t *Transaction) Discard() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state != transactionOpen {
+		return
+	}
+
+	t.state = transactionDiscarded
+	t.events = nil
+}
+
+func (t *Transaction) Open(path string) (aufs.File, error) {
+	return t.open(context.Background(), path, os.O_RDWR|os.O_CREATE, t)
+}
+
+func (t *Transaction) OpenFile(path string, flag int) (aufs.File, error) {
+	return t.open(context.Background(), path, flag, t)
+}
+
+func (t *Transaction) OpenFileWithContext(ctx context.Context, path string, flag int) (aufs.File, error) {
+	return t.open(ctx, path, flag, t)
+}
+
+func (t *Transaction) MkDir(path string) (aufs.NodeInfo, error) {
+	return t.mkDir(context.Background(), path, t)
+}
+
+func (t *Transaction) MkDirWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
+	return t.mkDir(ctx, path, t)
+}
+
+func (t *Transaction) Delete(path string) error {
+	return t.delete(context.Background(), path, t)
+}
+
+func (t *Transaction) DeleteWithContext(ctx context.Context, path string) error {
+	return t.delete(ctx, path, t)
+}
+
+func (t *Transaction) Copy(srcPath string, dstPath string) error {
+	return t.copy(context.Background(), srcPath, dstPath, t)
+}
+
+func (t *Transaction) CopyWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	return t.copy(ctx, srcPath, dstPath, t)
+}
+
+func (t *Transaction) CopyWithOptions(ctx context.Context, srcPath string, dstPath string, options aufs.CopyOptions) (*aufs.CopyReport, error) {
+	return t.copyWithOptions(ctx, srcPath, dstPath, options, t)
+}
+
+func (t *Transaction) Move(srcPath string, dstPath string) error {
+	return t.move(context.Background(), srcPath, dstPath, t)
+}
+
+func (t *Transaction) MoveWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	return t.move(ctx, srcPath, dstPath, t)
+}
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	aufs "github.com/aulaga/aufs/src"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+
+// errWalkStopped is returned to the workers of a parallel walk once another one failed.
+var errWalkStopped = errors.New("walk stopped")
+
+func (f *Filesystem) Walk(root string, fn aufs.WalkFunc, options aufs.WalkOptions) error {
+	return f.WalkWithContext(context.Background(), root, fn, options)
+}
+
+// WalkWithContext walks the tree rooted at root. Nodes of a directory are visited by name, storages mounted in a
+// directory are walked as its subdirectories.
+func (f *Filesystem) WalkWithContext(ctx context.Context, root string, fn aufs.WalkFunc, options aufs.WalkOptions) error {
+	root = path.Clean("/" + root)
+	info, err := f.walkRoot(ctx, root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else if options.Parallelism > 1 {
+		err = f.walkParallel(ctx, root, info, fn, options.Parallelism)
+	} else {
+		err = f.walk(ctx, root, info, fn)
+	}
+
+	if err == aufs.SkipDir || err == aufs.SkipAll {
+		return nil
+	}
+
+	return err
+}
+
+// walkRoot stats root. Mount points are directories even when their storage has no node for its root.
+func (f *Filesystem) walkRoot(ctx context.Context, root string) (aufs.NodeInfo, error) {
+	_, relPath := f.MountForPath(root)
+	// Mount roots resolve to ".", the root storage to "/"
+	if path.Clean("/"+relPath) == "/" {
+		return aufs.NewNodeInfo(root, 0, time.Time{}, true, "", ""), nil
+	}
+
+	return f.StatWithContext(ctx, root)
+}
+
+// readDir lists the nodes of dirPath sorted by name.
+func (f *Filesystem) readDir(ctx context.Context, dirPath string) ([]aufs.NodeInfo, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := f.ListWithContext(ctx, dirPath, aufs.ListOptions{Sort: aufs.ListSortByName})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var infos []aufs.NodeInfo
+	for {
+		page, err := iterator.Next()
+		if err == io.EOF {
+			return infos, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, page...)
+	}
+}
+
+func (f *Filesystem) walk(ctx context.Context, nodePath string, info aufs.NodeInfo, fn aufs.WalkFunc) error {
+	err := fn(nodePath, info, nil)
+	if err != nil || !info.IsDir() {
+		return err
+	}
+
+	infos, err := f.readDir(ctx, nodePath)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fn(nodePath, info, err)
+	}
+
+	for _, child := range infos {
+		err = f.walk(ctx, path.Join(nodePath, child.Name()), child, fn)
+		if err == aufs.SkipDir && child.IsDir() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type walkDir struct {
+	path string
+	info aufs.NodeInfo
+}
+
+// parallelWalk lists the directories of a walk with a pool of workers. The worker listing a directory visits its
+// nodes, queuing its subdirectories for the pool.
+type parallelWalk struct {
+	fs  *Filesystem
+	ctx context.Context
+	fn  aufs.WalkFunc
+
+	fnMu sync.Mutex
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []walkDir
+	pending int // directories queued or being visited
+	err     error
+}
+
+func (f *Filesystem) walkParallel(ctx context.Context, root string, info aufs.NodeInfo, fn aufs.WalkFunc, workers int) error {
+	err := fn(root, info, nil)
+	if err != nil || !info.IsDir() {
+		return err
+	}
+
+	w := &parallelWalk{
+		fs:      f,
+		ctx:     ctx,
+		fn:      fn,
+		queue:   []walkDir{{path: root, info: info}},
+		pending: 1,
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+
+	return w.err
+}
+
+func (w *parallelWalk) work() {
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && w.pending > 0 && w.err == nil {
+			w.cond.Wait()
+		}
+		if w.err != nil || w.pending == 0 {
+			w.mu.Unlock()
+			return
+		}
+
+		dir := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		err := w.visit(dir)
+
+		w.mu.Lock()
+		if err != nil && w.err == nil && err != errWalkStopped {
+			w.err = err
+		}
+		w.pending--
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// visit lists dir and calls fn for its nodes, queuing the subdirectories fn does not skip.
+func (w *parallelWalk) visit(dir walkDir) error {
+	infos, err := w.fs.readDir(w.ctx, dir.path)
+	if err != nil {
+		if w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+
+		err = w.call(dir.path, dir.info, err)
+		if err == aufs.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	for _, child := range infos {
+		childPath := path.Join(dir.path, child.Name())
+		err = w.call(childPath, child, nil)
+		switch {
+		case err == aufs.SkipDir && child.IsDir():
+			continue
+		case err == aufs.SkipDir:
+			return nil
+		case err != nil:
+			return err
+		case child.IsDir():
+			w.push(walkDir{path: childPath, info: child})
+		}
+	}
+
+	return nil
+}
+
+func (w *parallelWalk) call(nodePath string, info aufs.NodeInfo, err error) error {
+	w.fnMu.Lock()
+	defer w.fnMu.Unlock()
+
+	w.mu.Lock()
+	stopped := w.err != nil
+	w.mu.Unlock()
+	if stopped {
+		return errWalkStopped
+	}
+
+	return w.fn(nodePath, info, err)
+}
+
+func (w *parallelWalk) push(dir walkDir) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.queue = append(w.queue, dir)
+	w.pending++
+	w.cond.Signal()
+}
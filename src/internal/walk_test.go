@@ -0,0 +1,47 @@
+package internal_test
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"strings"
+	"testing"
+)
+
+func TestWalkFromMountPoint(t *testing.T) {
+	mounted := newMemoryStorage(t)
+	_, err := mounted.MkDir("dir")
+	if err != nil {
+		t.Fatalf("failed to create 'dir', %s", err.Error())
+	}
+	writeFile(t, mounted, "a.txt", "a")
+	writeFile(t, mounted, "dir/b.txt", "b")
+
+	fs, err := internal.NewFilesystem("fs", newMemoryStorage(t), []aufs.Mount{
+		internal.NewMount(mounted, "/mnt", aufs.MountReadWrite),
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to create filesystem, %s", err.Error())
+	}
+
+	for _, parallelism := range []int{1, 4} {
+		var visited []string
+		err = fs.Walk("/mnt", func(path string, info aufs.NodeInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == "/mnt" && (!info.IsDir() || info.Name() != "mnt") {
+				t.Fatalf("mount point walked as %q with dir %t", info.Name(), info.IsDir())
+			}
+			visited = append(visited, path)
+			return nil
+		}, aufs.WalkOptions{Parallelism: parallelism})
+		if err != nil {
+			t.Fatalf("walk with parallelism %d failed, %s", parallelism, err.Error())
+		}
+
+		want := "/mnt /mnt/a.txt /mnt/dir /mnt/dir/b.txt"
+		if strings.Join(visited, " ") != want {
+			t.Fatalf("walk with parallelism %d visited %q, want %q", parallelism, visited, want)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentSize = 16 << 20
+	defaultMaxSize     = 1 << 30
+	segmentExtension   = ".log"
+	// maxCompactInterval bounds the interval of the compactions removing segments past their maximum age
+	maxCompactInterval = 10 * time.Minute
+)
+
+// ErrCompacted is returned when replaying from a sequence number whose events were already compacted away.
+var ErrCompacted = errors.New("journal events were compacted")
+
+type segment struct {
+	path     string
+	firstSeq uint64
+}
+
+// Journal is an append-only event log split in segment files of JSON lines, each named after its first sequence
+// number. Old segments are compacted away when exceeding the configured size or age, on rotation and, with a maximum
+// age, periodically so idle journals expire too. Appends are synced to disk before returning unless the spec sets
+// NoSync.
+type Journal struct {
+	spec aufs.JournalSpec
+
+	mu       sync.Mutex
+	segments []segment // oldest first, the last one is being written
+	active   *os.File
+	size     int64 // size of the active segment
+	lastSeq  uint64
+	stop     chan struct{} // closed by Close to stop the periodic compactions
+}
+
+var _ aufs.EventJournal = &Journal{}
+
+// Open opens the journal in spec.Dir, creating it if needed. A partially written trailing record, left by a crash,
+// is truncated.
+func Open(spec aufs.JournalSpec) (*Journal, error) {
+	if spec.Dir == "" {
+		return nil, fmt.Errorf("journal dir is required")
+	}
+	if spec.SegmentSize <= 0 {
+		spec.SegmentSize = defaultSegmentSize
+	}
+	if spec.MaxSize <= 0 {
+		spec.MaxSize = defaultMaxSize
+	}
+
+	err := os.MkdirAll(spec.Dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal dir '%s', %s", spec.Dir, err.Error())
+	}
+
+	j := &Journal{spec: spec}
+	j.segments, err = listSegments(spec.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(j.segments) == 0 {
+		err = j.rotate()
+		if err != nil {
+			return j, err
+		}
+		j.startCompactions()
+		return j, nil
+	}
+
+	last := j.segments[len(j.segments)-1]
+	j.lastSeq, j.size, err = recoverSegment(last)
+	if err != nil {
+		return nil, err
+	}
+	if j.lastSeq == 0 {
+		j.lastSeq = last.firstSeq - 1
+	}
+
+	j.active, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	j.startCompactions()
+	return j, nil
+}
+
+// startCompactions compacts the journal every half of its maximum age until closed, when it has one.
+func (j *Journal) startCompactions() {
+	if j.spec.MaxAge <= 0 {
+		return
+	}
+
+	interval := j.spec.MaxAge / 2
+	if interval > maxCompactInterval {
+		interval = maxCompactInterval
+	}
+
+	j.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				_ = j.Compact()
+			case <-stop:
+				return
+			}
+		}
+	}(j.stop)
+}
+
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%020d%s", firstSeq, segmentExtension)
+}
+
+func listSegments(dir string) ([]segment, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, path := range paths {
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: path, firstSeq: firstSeq})
+	}
+
+	sort.Slice(segments, func(i, k int) bool {
+		return segments[i].firstSeq < segments[k].firstSeq
+	})
+
+	return segments, nil
+}
+
+// recoverSegment returns the last sequence number and the valid size of s, truncating any incomplete record.
+func recoverSegment(s segment) (uint64, int64, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var lastSeq uint64
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var event aufs.Event
+		if json.Unmarshal(line, &event) != nil {
+			break
+		}
+
+		lastSeq = event.Seq
+		valid += int64(len(line))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.Size() != valid {
+		err = os.Truncate(s.path, valid)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to truncate incomplete journal record, %s", err.Error())
+		}
+	}
+
+	return lastSeq, valid, nil
+}
+
+// rotate starts a new segment for the next sequence number, then compacts old segments.
+func (j *Journal) rotate() error {
+	if j.active != nil {
+		err := j.active.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	s := segment{
+		path:     filepath.Join(j.spec.Dir, segmentName(j.lastSeq+1)),
+		firstSeq: j.lastSeq + 1,
+	}
+
+	active, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	j.active = active
+	j.size = 0
+	j.segments = append(j.segments, s)
+
+	if !j.spec.NoSync {
+		// The new segment must survive a crash along with the events synced into it
+		err = syncDir(j.spec.Dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return j.compact()
+}
+
+// Append writes event to the journal, numbered after the last journaled event. The event is on disk when Append
+// returns, unless the spec sets NoSync.
+func (j *Journal) Append(event aufs.Event) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.active == nil {
+		return 0, fmt.Errorf("journal is closed")
+	}
+
+	event.Seq = j.lastSeq + 1
+	line, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+
+	n, err := j.active.Write(line)
+	if err == nil && !j.spec.NoSync {
+		err = j.active.Sync()
+	}
+	if err != nil {
+		// Do not leave a partial or unsynced record behind for the next append to follow
+		_ = j.active.Truncate(j.size)
+		return 0, err
+	}
+
+	j.size += int64(n)
+	j.lastSeq = event.Seq
+
+	if j.size >= j.spec.SegmentSize {
+		err = j.rotate()
+		if err != nil {
+			return event.Seq, fmt.Errorf("event journaled but failed to rotate segment, %s", err.Error())
+		}
+	}
+
+	return event.Seq, nil
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync journal dir '%s', %s", dir, err.Error())
+	}
+
+	return nil
+}
+
+// LastSeq returns the sequence number of the last journaled event, 0 when empty.
+func (j *Journal) LastSeq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.lastSeq
+}
+
+// Replay delivers the journaled events from fromSeq to the last one journaled when called. It fails with ErrCompacted
+// when events from fromSeq are no longer available, without delivering any.
+func (j *Journal) Replay(fromSeq uint64, handler aufs.EventHandler) error {
+	j.mu.Lock()
+	segments := make([]segment, len(j.segments))
+	copy(segments, j.segments)
+	lastSeq := j.lastSeq
+	j.mu.Unlock()
+
+	if fromSeq == 0 {
+		fromSeq = 1
+	}
+	if fromSeq > lastSeq {
+		return nil
+	}
+	if len(segments) == 0 || fromSeq < segments[0].firstSeq {
+		return fmt.Errorf("cannot replay from %d, %w", fromSeq, ErrCompacted)
+	}
+
+	start := 0
+	for i, s := range segments {
+		if s.firstSeq <= fromSeq {
+			start = i
+		}
+	}
+
+	for _, s := range segments[start:] {
+		done, err := replaySegment(s, fromSeq, lastSeq, handler)
+		if errors.Is(err, os.ErrNotExist) {
+			// Compacted while replaying
+			return fmt.Errorf("cannot replay from %d, %w", fromSeq, ErrCompacted)
+		}
+		if err != nil || done {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func replaySegment(s segment, fromSeq uint64, lastSeq uint64, handler aufs.EventHandler) (bool, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		var event aufs.Event
+		err = json.Unmarshal(bytes.TrimSpace(line), &event)
+		if err != nil {
+			return false, fmt.Errorf("corrupt journal record in '%s', %s", s.path, err.Error())
+		}
+
+		if event.Seq > lastSeq {
+			return true, nil
+		}
+		if event.Seq >= fromSeq {
+			handler.HandleEvent(event)
+		}
+	}
+}
+
+// Compact removes the oldest segments while the journal exceeds its maximum size, or while they are older than its
+// maximum age. The segment being written is never removed.
+func (j *Journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.compact()
+}
+
+func (j *Journal) compact() error {
+	var total int64
+	sizes := make([]int64, len(j.segments))
+	modTimes := make([]time.Time, len(j.segments))
+	for i, s := range j.segments {
+		info, err := os.Stat(s.path)
+		if err != nil {
+			continue
+		}
+		sizes[i] = info.Size()
+		modTimes[i] = info.ModTime()
+		total += sizes[i]
+	}
+
+	removed := 0
+	for i := 0; i < len(j.segments)-1; i++ {
+		tooBig := total > j.spec.MaxSize
+		tooOld := j.spec.MaxAge > 0 && time.Since(modTimes[i]) > j.spec.MaxAge
+		if !tooBig && !tooOld {
+			break
+		}
+
+		err := os.Remove(j.segments[i].path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+
+		total -= sizes[i]
+		removed++
+	}
+
+	j.segments = j.segments[removed:]
+	return nil
+}
+
+// Close closes the segment being written, appending afterwards fails.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.active == nil {
+		return nil
+	}
+
+	if j.stop != nil {
+		close(j.stop)
+		j.stop = nil
+	}
+	err := j.active.Close()
+	j.active = nil
+	return err
+}
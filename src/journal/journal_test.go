@@ -0,0 +1,80 @@
+package journal_test
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/journal"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type collector []aufs.Event
+
+func (c *collector) HandleEvent(event aufs.Event) {
+	*c = append(*c, event)
+}
+
+func TestReopenReplaysAppends(t *testing.T) {
+	for _, noSync := range []bool{false, true} {
+		spec := aufs.JournalSpec{Dir: t.TempDir(), SegmentSize: 200, NoSync: noSync}
+		j, err := journal.Open(spec)
+		if err != nil {
+			t.Fatalf("failed to open journal, %s", err.Error())
+		}
+
+		for i := 0; i < 10; i++ {
+			_, err = j.Append(aufs.Event{Kind: aufs.EventCreated, Path: "/a.txt"})
+			if err != nil {
+				t.Fatalf("failed to append, %s", err.Error())
+			}
+		}
+		err = j.Close()
+		if err != nil {
+			t.Fatalf("failed to close journal, %s", err.Error())
+		}
+
+		j, err = journal.Open(spec)
+		if err != nil {
+			t.Fatalf("failed to reopen journal, %s", err.Error())
+		}
+		events := &collector{}
+		err = j.Replay(1, events)
+		if err != nil {
+			t.Fatalf("failed to replay, %s", err.Error())
+		}
+		if len(*events) != 10 || (*events)[9].Seq != 10 {
+			t.Fatalf("replay with NoSync %t delivered %d events, want 10", noSync, len(*events))
+		}
+		_ = j.Close()
+	}
+}
+
+func TestIdleJournalCompactedByAge(t *testing.T) {
+	spec := aufs.JournalSpec{Dir: t.TempDir(), SegmentSize: 100, MaxAge: 200 * time.Millisecond, NoSync: true}
+	j, err := journal.Open(spec)
+	if err != nil {
+		t.Fatalf("failed to open journal, %s", err.Error())
+	}
+	defer j.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err = j.Append(aufs.Event{Kind: aufs.EventCreated, Path: "/a.txt"})
+		if err != nil {
+			t.Fatalf("failed to append, %s", err.Error())
+		}
+	}
+	segments, _ := filepath.Glob(filepath.Join(spec.Dir, "*.log"))
+	if len(segments) < 2 {
+		t.Fatalf("appends wrote %d segments, want several", len(segments))
+	}
+
+	// No append rotates the journal anymore, the old segments still expire
+	deadline := time.Now().Add(5 * time.Second)
+	for len(segments) > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		segments, _ = filepath.Glob(filepath.Join(spec.Dir, "*.log"))
+	}
+	if len(segments) != 1 {
+		t.Fatalf("idle journal kept %d segments past their maximum age", len(segments))
+	}
+}
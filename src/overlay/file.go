@@ -0,0 +1,194 @@
+package overlay
+
+import (
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"io/fs"
+	"os"
+)
+
+// file reads from the topmost layer holding the path and writes to the upper layer, both opened lazily.
+type file struct {
+	overlay       *Storage
+	path          string
+	flag          int
+	exists        bool // when opened
+	createOnClose bool
+
+	reader    aufs.File
+	writer    aufs.File
+	dirReader *internal.DirReader
+}
+
+var _ aufs.File = &file{}
+
+func (f *file) Path() string {
+	return f.path
+}
+
+func (f *file) Storage() aufs.Storage {
+	return f.overlay
+}
+
+func (f *file) openReader() (aufs.File, error) {
+	if f.reader != nil {
+		return f.reader, nil
+	}
+	if !internal.IsReadable(f.flag) {
+		return nil, internal.HandleModeError("read", f.path)
+	}
+
+	layer, _, err := f.overlay.resolve(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := layer.OpenFile(f.path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+
+	f.reader = reader
+	return reader, nil
+}
+
+func (f *file) openWriter() (aufs.File, error) {
+	if f.writer != nil {
+		return f.writer, nil
+	}
+	if !internal.IsWritable(f.flag) {
+		return nil, internal.HandleModeError("write", f.path)
+	}
+
+	err := f.overlay.prepareWrite(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if f.exists && f.flag&os.O_APPEND != 0 {
+		err = f.copyUp()
+		if err != nil {
+			return nil, err
+		}
+		flag = os.O_WRONLY | os.O_APPEND
+	}
+
+	writer, err := f.overlay.upper.OpenFile(f.path, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	f.writer = writer
+	return writer, nil
+}
+
+// copyUp copies the file from the lower layer holding it to the upper layer, so it can be appended to.
+func (f *file) copyUp() error {
+	layer, _, err := f.overlay.resolve(f.path)
+	if err != nil || layer == f.overlay.upper {
+		return err
+	}
+
+	return internal.ManualCopyWithContext(f.overlay.context(), layer, f.overlay.upper, f.path, f.path)
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	reader, err := f.openReader()
+	if err != nil {
+		return 0, err
+	}
+
+	return reader.Read(p)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	reader, err := f.openReader()
+	if err != nil {
+		return 0, err
+	}
+
+	return reader.Seek(offset, whence)
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	writer, err := f.openWriter()
+	if err != nil {
+		return 0, err
+	}
+
+	return writer.Write(p)
+}
+
+func (f *file) Readdir(count int) ([]fs.FileInfo, error) {
+	if f.dirReader == nil {
+		f.dirReader = internal.NewDirReader(func() (aufs.NodeIterator, error) {
+			return internal.List(f.overlay.context(), f.overlay, f.path, aufs.ListOptions{})
+		})
+	}
+
+	return f.dirReader.Readdir(count)
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	if f.writer != nil {
+		return f.writer.Stat()
+	}
+
+	return f.overlay.Stat(f.path)
+}
+
+// Abort discards the writes to the upper layer, when its file can discard them.
+func (f *file) Abort() error {
+	if f.writer != nil {
+		aborter, ok := f.writer.(aufs.Aborter)
+		if !ok {
+			return aufs.NewError(aufs.NotSupported, "abort", f.path, nil)
+		}
+
+		err := aborter.Abort()
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.dirReader != nil {
+		_ = f.dirReader.Close()
+	}
+	if f.reader != nil {
+		return f.reader.Close()
+	}
+
+	return nil
+}
+
+func (f *file) Close() error {
+	if f.createOnClose && f.writer == nil {
+		_, err := f.openWriter()
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.dirReader != nil {
+		_ = f.dirReader.Close()
+	}
+
+	var writerErr, readerErr error
+	if f.writer != nil {
+		writerErr = f.writer.Close()
+	}
+	if f.reader != nil {
+		readerErr = f.reader.Close()
+	}
+
+	if writerErr != nil {
+		return writerErr
+	}
+	if readerErr != nil {
+		return fmt.Errorf("failed closing overlay reader of '%s', %s", f.path, readerErr.Error())
+	}
+
+	return nil
+}
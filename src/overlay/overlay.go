@@ -0,0 +1,508 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// whiteoutPrefix marks a file in the upper layer hiding the lower entry with the same name.
+	whiteoutPrefix = ".wh."
+	// opaqueMarker inside an upper directory hides the content of the same directory in the lower layers.
+	opaqueMarker = ".wh..wh..opq"
+)
+
+// Storage layers a writable upper storage over read-only lower storages. Reads fall through the layers, writes go to
+// the upper layer and deletes of lower entries are recorded as whiteouts in the upper layer.
+type Storage struct {
+	id     string
+	upper  aufs.Storage
+	lowers []aufs.Storage
+
+	// ctx is set on views of an overlay whose layers are bound to it, see withContext
+	ctx     context.Context
+	unbound *Storage
+}
+
+var _ aufs.ContextStorage = &Storage{}
+
+// New returns an overlay of upper over lowers, lowers are given from the topmost to the bottommost layer.
+func New(id string, upper aufs.Storage, lowers ...aufs.Storage) aufs.Storage {
+	return &Storage{
+		id:     id,
+		upper:  upper,
+		lowers: lowers,
+	}
+}
+
+func (s *Storage) Id() string {
+	return s.id
+}
+
+// withContext returns a view of the overlay whose layers run their operations with ctx.
+func (s *Storage) withContext(ctx context.Context) *Storage {
+	if s.unbound != nil {
+		s = s.unbound
+	}
+
+	lowers := make([]aufs.Storage, len(s.lowers))
+	for i, lower := range s.lowers {
+		lowers[i] = internal.Bind(ctx, lower)
+	}
+
+	return &Storage{
+		id:      s.id,
+		upper:   internal.Bind(ctx, s.upper),
+		lowers:  lowers,
+		ctx:     ctx,
+		unbound: s,
+	}
+}
+
+func (s *Storage) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+
+	return s.ctx
+}
+
+func (s *Storage) OpenFileWithContext(ctx context.Context, path string, flag int) (aufs.File, error) {
+	return s.withContext(ctx).OpenFile(path, flag)
+}
+
+func (s *Storage) StatWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
+	return s.withContext(ctx).Stat(path)
+}
+
+func (s *Storage) DeleteWithContext(ctx context.Context, path string) error {
+	return s.withContext(ctx).Delete(path)
+}
+
+func (s *Storage) CopyWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	return s.withContext(ctx).Copy(srcPath, dstPath)
+}
+
+func (s *Storage) MoveWithContext(ctx context.Context, srcPath string, dstPath string) error {
+	return s.withContext(ctx).Move(srcPath, dstPath)
+}
+
+func (s *Storage) ListDirWithContext(ctx context.Context, path string, recursive bool) ([]aufs.NodeInfo, error) {
+	return s.withContext(ctx).ListDir(path, recursive)
+}
+
+func (s *Storage) MkDirWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
+	return s.withContext(ctx).MkDir(path)
+}
+
+func cleanPath(path string) string {
+	return strings.Trim(filepath.Clean("/"+path), "/")
+}
+
+// parentPath returns the parent of a cleaned path, the root being "".
+func parentPath(path string) string {
+	parent := filepath.Dir(path)
+	if parent == "." {
+		return ""
+	}
+
+	return parent
+}
+
+func whiteoutPath(path string) string {
+	return filepath.Join(parentPath(path), whiteoutPrefix+filepath.Base(path))
+}
+
+func isMarker(info aufs.NodeInfo) bool {
+	return strings.HasPrefix(info.Name(), whiteoutPrefix)
+}
+
+// isMarkerPath tells whether path names a whiteout or an opaque marker, which the overlay never exposes.
+func isMarkerPath(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), whiteoutPrefix)
+}
+
+// checkName fails when path cannot be created through the overlay because its name is reserved for markers.
+func checkName(op string, path string) error {
+	if isMarkerPath(path) {
+		return aufs.NewError(aufs.PermissionDenied, op, path, fmt.Errorf("names starting with '%s' are reserved by the overlay", whiteoutPrefix))
+	}
+
+	return nil
+}
+
+func notExist(op string, path string) error {
+	return aufs.NewError(aufs.NotFound, op, path, nil)
+}
+
+func (s *Storage) existsInUpper(path string) bool {
+	_, err := s.upper.Stat(path)
+	return err == nil
+}
+
+// hiddenInLowers tells whether the lower layers are hidden at path, either by a whiteout of the path or one of its
+// ancestors, or by an opaque ancestor directory. The markers of every ancestor are found in a single listing of its
+// upper directory, and the walk stops at the first ancestor missing from the upper layer, which cannot hold markers.
+func (s *Storage) hiddenInLowers(path string) bool {
+	if path == "" {
+		return false
+	}
+
+	dir := ""
+	for i, name := range strings.Split(path, "/") {
+		infos, err := s.upper.ListDir(dir, false)
+		if err != nil {
+			return false
+		}
+
+		inUpper := false
+		for _, info := range infos {
+			switch info.Name() {
+			case whiteoutPrefix + name:
+				return true
+			case opaqueMarker:
+				// The root is never hidden by an opaque marker
+				if i > 0 {
+					return true
+				}
+			case name:
+				inUpper = info.IsDir()
+			}
+		}
+		if !inUpper {
+			return false
+		}
+
+		dir = filepath.Join(dir, name)
+	}
+
+	return false
+}
+
+// resolve returns the topmost layer holding path and the info of path in that layer.
+func (s *Storage) resolve(path string) (aufs.Storage, aufs.NodeInfo, error) {
+	if isMarkerPath(path) {
+		return nil, nil, notExist("stat", path)
+	}
+
+	info, err := s.upper.Stat(path)
+	if err == nil {
+		return s.upper, info, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	if s.hiddenInLowers(path) {
+		return nil, nil, notExist("stat", path)
+	}
+
+	for _, lower := range s.lowers {
+		info, err := lower.Stat(path)
+		if err == nil {
+			return lower, info, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+
+	return nil, nil, notExist("stat", path)
+}
+
+// inLowers tells whether path is visible from any of the lower layers.
+func (s *Storage) inLowers(path string) bool {
+	if s.hiddenInLowers(path) {
+		return false
+	}
+
+	for _, lower := range s.lowers {
+		if _, err := lower.Stat(path); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prepareWrite copies up the parent directories of path to the upper layer and drops a whiteout of path, if any.
+func (s *Storage) prepareWrite(path string) error {
+	parent := parentPath(path)
+	if parent != "" && !s.existsInUpper(parent) {
+		err := s.prepareWrite(parent)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.upper.MkDir(parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	whiteout := whiteoutPath(path)
+	if s.existsInUpper(whiteout) {
+		return s.upper.Delete(whiteout)
+	}
+
+	return nil
+}
+
+func (s *Storage) writeMarker(path string) error {
+	return internal.CreateFileWithContext(s.context(), s.upper, path, bytes.NewBufferString("aufs overlay marker\n"))
+}
+
+func (s *Storage) Open(path string) (aufs.File, error) {
+	return s.OpenFile(path, os.O_RDWR|os.O_CREATE)
+}
+
+func (s *Storage) OpenFile(path string, flag int) (aufs.File, error) {
+	path = cleanPath(path)
+	exists, err := internal.CheckOpenFlags(s, path, flag)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = checkName("open", path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &file{
+		overlay:       s,
+		path:          path,
+		flag:          flag,
+		exists:        exists,
+		createOnClose: internal.CreatesOnClose(flag, exists),
+	}, nil
+}
+
+func (s *Storage) Stat(path string) (aufs.NodeInfo, error) {
+	_, info, err := s.resolve(cleanPath(path))
+	return info, err
+}
+
+func (s *Storage) Delete(path string) error {
+	path = cleanPath(path)
+	if path == "" {
+		return fmt.Errorf("cannot delete root of overlay")
+	}
+
+	_, info, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	if s.existsInUpper(path) {
+		if info.IsDir() {
+			err = s.deleteMarkers(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.upper.Delete(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !s.inLowers(path) {
+		return nil
+	}
+
+	err = s.prepareWrite(path)
+	if err != nil {
+		return err
+	}
+
+	return s.writeMarker(whiteoutPath(path))
+}
+
+// deleteMarkers removes the whiteouts and opaque marker held by an upper directory, so it can be deleted.
+func (s *Storage) deleteMarkers(path string) error {
+	infos, err := s.upper.ListDir(path, false)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !isMarker(info) {
+			continue
+		}
+
+		err := s.upper.Delete(filepath.Join(path, info.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) Copy(srcPath string, dstPath string) error {
+	srcPath, dstPath = cleanPath(srcPath), cleanPath(dstPath)
+	err := checkName("copy", dstPath)
+	if err != nil {
+		return err
+	}
+
+	layer, info, err := s.resolve(srcPath)
+	if err != nil {
+		return err
+	}
+
+	// Directories go through the overlay so the content of every layer is merged into the copy
+	if layer != s.upper || info.IsDir() {
+		return internal.ManualCopyWithContext(s.context(), s, s, srcPath, dstPath)
+	}
+
+	err = s.prepareWrite(dstPath)
+	if err != nil {
+		return err
+	}
+
+	return s.upper.Copy(srcPath, dstPath)
+}
+
+func (s *Storage) Move(srcPath string, dstPath string) error {
+	srcPath, dstPath = cleanPath(srcPath), cleanPath(dstPath)
+	err := checkName("move", dstPath)
+	if err != nil {
+		return err
+	}
+
+	layer, _, err := s.resolve(srcPath)
+	if err != nil {
+		return err
+	}
+
+	if layer == s.upper && !s.inLowers(srcPath) {
+		err = s.prepareWrite(dstPath)
+		if err != nil {
+			return err
+		}
+
+		return s.upper.Move(srcPath, dstPath)
+	}
+
+	err = s.Copy(srcPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	return internal.ManualDeleteWithContext(s.context(), s, srcPath)
+}
+
+func (s *Storage) ListDir(path string, recursive bool) ([]aufs.NodeInfo, error) {
+	path = cleanPath(path)
+	_, info, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("cannot list '%s', not a directory", path)
+	}
+
+	seen := map[string]bool{}
+	var hidden []string
+	var infos []aufs.NodeInfo
+	opaque := false
+
+	if s.existsInUpper(path) {
+		upperInfos, err := s.upper.ListDir(path, recursive)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range upperInfos {
+			infoPath := cleanPath(info.Path())
+			switch {
+			case info.Name() == opaqueMarker && parentPath(infoPath) == path:
+				opaque = true
+			case info.Name() == opaqueMarker:
+				hidden = append(hidden, parentPath(infoPath))
+			case isMarker(info):
+				hidden = append(hidden, filepath.Join(parentPath(infoPath), strings.TrimPrefix(info.Name(), whiteoutPrefix)))
+			default:
+				seen[infoPath] = true
+				infos = append(infos, info)
+			}
+		}
+	}
+
+	if opaque || s.hiddenInLowers(path) {
+		return infos, nil
+	}
+
+	isHidden := func(infoPath string) bool {
+		for _, h := range hidden {
+			if infoPath == h || strings.HasPrefix(infoPath, h+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, lower := range s.lowers {
+		if info, err := lower.Stat(path); err != nil || !info.IsDir() {
+			continue
+		}
+
+		lowerInfos, err := lower.ListDir(path, recursive)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range lowerInfos {
+			infoPath := cleanPath(info.Path())
+			if seen[infoPath] || isHidden(infoPath) {
+				continue
+			}
+
+			seen[infoPath] = true
+			infos = append(infos, info)
+		}
+	}
+
+	return infos, nil
+}
+
+func (s *Storage) MkDir(path string) (aufs.NodeInfo, error) {
+	path = cleanPath(path)
+	err := checkName("mkdir", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// A directory recreated over a whiteout must not expose the content it had in the lower layers
+	opaque := s.existsInUpper(whiteoutPath(path))
+
+	err = s.prepareWrite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.upper.MkDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if opaque {
+		err = s.writeMarker(filepath.Join(path, opaqueMarker))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
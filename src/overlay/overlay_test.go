@@ -0,0 +1,109 @@
+package overlay_test
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/overlay"
+	"github.com/aulaga/aufs/src/storager"
+	"github.com/google/uuid"
+	"go.beyondstorage.io/v5/services"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newMemoryStorage(t *testing.T) aufs.Storage {
+	s, err := services.NewStoragerFromString("memory://")
+	if err != nil {
+		t.Fatalf("failed to create storager, %s", err.Error())
+	}
+
+	return storager.NewStorager(uuid.New().String(), s)
+}
+
+// newOverlay returns an overlay over a lower layer holding "dir/a.txt", "dir/sub/b.txt" and "c.txt", where
+// "dir/a.txt" and "c.txt" were deleted.
+func newOverlay(t *testing.T) aufs.Storage {
+	lower := newMemoryStorage(t)
+	for _, filePath := range []string{"dir/a.txt", "dir/sub/b.txt", "c.txt"} {
+		err := internal.CreateFile(lower, filePath, strings.NewReader("lower"))
+		if err != nil {
+			t.Fatalf("failed to write '%s', %s", filePath, err.Error())
+		}
+	}
+
+	s := overlay.New("overlay", newMemoryStorage(t), lower)
+	for _, filePath := range []string{"dir/a.txt", "c.txt"} {
+		err := s.Delete(filePath)
+		if err != nil {
+			t.Fatalf("failed to delete '%s', %s", filePath, err.Error())
+		}
+	}
+
+	return s
+}
+
+func TestWhiteoutsHidden(t *testing.T) {
+	s := newOverlay(t)
+
+	for _, filePath := range []string{"dir/a.txt", "c.txt", "dir/.wh.a.txt", ".wh.c.txt"} {
+		_, err := s.Stat(filePath)
+		if aufs.CodeOf(err) != aufs.NotFound {
+			t.Fatalf("stat of '%s' returned %v, want a NotFound error", filePath, err)
+		}
+
+		_, err = s.OpenFile(filePath, os.O_RDONLY)
+		if aufs.CodeOf(err) != aufs.NotFound {
+			t.Fatalf("open of '%s' returned %v, want a NotFound error", filePath, err)
+		}
+	}
+
+	infos, err := s.ListDir("dir", false)
+	if err != nil {
+		t.Fatalf("failed to list 'dir', %s", err.Error())
+	}
+	if len(infos) != 1 || infos[0].Name() != "sub" {
+		t.Fatalf("'dir' lists %d entries, want only 'sub'", len(infos))
+	}
+}
+
+func TestMarkerNamesReserved(t *testing.T) {
+	s := newOverlay(t)
+
+	_, err := s.OpenFile("dir/.wh.sub", os.O_WRONLY|os.O_CREATE)
+	if aufs.CodeOf(err) != aufs.PermissionDenied {
+		t.Fatalf("creating a whiteout returned %v, want a PermissionDenied error", err)
+	}
+
+	_, err = s.MkDir("dir/.wh..wh..opq")
+	if aufs.CodeOf(err) != aufs.PermissionDenied {
+		t.Fatalf("creating an opaque marker returned %v, want a PermissionDenied error", err)
+	}
+
+	_, err = s.Stat("dir/sub/b.txt")
+	if err != nil {
+		t.Fatalf("stat of 'dir/sub/b.txt' failed, %s", err.Error())
+	}
+}
+
+func TestDeletedDirectoryHidesLowerContent(t *testing.T) {
+	s := newOverlay(t)
+
+	err := s.Delete("dir")
+	if err != nil {
+		t.Fatalf("failed to delete 'dir', %s", err.Error())
+	}
+	_, err = s.Stat("dir/sub/b.txt")
+	if aufs.CodeOf(err) != aufs.NotFound {
+		t.Fatalf("stat below a deleted directory returned %v, want a NotFound error", err)
+	}
+
+	_, err = s.MkDir("dir")
+	if err != nil {
+		t.Fatalf("failed to recreate 'dir', %s", err.Error())
+	}
+	_, err = s.Stat("dir/sub")
+	if aufs.CodeOf(err) != aufs.NotFound {
+		t.Fatalf("stat in a recreated directory returned %v, want a NotFound error", err)
+	}
+}
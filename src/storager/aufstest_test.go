@@ -0,0 +1,18 @@
+package storager_test
+
+import (
+	"github.com/aulaga/aufs/src/aufstest"
+	"testing"
+)
+
+func TestFsStorager(t *testing.T) {
+	aufstest.Run(t, aufstest.StoragerFactory(func(t *testing.T) string {
+		return "fs://" + t.TempDir()
+	}))
+}
+
+func TestMemoryStorager(t *testing.T) {
+	aufstest.Run(t, aufstest.StoragerFactory(func(t *testing.T) string {
+		return "memory://"
+	}))
+}
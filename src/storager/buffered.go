@@ -0,0 +1,265 @@
+package storager
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"go.beyondstorage.io/v5/pairs"
+	"go.beyondstorage.io/v5/types"
+	"io"
+	"sync"
+)
+
+const (
+	defaultBlockSize   = 1 << 20
+	defaultReadAhead   = 4
+	defaultCacheBlocks = 16
+)
+
+// ReaderOptions configure how files are read from a StoragerWrapper.
+type ReaderOptions struct {
+	// BlockSize is the size of the blocks read from the storage, 1MiB when not set.
+	BlockSize int64
+	// ReadAhead is the number of blocks fetched in the background ahead of sequential reads, 4 when not set and none
+	// when negative.
+	ReadAhead int
+	// CacheBlocks is the number of blocks kept for random access, 16 when not set. It is raised to hold at least the
+	// blocks read ahead.
+	CacheBlocks int
+}
+
+type block struct {
+	index int64
+	data  []byte
+	err   error
+	done  chan struct{}
+	elem  *list.Element
+}
+
+// bufferedReader reads a file a block at a time, keeping the most recently used blocks in a cache and fetching the
+// next blocks in the background while the file is read sequentially. Each block fetched is revalidated with a stat.
+type bufferedReader struct {
+	*defaultReader
+	cancel  context.CancelFunc
+	options ReaderOptions
+
+	mu        sync.Mutex
+	blocks    map[int64]*block
+	lru       *list.List // cached blocks, most recently used first
+	lastBlock int64
+}
+
+func newBufferedReader(ctx context.Context, storager types.Storager, path string, options ReaderOptions) Reader {
+	if options.BlockSize <= 0 {
+		options.BlockSize = defaultBlockSize
+	}
+	if options.ReadAhead == 0 {
+		options.ReadAhead = defaultReadAhead
+	}
+	if options.ReadAhead < 0 {
+		options.ReadAhead = 0
+	}
+	if options.CacheBlocks <= 0 {
+		options.CacheBlocks = defaultCacheBlocks
+	}
+	if options.CacheBlocks <= options.ReadAhead {
+		options.CacheBlocks = options.ReadAhead + 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &bufferedReader{
+		defaultReader: &defaultReader{
+			ctx:      ctx,
+			storager: storager,
+			path:     path,
+		},
+		cancel:    cancel,
+		options:   options,
+		blocks:    map[int64]*block{},
+		lru:       list.New(),
+		lastBlock: -1,
+	}
+}
+
+// objectSize returns the size of the file, stated once for the concurrent ReadAt calls.
+func (f *bufferedReader) objectSize() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.Size()
+}
+
+// Close stops the blocks being fetched in the background.
+func (f *bufferedReader) Close() error {
+	f.cancel()
+	return nil
+}
+
+func (f *bufferedReader) Read(p []byte) (int, error) {
+	n, err := f.readAt(p, f.offset, true)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// ReadAt reads len(p) bytes at off, without changing the offset of Read.
+func (f *bufferedReader) ReadAt(p []byte, off int64) (int, error) {
+	return f.readAt(p, off, false)
+}
+
+func (f *bufferedReader) readAt(p []byte, off int64, sequential bool) (int, error) {
+	size, err := f.objectSize()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(p) {
+		if off >= size {
+			return n, io.EOF
+		}
+
+		index := off / f.options.BlockSize
+		b, err := f.block(index, sequential)
+		if err != nil {
+			return n, err
+		}
+
+		start := off - index*f.options.BlockSize
+		if start >= int64(len(b.data)) {
+			return n, io.ErrUnexpectedEOF
+		}
+
+		copied := copy(p[n:], b.data[start:])
+		n += copied
+		off += int64(copied)
+	}
+
+	return n, nil
+}
+
+// WriteTo writes the file from the offset of Read to w, reading ahead as it goes.
+func (f *bufferedReader) WriteTo(w io.Writer) (int64, error) {
+	size, err := f.objectSize()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for f.offset < size {
+		index := f.offset / f.options.BlockSize
+		b, err := f.block(index, true)
+		if err != nil {
+			return total, err
+		}
+
+		start := f.offset - index*f.options.BlockSize
+		if start >= int64(len(b.data)) {
+			return total, io.ErrUnexpectedEOF
+		}
+
+		n, err := w.Write(b.data[start:])
+		total += int64(n)
+		f.offset += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// block returns the block at index, fetching it if not cached. Sequential reads trigger fetching the next blocks.
+func (f *bufferedReader) block(index int64, sequential bool) (*block, error) {
+	f.mu.Lock()
+	b := f.fetch(index)
+	if sequential {
+		if index == f.lastBlock || index == f.lastBlock+1 {
+			for i := index + 1; i <= index+int64(f.options.ReadAhead) && i*f.options.BlockSize < *f.size; i++ {
+				f.fetch(i)
+			}
+		}
+		f.lastBlock = index
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-f.ctx.Done():
+		return nil, f.ctx.Err()
+	}
+
+	if b.err != nil {
+		// Failed blocks are not cached, they are fetched again by the next read
+		f.mu.Lock()
+		f.evict(b)
+		f.mu.Unlock()
+		return nil, b.err
+	}
+
+	return b, nil
+}
+
+// fetch returns the block at index, marking it as the most recently used, and starts fetching it when not cached. It
+// must be called with the lock held.
+func (f *bufferedReader) fetch(index int64) *block {
+	b, ok := f.blocks[index]
+	if ok {
+		f.lru.MoveToFront(b.elem)
+		return b
+	}
+
+	b = &block{index: index, done: make(chan struct{})}
+	b.elem = f.lru.PushFront(b)
+	f.blocks[index] = b
+	for f.lru.Len() > f.options.CacheBlocks {
+		f.evict(f.lru.Back().Value.(*block))
+	}
+
+	size := *f.size
+	start := index * f.options.BlockSize
+	length := f.options.BlockSize
+	if start+length > size {
+		length = size - start
+	}
+
+	if length <= 0 {
+		close(b.done)
+		return b
+	}
+
+	go func() {
+		defer close(b.done)
+
+		var buf bytes.Buffer
+		buf.Grow(int(length))
+		_, err := f.storager.ReadWithContext(f.ctx, f.path, &buf, pairs.WithOffset(start), pairs.WithSize(length))
+		if err != nil {
+			b.err = wrapError("read", f.path, err)
+			return
+		}
+
+		// Blocks are only served when the object did not change since it was stated, an object replaced or grown
+		// under the reader returns full blocks of another content
+		b.err = f.revalidate()
+		if b.err != nil {
+			return
+		}
+
+		b.data = buf.Bytes()
+	}()
+
+	return b
+}
+
+func (f *bufferedReader) evict(b *block) {
+	if f.blocks[b.index] != b {
+		return
+	}
+
+	delete(f.blocks, b.index)
+	f.lru.Remove(b.elem)
+}
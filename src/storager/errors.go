@@ -0,0 +1,28 @@
+package storager
+
+import (
+	"errors"
+	aufs "github.com/aulaga/aufs/src"
+	"go.beyondstorage.io/v5/services"
+	"net"
+)
+
+// wrapError classifies the errors returned by beyondstorage services, see aufs.Error.
+func wrapError(op string, path string, err error) error {
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, services.ErrObjectNotExist):
+		return aufs.NewError(aufs.NotFound, op, path, err)
+	case errors.Is(err, services.ErrPermissionDenied):
+		return aufs.NewError(aufs.PermissionDenied, op, path, err)
+	case errors.Is(err, services.ErrCapabilityInsufficient):
+		return aufs.NewError(aufs.NotSupported, op, path, err)
+	case errors.Is(err, services.ErrServiceInternal), errors.Is(err, services.ErrRequestThrottled), errors.As(err, &netErr):
+		return aufs.NewError(aufs.StorageUnavailable, op, path, err)
+	}
+
+	return aufs.WrapError(op, path, err)
+}
@@ -1,8 +1,13 @@
 package storager
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
 	"github.com/aulaga/aufs/src/storager/writers"
+	"io"
 	"io/fs"
 )
 
@@ -13,66 +18,138 @@ type File interface {
 	aufs.File
 }
 
+// FileReadWriter is a handle opened by StoragerWrapper.OpenFile, its writer is nil when opened read-only and its reader
+// is nil when opened write-only.
 type FileReadWriter struct {
+	ctx    context.Context
 	writer writers.Writer
 	reader Reader
 
-	storager *StoragerWrapper
-	path     string
+	storager      *StoragerWrapper
+	path          string
+	createOnClose bool // the open flags create or truncate the file
+	written       bool
+	dirReader     *internal.DirReader
 }
 
-func (f FileReadWriter) Readdir(count int) ([]fs.FileInfo, error) {
-	infos, err := f.storager.ListDir(f.Path(), false)
-	if err != nil {
-		return nil, err
+func (f *FileReadWriter) Readdir(count int) ([]fs.FileInfo, error) {
+	if f.dirReader == nil {
+		f.dirReader = internal.NewDirReader(func() (aufs.NodeIterator, error) {
+			return f.storager.ListWithContext(f.ctx, f.path, aufs.ListOptions{})
+		})
 	}
 
-	if count <= 0 || count > len(infos) {
-		count = len(infos)
+	return f.dirReader.Readdir(count)
+}
+
+func (f *FileReadWriter) Stat() (fs.FileInfo, error) {
+	// If writer offers stat we use that (helpful when file is recently written and may not be available from storager yet)
+	if f.writer != nil {
+		info, err := f.writer.Stat()
+		if err == nil {
+			return info, nil
+		}
 	}
 
-	fsInfos := make([]fs.FileInfo, count)
-	for i := 0; i < count; i++ {
-		fsInfos[i] = infos[i]
+	return f.storager.StatWithContext(f.ctx, f.path)
+}
+
+func (f *FileReadWriter) Write(bytes []byte) (int, error) {
+	if f.writer == nil {
+		return 0, internal.HandleModeError("write", f.path)
 	}
 
-	return fsInfos, nil
+	f.written = true
+	n, err := f.writer.Write(bytes)
+	return n, wrapError("write", f.path, err)
 }
 
-func (f FileReadWriter) Stat() (fs.FileInfo, error) {
-	// If writer offers stat we use that (helpful when file is recently written and may not be available from storager yet)
-	info, err := f.writer.Stat()
-	if err == nil {
-		return info, nil
+func (f *FileReadWriter) Read(bytes []byte) (int, error) {
+	if f.reader == nil {
+		return 0, internal.HandleModeError("read", f.path)
+	}
+
+	n, err := f.reader.Read(bytes)
+	if err == io.EOF {
+		return n, err
 	}
 
-	return f.storager.Stat(f.path)
+	return n, wrapError("read", f.path, err)
 }
 
-func (f FileReadWriter) Write(bytes []byte) (int, error) {
-	return f.writer.Write(bytes)
+func (f *FileReadWriter) ReadAt(p []byte, off int64) (int, error) {
+	readerAt, ok := f.reader.(io.ReaderAt)
+	if !ok {
+		return 0, internal.HandleModeError("read", f.path)
+	}
+
+	return readerAt.ReadAt(p, off)
 }
 
-func (f FileReadWriter) Read(bytes []byte) (int, error) {
-	return f.reader.Read(bytes)
+func (f *FileReadWriter) WriteTo(w io.Writer) (int64, error) {
+	writerTo, ok := f.reader.(io.WriterTo)
+	if !ok {
+		return 0, internal.HandleModeError("read", f.path)
+	}
+
+	return writerTo.WriteTo(w)
 }
 
-func (f FileReadWriter) Seek(offset int64, whence int) (int64, error) {
+func (f *FileReadWriter) Seek(offset int64, whence int) (int64, error) {
+	if f.reader == nil {
+		return 0, internal.HandleModeError("seek", f.path)
+	}
+
 	return f.reader.Seek(offset, whence)
 }
 
-func (f FileReadWriter) Path() string {
+func (f *FileReadWriter) Path() string {
 	return f.path
 }
 
-func (f FileReadWriter) Storage() aufs.Storage {
+func (f *FileReadWriter) Storage() aufs.Storage {
 	return f.storager
 }
 
-func (f FileReadWriter) Close() error {
-	err := f.writer.Close()
-	if err != nil {
-		return err
+func (f *FileReadWriter) Close() error {
+	if f.writer != nil {
+		err := f.writer.Close()
+		if err != nil {
+			return wrapError("write", f.path, err)
+		}
+	}
+
+	if f.createOnClose && !f.written {
+		_, err := f.storager.storager.WriteWithContext(f.ctx, f.path, bytes.NewReader(nil), 0)
+		if err != nil {
+			return wrapError("write", f.path, err)
+		}
+	}
+
+	return f.closeReaders()
+}
+
+// Abort closes the file without writing anything, which appenders writing in place cannot do.
+func (f *FileReadWriter) Abort() error {
+	if f.writer != nil {
+		aborter, ok := f.writer.(writers.Aborter)
+		if !ok {
+			return aufs.NewError(aufs.NotSupported, "abort", f.path, fmt.Errorf("writer cannot discard writes"))
+		}
+
+		aborter.Abort()
+	}
+
+	return f.closeReaders()
+}
+
+func (f *FileReadWriter) closeReaders() error {
+	if f.dirReader != nil {
+		_ = f.dirReader.Close()
+	}
+
+	if f.reader == nil {
+		return nil
 	}
 
 	return f.reader.Close()
@@ -1,18 +1,38 @@
 package storager
 
 import (
+	"context"
 	"fmt"
 	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/faulty"
 	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/journal"
+	"github.com/aulaga/aufs/src/overlay"
+	"github.com/aulaga/aufs/src/storager/writers"
+	"github.com/aulaga/aufs/src/webhook"
 	_ "go.beyondstorage.io/services/fs/v4"
 	_ "go.beyondstorage.io/services/memory"
 	"go.beyondstorage.io/v5/services"
+	"io/fs"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type DefaultStorageProvider struct {
-	filesystems map[aufs.FileSystemSpec]aufs.Filesystem
-	storages    map[aufs.StorageSpec]aufs.Storage
+	filesystems   map[aufs.FileSystemSpec]aufs.Filesystem
+	filesystemsMu sync.Mutex
+	storages      map[aufs.StorageSpec]aufs.Storage
+	storagesMu    sync.Mutex
+}
+
+var defaultProvider = Provider()
+
+// Default returns the process-wide provider, handlers sharing it observe the same filesystems and their events.
+func Default() aufs.StorageProvider {
+	return defaultProvider
 }
 
 func Provider() aufs.StorageProvider {
@@ -22,20 +42,10 @@ func Provider() aufs.StorageProvider {
 	}
 }
 
-type mount struct {
-	storage aufs.Storage
-	point   string
-}
-
-func (m mount) Storage() aufs.Storage {
-	return m.storage
-}
-
-func (m mount) Point() string {
-	return m.point
-}
-
 func (p *DefaultStorageProvider) ProvideFileSystem(spec aufs.FileSystemSpec) (aufs.Filesystem, error) {
+	p.filesystemsMu.Lock()
+	defer p.filesystemsMu.Unlock()
+
 	fs, ok := p.filesystems[spec]
 	if ok {
 		return fs, nil
@@ -55,41 +65,251 @@ func (p *DefaultStorageProvider) ProvideFileSystem(spec aufs.FileSystemSpec) (au
 			return nil, err
 		}
 
-		point := strings.Trim(mountSpec.MountPoint, "/")
-		point = fmt.Sprintf("/%s/", point)
+		mounts[i] = internal.NewMount(storage, mountSpec.MountPoint, mountSpec.Mode)
+	}
 
-		mount := &mount{
-			storage: storage,
-			point:   point,
+	id := spec.Root().Id
+	filesystem, err := internal.NewFilesystem(id, rootStorage, mounts, p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filesystem spec '%s', %s", id, err.Error())
+	}
+
+	journalSpec, ok := spec.(aufs.JournalFileSystemSpec)
+	if ok {
+		eventJournal, err := journal.Open(journalSpec.Journal())
+		if err != nil {
+			return nil, fmt.Errorf("invalid journal for filesystem '%s', %s", id, err.Error())
 		}
-		mounts[i] = mount
+
+		filesystem.SetJournal(eventJournal)
 	}
 
-	id := spec.Root().Id
-	fs = internal.NewFilesystem(id, rootStorage, mounts)
+	moveJournalSpec, ok := spec.(aufs.MoveJournalFileSystemSpec)
+	if ok {
+		moveJournal, err := internal.OpenMoveJournal(moveJournalSpec.MoveJournal())
+		if err != nil {
+			return nil, fmt.Errorf("invalid move journal for filesystem '%s', %s", id, err.Error())
+		}
+
+		filesystem.SetMoveJournal(moveJournal)
+		err = filesystem.RecoverMoves(context.Background())
+		if err != nil {
+			_ = filesystem.Shutdown(context.Background())
+			return nil, fmt.Errorf("invalid move journal for filesystem '%s', %s", id, err.Error())
+		}
+	}
+
+	fs = filesystem
 	listener := spec.Listener()
 	if listener != nil {
 		fs.AddEventListener(listener)
 	}
 
+	webhookSpec, ok := spec.(aufs.WebhookFileSystemSpec)
+	if ok {
+		for _, hook := range webhookSpec.Webhooks() {
+			sink, err := webhook.New(hook)
+			if err != nil {
+				_ = fs.Shutdown(context.Background())
+				return nil, fmt.Errorf("invalid webhook for filesystem '%s', %s", id, err.Error())
+			}
+
+			fs.AddEventHandler(sink, aufs.DefaultListenerOptions())
+		}
+	}
+
 	p.filesystems[spec] = fs
 	return fs, nil
 }
 
 func (p *DefaultStorageProvider) ProvideStorage(spec aufs.StorageSpec) (aufs.Storage, error) {
+	p.storagesMu.Lock()
+	defer p.storagesMu.Unlock()
+
+	return p.provideStorage(spec)
+}
+
+func (p *DefaultStorageProvider) provideStorage(spec aufs.StorageSpec) (aufs.Storage, error) {
 	st, ok := p.storages[spec]
 	if ok {
 		return st, nil
 	}
 
 	uri := strings.TrimLeft(spec.Uri, "@")
+	if strings.HasPrefix(uri, overlayScheme+":") {
+		storage, err := p.provideOverlay(spec.Id, uri)
+		if err != nil {
+			return nil, err
+		}
+
+		p.storages[spec] = storage
+		return storage, nil
+	}
+	if strings.HasPrefix(uri, faultyScheme+":") {
+		storage, err := p.provideFaulty(spec.Id, uri)
+		if err != nil {
+			return nil, err
+		}
+
+		p.storages[spec] = storage
+		return storage, nil
+	}
+
 	storager, err := services.NewStoragerFromString(uri)
 	if err != nil {
 		return nil, err
 	}
 
 	id := spec.Id
+	storage := NewStoragerWithOptions(id, storager, Options{
+		AtomicWrites: spec.AtomicWrites,
+		Multipart:    writers.MultipartOptions{PartSize: spec.PartSize},
+	}).(*StoragerWrapper)
+
+	// Non atomic storages stage files too, e.g. the copies replacing existing files
+	err = storage.CleanStaging(context.Background(), OrphanedStagingAge)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage '%s', %s", id, err.Error())
+	}
+
+	p.storages[spec] = storage
+	return storage, nil
+}
+
+const overlayScheme = "overlay"
+
+// provideOverlay builds an overlay storage from an uri like "overlay://?upper=<uri>&lower=<uri>&lower=<uri>", where
+// nested uris are query-escaped and lower layers are listed from the topmost to the bottommost.
+func (p *DefaultStorageProvider) provideOverlay(id string, uri string) (aufs.Storage, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid overlay uri '%s', %s", uri, err.Error())
+	}
+
+	query := parsed.Query()
+	upperUri := query.Get("upper")
+	if upperUri == "" {
+		return nil, fmt.Errorf("invalid overlay uri '%s', missing upper storage", uri)
+	}
+
+	upper, err := p.provideStorage(aufs.StorageSpec{Id: upperUri, Uri: upperUri})
+	if err != nil {
+		return nil, err
+	}
+
+	var lowers []aufs.Storage
+	for _, lowerUri := range query["lower"] {
+		lower, err := p.provideStorage(aufs.StorageSpec{Id: lowerUri, Uri: lowerUri})
+		if err != nil {
+			return nil, err
+		}
+		lowers = append(lowers, lower)
+	}
+
+	return overlay.New(id, upper, lowers...), nil
+}
+
+const faultyScheme = "faulty"
+
+var faultyErrors = map[string]error{
+	"injected":    faulty.ErrInjected,
+	"notfound":    fs.ErrNotExist,
+	"exists":      fs.ErrExist,
+	"denied":      fs.ErrPermission,
+	"unsupported": aufs.ErrNotSupported,
+	"quota":       aufs.ErrQuotaExceeded,
+	"conflict":    aufs.ErrConflict,
+	"unavailable": aufs.ErrStorageUnavailable,
+}
+
+// provideFaulty builds a fault-injecting storage from an uri like
+// "faulty://?storage=<uri>&op=write&path=/tmp/**&error=unavailable&rate=0.5", where the nested uri is query-escaped.
+// The other parameters configure a single faulty.Fault: op, path, on_call, times, rate, latency (a duration like
+// "200ms"), hang, partial and error, one of the names of faultyErrors. Faults fail with the injected error unless
+// they only delay, hang or cut short calls.
+func (p *DefaultStorageProvider) provideFaulty(id string, uri string) (aufs.Storage, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid faulty uri '%s', %s", uri, err.Error())
+	}
+
+	query := parsed.Query()
+	storageUri := query.Get("storage")
+	if storageUri == "" {
+		return nil, fmt.Errorf("invalid faulty uri '%s', missing storage", uri)
+	}
+
+	fault, err := parseFault(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid faulty uri '%s', %s", uri, err.Error())
+	}
+
+	storage, err := p.provideStorage(aufs.StorageSpec{Id: storageUri, Uri: storageUri})
+	if err != nil {
+		return nil, err
+	}
+
+	faultyStorage := faulty.New(id, storage)
+	faultyStorage.Inject(fault)
+	return faultyStorage, nil
+}
+
+func parseFault(query url.Values) (faulty.Fault, error) {
+	fault := faulty.Fault{
+		Op:   faulty.Op(query.Get("op")),
+		Path: query.Get("path"),
+	}
+
+	var err error
+	if value := query.Get("on_call"); value != "" {
+		fault.OnCall, err = strconv.Atoi(value)
+		if err != nil || fault.OnCall < 0 {
+			return fault, fmt.Errorf("invalid on_call '%s'", value)
+		}
+	}
+	if value := query.Get("times"); value != "" {
+		fault.Times, err = strconv.Atoi(value)
+		if err != nil || fault.Times < 0 {
+			return fault, fmt.Errorf("invalid times '%s'", value)
+		}
+	}
+	if value := query.Get("rate"); value != "" {
+		fault.Rate, err = strconv.ParseFloat(value, 64)
+		if err != nil || fault.Rate < 0 || fault.Rate > 1 {
+			return fault, fmt.Errorf("invalid rate '%s'", value)
+		}
+	}
+	if value := query.Get("latency"); value != "" {
+		fault.Latency, err = time.ParseDuration(value)
+		if err != nil || fault.Latency < 0 {
+			return fault, fmt.Errorf("invalid latency '%s'", value)
+		}
+	}
+	if value := query.Get("hang"); value != "" {
+		fault.Hang, err = strconv.ParseBool(value)
+		if err != nil {
+			return fault, fmt.Errorf("invalid hang '%s'", value)
+		}
+	}
+	if value := query.Get("partial"); value != "" {
+		fault.Partial, err = strconv.Atoi(value)
+		if err != nil || fault.Partial < 0 {
+			return fault, fmt.Errorf("invalid partial '%s'", value)
+		}
+	}
+
+	name := query.Get("error")
+	if name == "" {
+		if fault.Latency > 0 || fault.Hang || fault.Partial > 0 {
+			return fault, nil
+		}
+		name = "injected"
+	}
+
+	fault.Err = faultyErrors[name]
+	if fault.Err == nil {
+		return fault, fmt.Errorf("unknown error '%s'", name)
+	}
 
-	p.storages[spec] = NewStorager(id, storager)
-	return p.storages[spec], nil
+	return fault, nil
 }
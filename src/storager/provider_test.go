@@ -0,0 +1,65 @@
+package storager_test
+
+import (
+	"errors"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/faulty"
+	"github.com/aulaga/aufs/src/storager"
+	"net/url"
+	"testing"
+)
+
+func faultyUri(query string) string {
+	return "faulty://?storage=" + url.QueryEscape("memory://") + "&" + query
+}
+
+func TestProvideFaultyInvalidUri(t *testing.T) {
+	for _, uri := range []string{
+		"faulty://?op=stat",
+		"faulty://?storage=%zz",
+		faultyUri("on_call=first"),
+		faultyUri("on_call=-1"),
+		faultyUri("times=1.5"),
+		faultyUri("times=-2"),
+		faultyUri("rate=half"),
+		faultyUri("rate=1.5"),
+		faultyUri("rate=-0.1"),
+		faultyUri("latency=200"),
+		faultyUri("latency=-1s"),
+		faultyUri("hang=maybe"),
+		faultyUri("partial=some"),
+		faultyUri("partial=-1"),
+		faultyUri("error=boom"),
+		faultyUri("latency=1ms&error=boom"),
+	} {
+		_, err := storager.Provider().ProvideStorage(aufs.StorageSpec{Id: "faulty", Uri: uri})
+		if err == nil {
+			t.Fatalf("faulty uri '%s' was accepted", uri)
+		}
+	}
+}
+
+func TestProvideFaulty(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		code  aufs.ErrorCode
+	}{
+		{"op=stat", aufs.Unknown},
+		{"op=stat&error=unavailable", aufs.StorageUnavailable},
+		{"op=stat&error=denied&on_call=1&times=1&rate=1", aufs.PermissionDenied},
+		{"path=dir/**&error=quota", aufs.QuotaExceeded},
+	} {
+		storage, err := storager.Provider().ProvideStorage(aufs.StorageSpec{Id: "faulty", Uri: faultyUri(test.query)})
+		if err != nil {
+			t.Fatalf("failed to provide '%s', %s", test.query, err.Error())
+		}
+
+		_, err = storage.Stat("dir/a.txt")
+		if test.code == aufs.Unknown && !errors.Is(err, faulty.ErrInjected) {
+			t.Fatalf("stat with '%s' returned %v, want the injected error", test.query, err)
+		}
+		if aufs.CodeOf(err) != test.code {
+			t.Fatalf("stat with '%s' returned %v, want a %s error", test.query, err, test.code)
+		}
+	}
+}
@@ -1,29 +1,29 @@
 package storager
 
 import (
-	"bytes"
-	"go.beyondstorage.io/v5/pairs"
+	"context"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
 	"go.beyondstorage.io/v5/types"
 	"io"
 	"io/fs"
+	"time"
 )
 
 type Reader interface {
 	io.ReadSeekCloser
 }
 
+// defaultReader holds the offset of a file being read and the object it was opened on. The file is stated once, reads
+// serve the object of that stat and fail with a Conflict Error when the object changed under them, see revalidate.
 type defaultReader struct {
+	ctx      context.Context
 	storager types.Storager
 	path     string
 	offset   int64
 	size     *int64
-}
-
-func newDefaultReader(storager types.Storager, path string) Reader {
-	return &defaultReader{
-		storager: storager,
-		path:     path,
-	}
+	etag     string
+	modified time.Time
 }
 
 func (f *defaultReader) Path() string {
@@ -34,69 +34,74 @@ func (f *defaultReader) Close() error {
 	return nil
 }
 
-func (f *defaultReader) Read(p []byte) (int, error) {
-	var buf bytes.Buffer
-
-	size, err := f.Size()
-	if err != nil {
-		return 0, err
-	}
-
-	readSize := int64(len(p))
-	if readSize+f.offset > size {
-		readSize = size - f.offset
-	}
-
-	n, err := f.storager.Read(f.path, &buf, pairs.WithOffset(f.offset), pairs.WithSize(readSize))
-	if err != nil {
-		return 0, err
-	}
-	f.offset += n
-
-	return buf.Read(p)
-}
-
+// Seek sets the offset of the next Read as io.Seeker does. Offsets past the end of the file are allowed, reading
+// there returns io.EOF.
 func (f *defaultReader) Seek(offset int64, whence int) (int64, error) {
-	size, err := f.Size()
-	if err != nil {
-		return 0, err
-	}
-
-	if whence == io.SeekStart {
-		f.offset = offset
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = f.offset
+	case io.SeekEnd:
+		size, err := f.Size()
+		if err != nil {
+			return 0, err
+		}
+		base = size
+	default:
+		return 0, fmt.Errorf("cannot seek '%s', invalid whence %d", f.path, whence)
 	}
 
-	if whence == io.SeekEnd {
-		f.offset = size - offset
-	}
-
-	if whence == io.SeekCurrent {
-		f.offset += offset
+	if base+offset < 0 {
+		return 0, fmt.Errorf("cannot seek '%s', negative position %d", f.path, base+offset)
 	}
 
+	f.offset = base + offset
 	return f.offset, nil
 }
 
+// Size returns the size of the file when first stated.
 func (f *defaultReader) Size() (int64, error) {
 	if f.size != nil {
 		return *f.size, nil
 	}
 
-	obj, err := f.storager.Stat(f.path)
+	obj, err := f.storager.StatWithContext(f.ctx, f.path)
 	if err != nil {
-		return -1, err
+		return -1, wrapError("stat", f.path, err)
 	}
 
 	size, ok := obj.GetContentLength()
 	if !ok {
-		return 0, nil // FIXME should return error?
+		return -1, fmt.Errorf("cannot read '%s', size unknown", f.path)
 	}
+
+	f.etag, _ = obj.GetEtag()
+	f.modified, _ = obj.GetLastModified()
 	f.size = &size
 	return size, nil
 }
 
+// revalidate checks the object is still the one first stated, once data was read from it. Objects without etag are
+// compared by size and modification time.
+func (f *defaultReader) revalidate() error {
+	obj, err := f.storager.StatWithContext(f.ctx, f.path)
+	if err != nil {
+		return wrapError("read", f.path, err)
+	}
+
+	size, _ := obj.GetContentLength()
+	etag, _ := obj.GetEtag()
+	modified, _ := obj.GetLastModified()
+	if etag != f.etag || size != *f.size || !modified.Equal(f.modified) {
+		return aufs.NewError(aufs.Conflict, "read", f.path, fmt.Errorf("object changed while being read"))
+	}
+
+	return nil
+}
+
 func (f *defaultReader) Stat() (fs.FileInfo, error) {
-	obj, err := f.storager.Stat(f.path)
+	obj, err := f.storager.StatWithContext(f.ctx, f.path)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,126 @@
+package storager_test
+
+import (
+	"errors"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/storager"
+	"go.beyondstorage.io/v5/services"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newReaderStorage returns a memory storage reading blocks of 4 bytes, with content written at "file.txt".
+func newReaderStorage(t *testing.T, content string) aufs.Storage {
+	s, err := services.NewStoragerFromString("memory://")
+	if err != nil {
+		t.Fatalf("failed to create storager, %s", err.Error())
+	}
+
+	storage := storager.NewStoragerWithOptions(t.Name(), s, storager.Options{
+		Reader: storager.ReaderOptions{BlockSize: 4, ReadAhead: -1},
+	})
+	writeFile(t, storage, "file.txt", content)
+
+	return storage
+}
+
+func writeFile(t *testing.T, s aufs.Storage, filePath string, content string) {
+	t.Helper()
+	err := internal.CreateFile(s, filePath, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("failed to write '%s', %s", filePath, err.Error())
+	}
+}
+
+func openFile(t *testing.T, s aufs.Storage, filePath string) aufs.File {
+	t.Helper()
+	file, err := s.OpenFile(filePath, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("failed to open '%s', %s", filePath, err.Error())
+	}
+	t.Cleanup(func() {
+		_ = file.Close()
+	})
+
+	return file
+}
+
+func TestReaderSeekEnd(t *testing.T) {
+	file := openFile(t, newReaderStorage(t, "0123456789"), "file.txt")
+
+	for _, offset := range []int64{-1, -4, -10} {
+		pos, err := file.Seek(offset, io.SeekEnd)
+		if err != nil || pos != 10+offset {
+			t.Fatalf("seek %d from the end returned %d and %v, want %d", offset, pos, err, 10+offset)
+		}
+
+		content, err := io.ReadAll(file)
+		if err != nil || string(content) != "0123456789"[10+offset:] {
+			t.Fatalf("read after seek %d from the end returned %q and %v", offset, content, err)
+		}
+	}
+
+	_, err := file.Seek(-11, io.SeekEnd)
+	if err == nil {
+		t.Fatalf("seek before the start of the file succeeded")
+	}
+}
+
+func TestReaderPastEnd(t *testing.T) {
+	file := openFile(t, newReaderStorage(t, "0123456789"), "file.txt")
+	buf := make([]byte, 4)
+
+	for _, offset := range []int64{10, 11, 100} {
+		_, err := file.Seek(offset, io.SeekStart)
+		if err != nil {
+			t.Fatalf("seek to %d failed, %s", offset, err.Error())
+		}
+
+		n, err := file.Read(buf)
+		if n != 0 || err != io.EOF {
+			t.Fatalf("read at %d returned %d and %v, want 0 and io.EOF", offset, n, err)
+		}
+	}
+
+	readerAt, ok := file.(io.ReaderAt)
+	if !ok {
+		t.Fatalf("file is not an io.ReaderAt")
+	}
+	n, err := readerAt.ReadAt(buf, 10)
+	if n != 0 || err != io.EOF {
+		t.Fatalf("read at the size returned %d and %v, want 0 and io.EOF", n, err)
+	}
+	n, err = readerAt.ReadAt(buf, 8)
+	if n != 2 || err != io.EOF {
+		t.Fatalf("read across the size returned %d and %v, want 2 and io.EOF", n, err)
+	}
+}
+
+func TestReaderChangedObject(t *testing.T) {
+	for name, content := range map[string]string{
+		"Replaced": "abcdefghij",
+		"Grown":    "0123456789abcdef",
+	} {
+		content := content
+		t.Run(name, func(t *testing.T) {
+			storage := newReaderStorage(t, "0123456789")
+			file := openFile(t, storage, "file.txt")
+
+			buf := make([]byte, 4)
+			_, err := io.ReadFull(file, buf)
+			if err != nil || string(buf) != "0123" {
+				t.Fatalf("first read returned %q and %v", buf, err)
+			}
+
+			writeFile(t, storage, "file.txt", content)
+
+			_, err = io.ReadFull(file, buf)
+			if !errors.Is(err, aufs.ErrConflict) {
+				t.Fatalf("read of the changed object returned %q and %v, want a Conflict error", buf, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package storager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/google/uuid"
+	"go.beyondstorage.io/v5/types"
+	"io/fs"
+	"time"
+)
+
+// OrphanedStagingAge is the age after which a staging object is considered left behind by a crashed writer.
+var OrphanedStagingAge = time.Hour
+
+func newStagingPath() string {
+	return internal.NewStagingPath(uuid.New().String())
+}
+
+func isStagingPath(path string) bool {
+	return internal.IsStagingPath(sanitizePath(path))
+}
+
+func withoutStaging(infos []aufs.NodeInfo) []aufs.NodeInfo {
+	visible := infos[:0]
+	for _, info := range infos {
+		if !isStagingPath(info.Path()) {
+			visible = append(visible, info)
+		}
+	}
+
+	return visible
+}
+
+// CleanStaging removes the staging objects last modified before olderThan ago, left behind by writers or copies that
+// crashed before committing or aborting their writes.
+func (s *StoragerWrapper) CleanStaging(ctx context.Context, olderThan time.Duration) error {
+	objects, err := s.listObjects(ctx, internal.StagingDir, types.ListModeDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list staging objects of storage '%s', %s", s.id, err.Error())
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	for _, obj := range objects {
+		info := getObjectInfo(obj)
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+
+		err = s.storager.DeleteWithContext(ctx, obj.GetPath())
+		if err != nil {
+			return fmt.Errorf("failed to remove staging object '%s', %s", obj.GetPath(), err.Error())
+		}
+	}
+
+	return nil
+}
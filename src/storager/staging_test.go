@@ -0,0 +1,53 @@
+package storager_test
+
+import (
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/storager"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProvideRemovesOrphanedStaging(t *testing.T) {
+	dir := t.TempDir()
+	stagingDir := filepath.Join(dir, internal.StagingDir)
+	err := os.MkdirAll(stagingDir, 0755)
+	if err != nil {
+		t.Fatalf("failed to create staging dir, %s", err.Error())
+	}
+	old := time.Now().Add(-2 * storager.OrphanedStagingAge)
+	for _, name := range []string{"orphaned", "recent"} {
+		err = os.WriteFile(filepath.Join(stagingDir, name), []byte("staged"), 0644)
+		if err != nil {
+			t.Fatalf("failed to write '%s', %s", name, err.Error())
+		}
+	}
+	err = os.Chtimes(filepath.Join(stagingDir, "orphaned"), old, old)
+	if err != nil {
+		t.Fatalf("failed to age staging file, %s", err.Error())
+	}
+
+	storage, err := storager.Provider().ProvideStorage(aufs.StorageSpec{Id: "fs", Uri: "fs://" + dir})
+	if err != nil {
+		t.Fatalf("failed to provide storage, %s", err.Error())
+	}
+
+	_, err = os.Stat(filepath.Join(stagingDir, "orphaned"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("orphaned staging file was kept by a non atomic storage")
+	}
+	_, err = os.Stat(filepath.Join(stagingDir, "recent"))
+	if err != nil {
+		t.Fatalf("recent staging file was removed, %s", err.Error())
+	}
+
+	infos, err := storage.ListDir("", false)
+	if err != nil {
+		t.Fatalf("failed to list storage, %s", err.Error())
+	}
+	if len(infos) != 0 {
+		t.Fatalf("storage lists %d entries, want the staging dir hidden", len(infos))
+	}
+}
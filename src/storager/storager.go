@@ -1,14 +1,21 @@
 package storager
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	aufs "github.com/aulaga/aufs/src"
 	"github.com/aulaga/aufs/src/internal"
 	"github.com/aulaga/aufs/src/storager/writers"
 	"go.beyondstorage.io/v5/pairs"
+	"go.beyondstorage.io/v5/services"
 	"go.beyondstorage.io/v5/types"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 type Object = types.Object
@@ -30,15 +37,43 @@ func getObjectInfo(node *Object) aufs.NodeInfo {
 	)
 }
 
+var _ aufs.ContextStorage = &StoragerWrapper{}
+var _ aufs.Lister = &StoragerWrapper{}
+
 type StoragerWrapper struct {
-	id       string
-	storager types.Storager
+	id           string
+	storager     types.Storager
+	atomicWrites bool
+	multipart    writers.MultipartOptions
+	reader       ReaderOptions
+}
+
+// Options configure how a StoragerWrapper writes files.
+type Options struct {
+	// AtomicWrites writes files to a hidden staging object, only replacing their path once closed successfully.
+	// Storages that can neither move nor copy objects buffer written files locally instead.
+	AtomicWrites bool
+	// Multipart configures the uploads of storages implementing types.Multiparter.
+	Multipart writers.MultipartOptions
+	Reader    ReaderOptions
 }
 
 func NewStorager(id string, storager types.Storager) aufs.Storage {
+	return NewStoragerWithOptions(id, storager, Options{})
+}
+
+// NewAtomicStorager returns a storage writing files atomically, see Options.AtomicWrites.
+func NewAtomicStorager(id string, storager types.Storager) aufs.Storage {
+	return NewStoragerWithOptions(id, storager, Options{AtomicWrites: true})
+}
+
+func NewStoragerWithOptions(id string, storager types.Storager, options Options) aufs.Storage {
 	return &StoragerWrapper{
-		id:       id,
-		storager: storager,
+		id:           id,
+		storager:     storager,
+		atomicWrites: options.AtomicWrites,
+		multipart:    options.Multipart,
+		reader:       options.Reader,
 	}
 }
 
@@ -55,111 +90,314 @@ func sanitizePath(path string) string {
 }
 
 func (s *StoragerWrapper) Open(path string) (aufs.File, error) {
+	return s.OpenFile(path, os.O_RDWR|os.O_CREATE)
+}
+
+func (s *StoragerWrapper) OpenFile(path string, flag int) (aufs.File, error) {
+	return s.OpenFileWithContext(context.Background(), path, flag)
+}
+
+func (s *StoragerWrapper) OpenFileWithContext(ctx context.Context, path string, flag int) (aufs.File, error) {
 	path = sanitizePath(path)
+	exists, err := internal.CheckOpenFlags(internal.Bind(ctx, s), path, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &FileReadWriter{
+		ctx:           ctx,
+		storager:      s,
+		path:          path,
+		createOnClose: internal.CreatesOnClose(flag, exists),
+	}
+
+	if internal.IsReadable(flag) {
+		file.reader = newBufferedReader(ctx, s.storager, path, s.reader)
+	}
+
+	if internal.IsWritable(flag) {
+		file.writer = s.newWriter(ctx, path, exists && flag&os.O_APPEND != 0)
+	}
+
+	return file, nil
+}
+
+func (s *StoragerWrapper) newWriter(ctx context.Context, path string, appending bool) writers.Writer {
+	if !s.atomicWrites {
+		return s.newObjectWriter(ctx, path, path, appending)
+	}
 
-	reader := newDefaultReader(s.storager, path)
+	_, isMover := s.storager.(types.Mover)
+	_, isCopier := s.storager.(types.Copier)
+	if !isMover && !isCopier {
+		// The temp buffer only writes to path once closed, in a single write
+		if appending {
+			return writers.NewAppendingTempBuffer(ctx, s.storager, path, path)
+		}
+		return writers.NewTempBuffer(ctx, s.storager, path)
+	}
+
+	stagingPath := newStagingPath()
+	return writers.NewStaged(ctx, s.storager, path, stagingPath, s.newObjectWriter(ctx, path, stagingPath, appending))
+}
+
+// newObjectWriter returns a writer of path, starting with the content of source when appending.
+func (s *StoragerWrapper) newObjectWriter(ctx context.Context, source string, path string, appending bool) writers.Writer {
+	// Appenders create new objects, appending to an existing one goes through a buffer holding its content
+	if appending {
+		return writers.NewAppendingTempBuffer(ctx, s.storager, source, path)
+	}
 
-	var writer writers.Writer
 	appender, isAppender := s.storager.(types.Appender)
 	if isAppender {
-		writer = writers.NewAppender(appender, path)
+		return writers.NewAppender(ctx, appender, path)
 	}
 
-	if writer == nil {
-		writer = writers.NewTempBuffer(s.storager, path)
+	multiparter, isMultiparter := s.storager.(types.Multiparter)
+	if isMultiparter {
+		return writers.NewMultipart(ctx, s.storager, multiparter, path, s.multipart)
 	}
 
-	return &FileReadWriter{
-		writer:   writer,
-		reader:   reader,
-		storager: s,
-		path:     path,
-	}, nil
+	return writers.NewTempBuffer(ctx, s.storager, path)
 }
 
 func (s *StoragerWrapper) Stat(path string) (aufs.NodeInfo, error) {
+	return s.StatWithContext(context.Background(), path)
+}
+
+func (s *StoragerWrapper) StatWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
 	path = sanitizePath(path)
-	obj, err := s.storager.Stat(path)
+	obj, err := s.storager.StatWithContext(ctx, path)
 	if err != nil {
-		return nil, err
+		return nil, wrapError("stat", path, err)
 	}
 
-	return getObjectInfo(obj), err
+	return getObjectInfo(obj), nil
 }
 
 func (s *StoragerWrapper) Delete(path string) error {
+	return s.DeleteWithContext(context.Background(), path)
+}
+
+func (s *StoragerWrapper) DeleteWithContext(ctx context.Context, path string) error {
 	path = sanitizePath(path)
 
-	return s.storager.Delete(path)
+	return wrapError("delete", path, s.storager.DeleteWithContext(ctx, path))
 }
 
 func (s *StoragerWrapper) Copy(srcPath string, dstPath string) error {
+	return s.CopyWithContext(context.Background(), srcPath, dstPath)
+}
+
+func (s *StoragerWrapper) CopyWithContext(ctx context.Context, srcPath string, dstPath string) error {
 	srcPath = sanitizePath(srcPath)
 	dstPath = sanitizePath(dstPath)
-	info, err := s.Stat(srcPath)
+	info, err := s.StatWithContext(ctx, srcPath)
 	if err != nil {
 		return err
 	}
 
 	// If source node is a folder we need to manually copy, storager does not allow copying file structures.
 	if info.IsDir() {
-		return internal.ManualCopy(s, s, srcPath, dstPath)
+		return internal.ManualCopyWithContext(ctx, s, s, srcPath, dstPath)
 	}
 
 	copier, ok := s.storager.(types.Copier)
 	if !ok {
-		return fmt.Errorf("CopyOperation failed, storage not a copier")
+		return aufs.NewError(aufs.NotSupported, "copy", srcPath, fmt.Errorf("storage not a copier"))
 	}
 
-	return copier.Copy(srcPath, dstPath)
+	return wrapError("copy", srcPath, copier.CopyWithContext(ctx, srcPath, dstPath))
 }
 
-// TODO implement Move between different storages
 func (s *StoragerWrapper) Move(srcPath string, dstPath string) error {
+	return s.MoveWithContext(context.Background(), srcPath, dstPath)
+}
+
+// TODO implement Move between different storages
+func (s *StoragerWrapper) MoveWithContext(ctx context.Context, srcPath string, dstPath string) error {
 	srcPath = sanitizePath(srcPath)
 	dstPath = sanitizePath(dstPath)
 	mover, ok := s.storager.(types.Mover)
 	if !ok {
-		return fmt.Errorf("MoveOperation failed, storage not a copier")
+		return aufs.NewError(aufs.NotSupported, "move", srcPath, fmt.Errorf("storage not a mover"))
+	}
+
+	err := mover.MoveWithContext(ctx, srcPath, dstPath)
+	if errors.Is(err, services.ErrObjectModeInvalid) {
+		// Services moving files only cannot move directories
+		return aufs.NewError(aufs.NotSupported, "move", srcPath, err)
 	}
 
-	return mover.Move(srcPath, dstPath)
+	return wrapError("move", srcPath, err)
 }
 
 func (s *StoragerWrapper) ListDir(path string, recursive bool) ([]aufs.NodeInfo, error) {
+	return s.ListDirWithContext(context.Background(), path, recursive)
+}
+
+func (s *StoragerWrapper) ListDirWithContext(ctx context.Context, path string, recursive bool) ([]aufs.NodeInfo, error) {
 	path = sanitizePath(path)
-	// TODO for recursion maybe listmode prefix can be used here
-	iterator, err := s.storager.List(path, pairs.WithListMode(types.ListModeDir))
+	if !recursive {
+		objects, err := s.listObjects(ctx, path, types.ListModeDir)
+		if err != nil {
+			return nil, err
+		}
+
+		infos := make([]aufs.NodeInfo, 0, len(objects))
+		for _, obj := range objects {
+			infos = append(infos, getObjectInfo(obj))
+		}
+
+		return withoutStaging(infos), nil
+	}
+
+	infos, err := s.listPrefix(ctx, path)
+	if errors.Is(err, services.ErrListModeInvalid) || errors.Is(err, services.ErrCapabilityInsufficient) {
+		infos, err = s.listTree(ctx, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return withoutStaging(infos), nil
+}
+
+func (s *StoragerWrapper) listObjects(ctx context.Context, path string, mode types.ListMode) ([]*Object, error) {
+	iterator, err := s.storager.ListWithContext(ctx, path, pairs.WithListMode(mode))
+	if err != nil {
+		return nil, wrapError("list", path, err)
+	}
+
+	var objects []*Object
+	for {
+		obj, err := iterator.Next()
+		if errors.Is(err, types.IterateDone) || (err == nil && obj == nil) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, wrapError("list", path, err)
+		}
+
+		objects = append(objects, obj)
+	}
+}
+
+// listPrefix lists every object under path in a single listing. Storages only return objects with a prefix listing,
+// the directories holding them are derived from their paths.
+func (s *StoragerWrapper) listPrefix(ctx context.Context, path string) ([]aufs.NodeInfo, error) {
+	prefix := path
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	objects, err := s.listObjects(ctx, prefix, types.ListModePrefix)
 	if err != nil {
 		return nil, err
 	}
 
+	dirs := map[string]bool{}
 	var infos []aufs.NodeInfo
-	for obj, err := iterator.Next(); obj != nil; obj, err = iterator.Next() {
-		if err != nil && errors.Is(err, types.IterateDone) {
-			break
+	for _, obj := range objects {
+		info := getObjectInfo(obj)
+		objPath := strings.TrimSuffix(info.Path(), "/")
+		if info.IsDir() {
+			if dirs[objPath] {
+				continue
+			}
+			dirs[objPath] = true
 		}
+		infos = append(infos, info)
+
+		for dir := filepath.Dir(objPath); dir != "." && dir != "/" && strings.HasPrefix(dir+"/", prefix) && dir+"/" != prefix; dir = filepath.Dir(dir) {
+			if dirs[dir] {
+				break
+			}
+			dirs[dir] = true
+			infos = append(infos, aufs.NewNodeInfo(dir, 0, time.Time{}, true, "", ""))
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path() < infos[j].Path()
+	})
+
+	return infos, nil
+}
+
+// listTree lists path recursively one directory at a time, for storages not supporting prefix listings.
+func (s *StoragerWrapper) listTree(ctx context.Context, path string) ([]aufs.NodeInfo, error) {
+	var infos []aufs.NodeInfo
+	pending := []string{path}
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+
+		objects, err := s.listObjects(ctx, dir, types.ListModeDir)
 		if err != nil {
 			return nil, err
 		}
 
-		infos = append(infos, getObjectInfo(obj))
-
+		for _, obj := range objects {
+			info := getObjectInfo(obj)
+			infos = append(infos, info)
+			if info.IsDir() {
+				pending = append(pending, info.Path())
+			}
+		}
 	}
 
 	return infos, nil
 }
 
+func (s *StoragerWrapper) List(path string, options aufs.ListOptions) (aufs.NodeIterator, error) {
+	return s.ListWithContext(context.Background(), path, options)
+}
+
+// ListWithContext streams the listing of path from the object iterator of the storager, a page at a time.
+func (s *StoragerWrapper) ListWithContext(ctx context.Context, path string, options aufs.ListOptions) (aufs.NodeIterator, error) {
+	path = sanitizePath(path)
+	iterator, err := s.storager.ListWithContext(ctx, path, pairs.WithListMode(types.ListModeDir))
+	if err != nil {
+		return nil, wrapError("list", path, err)
+	}
+
+	next := func() (aufs.NodeInfo, error) {
+		for {
+			obj, err := iterator.Next()
+			if errors.Is(err, types.IterateDone) {
+				return nil, io.EOF
+			}
+			if err != nil {
+				return nil, wrapError("list", path, err)
+			}
+			if obj == nil {
+				return nil, io.EOF
+			}
+
+			if !isStagingPath(obj.GetPath()) {
+				return getObjectInfo(obj), nil
+			}
+		}
+	}
+
+	return internal.ApplyListOptions(internal.NewNodeIterator(next, nil, options.PageSize), options), nil
+}
+
 func (s *StoragerWrapper) MkDir(path string) (aufs.NodeInfo, error) {
+	return s.MkDirWithContext(context.Background(), path)
+}
+
+func (s *StoragerWrapper) MkDirWithContext(ctx context.Context, path string) (aufs.NodeInfo, error) {
 	path = sanitizePath(path)
 	direr, ok := s.storager.(types.Direr)
 	if !ok {
-		return nil, fmt.Errorf("mkdir operation failed, storage is not direr")
+		return nil, aufs.NewError(aufs.NotSupported, "mkdir", path, fmt.Errorf("storage is not direr"))
 	}
 
-	o, err := direr.CreateDir(path)
+	o, err := direr.CreateDirWithContext(ctx, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create directory '%s', %s", path, err.Error())
+		return nil, wrapError("mkdir", path, fmt.Errorf("failed to create directory '%s', %w", path, err))
 	}
 
 	return getObjectInfo(o), nil
@@ -2,19 +2,23 @@ package writers
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"go.beyondstorage.io/v5/types"
 	"io/fs"
+	"time"
 )
 
 type appender struct {
+	ctx          context.Context
 	appender     types.Appender
 	appendObject *types.Object
 	path         string
+	written      int64
 }
 
-func NewAppender(appenderStorage types.Appender, path string) Writer {
+func NewAppender(ctx context.Context, appenderStorage types.Appender, path string) Writer {
 	return &appender{
+		ctx:      ctx,
 		appender: appenderStorage,
 		path:     path,
 	}
@@ -24,12 +28,12 @@ func (f *appender) Close() error {
 	if f.appendObject == nil {
 		return nil
 	}
-	return f.appender.CommitAppend(f.appendObject)
+	return f.appender.CommitAppendWithContext(f.ctx, f.appendObject)
 }
 
 func (f *appender) Write(p []byte) (int, error) {
 	if f.appendObject == nil {
-		obj, err := f.appender.CreateAppend(f.path)
+		obj, err := f.appender.CreateAppendWithContext(f.ctx, f.path)
 		if err != nil {
 			return 0, err
 		}
@@ -39,11 +43,13 @@ func (f *appender) Write(p []byte) (int, error) {
 
 	buf := bytes.NewBuffer(p)
 	n := int64(len(p))
-	n64, err := f.appender.WriteAppend(f.appendObject, buf, n)
+	n64, err := f.appender.WriteAppendWithContext(f.ctx, f.appendObject, buf, n)
+	f.written += n64
 
 	return int(n64), err
 }
 
+// Stat describes the content appended so far, the object may not be visible before it is committed.
 func (f *appender) Stat() (fs.FileInfo, error) {
-	return nil, fmt.Errorf("appender writer does cannot return Stat()")
+	return writtenInfo{path: f.path, size: f.written, modTime: time.Now()}, nil
 }
@@ -0,0 +1,224 @@
+package writers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.beyondstorage.io/v5/pairs"
+	"go.beyondstorage.io/v5/types"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPartSize    = 8 << 20
+	defaultConcurrency = 4
+)
+
+// MultipartOptions configure the uploads of multipart writers.
+type MultipartOptions struct {
+	// PartSize is the size of the uploaded parts, 8MiB when not set. Storages usually require a minimum size for every
+	// part but the last one.
+	PartSize int64
+	// Concurrency is the maximum number of parts uploaded at once, 4 when not set. A part buffer of PartSize is held in
+	// memory for each of them.
+	Concurrency int
+}
+
+type multipart struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	multiparter types.Multiparter
+	storager    types.Storager
+	path        string
+	partSize    int64
+
+	object *types.Object
+	part   []byte
+	index  int
+	size   int64 // bytes written so far
+	// buffers is the pool of part buffers, a buffer is taken from it while its part is filled and uploaded
+	buffers   chan []byte
+	allocated int
+	uploads   sync.WaitGroup
+
+	mu    sync.Mutex
+	parts []*types.Part
+	err   error
+}
+
+// NewMultipart returns a writer uploading the content of path in parts of options.PartSize, several parts being
+// uploaded concurrently while the next ones are written. Nothing is written to local disk. The multipart upload is
+// completed on Close, or aborted when any part failed.
+func NewMultipart(ctx context.Context, storager types.Storager, multiparter types.Multiparter, path string, options MultipartOptions) Writer {
+	if options.PartSize <= 0 {
+		options.PartSize = defaultPartSize
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = defaultConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &multipart{
+		ctx:         ctx,
+		cancel:      cancel,
+		multiparter: multiparter,
+		storager:    storager,
+		path:        path,
+		partSize:    options.PartSize,
+		buffers:     make(chan []byte, options.Concurrency),
+	}
+}
+
+func (f *multipart) failure() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.err
+}
+
+func (f *multipart) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err == nil {
+		f.err = err
+		f.cancel()
+	}
+}
+
+func (f *multipart) Write(p []byte) (int, error) {
+	err := f.failure()
+	if err != nil {
+		return 0, err
+	}
+
+	if f.object == nil && len(p) > 0 {
+		obj, err := f.multiparter.CreateMultipartWithContext(f.ctx, f.path)
+		if err != nil {
+			f.fail(err)
+			return 0, err
+		}
+		f.object = obj
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if f.part == nil {
+			f.part = f.buffer()
+		}
+
+		n := copy(f.part[len(f.part):cap(f.part)], p)
+		f.part = f.part[:len(f.part)+n]
+		p = p[n:]
+		written += n
+
+		if int64(len(f.part)) == f.partSize {
+			f.upload()
+		}
+	}
+	f.size += int64(written)
+
+	return written, f.failure()
+}
+
+// buffer takes a part buffer from the pool, allocating it while the pool is not full. It waits for an upload to
+// release its buffer otherwise.
+func (f *multipart) buffer() []byte {
+	select {
+	case buf := <-f.buffers:
+		return buf[:0]
+	default:
+	}
+
+	if f.allocated < cap(f.buffers) {
+		f.allocated++
+		return make([]byte, 0, f.partSize)
+	}
+
+	return (<-f.buffers)[:0]
+}
+
+// upload uploads the current part in the background.
+func (f *multipart) upload() {
+	part, index := f.part, f.index
+	f.part = nil
+	f.index++
+
+	f.uploads.Add(1)
+	go func() {
+		defer f.uploads.Done()
+		defer func() { f.buffers <- part }()
+
+		if f.failure() != nil {
+			return
+		}
+
+		n, uploaded, err := f.multiparter.WriteMultipartWithContext(f.ctx, f.object, bytes.NewReader(part), int64(len(part)), index)
+		if err != nil {
+			f.fail(fmt.Errorf("failed to upload part %d of '%s', %s", index, f.path, err.Error()))
+			return
+		}
+		if uploaded == nil {
+			uploaded = &types.Part{Index: index, Size: n}
+		}
+
+		f.mu.Lock()
+		f.parts = append(f.parts, uploaded)
+		f.mu.Unlock()
+	}()
+}
+
+func (f *multipart) Close() error {
+	defer f.cancel()
+	if f.object == nil {
+		return f.failure()
+	}
+
+	if len(f.part) > 0 {
+		f.upload()
+	}
+	f.uploads.Wait()
+
+	err := f.failure()
+	if err != nil {
+		f.abort()
+		return err
+	}
+
+	sort.Slice(f.parts, func(i, j int) bool {
+		return f.parts[i].Index < f.parts[j].Index
+	})
+
+	err = f.multiparter.CompleteMultipartWithContext(f.ctx, f.object, f.parts)
+	if err != nil {
+		f.abort()
+		return err
+	}
+
+	return nil
+}
+
+// Abort stops the pending uploads and aborts the multipart upload, the object at path is left untouched.
+func (f *multipart) Abort() {
+	f.fail(fmt.Errorf("write of '%s' aborted", f.path))
+	f.uploads.Wait()
+	if f.object != nil {
+		f.abort()
+	}
+}
+
+// abort deletes the multipart object with the parts uploaded so far.
+func (f *multipart) abort() {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	_ = f.storager.DeleteWithContext(ctx, f.path, pairs.WithMultipartID(f.object.MustGetMultipartID()))
+}
+
+// Stat describes the content written so far, the object is not visible before the multipart upload is completed.
+func (f *multipart) Stat() (fs.FileInfo, error) {
+	return writtenInfo{path: f.path, size: f.size, modTime: time.Now()}, nil
+}
@@ -0,0 +1,209 @@
+package writers_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/aulaga/aufs/src/storager/writers"
+	"go.beyondstorage.io/v5/types"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMultiparter keeps uploaded parts in memory. Parts finish out of order, the first ones being the slowest, and
+// the part at failPart fails.
+type fakeMultiparter struct {
+	types.Storager
+	failPart int
+
+	mu        sync.Mutex
+	parts     map[int][]byte
+	inflight  int
+	maxFlight int
+	completed []byte
+	aborted   string
+}
+
+func newFakeMultiparter(failPart int) *fakeMultiparter {
+	return &fakeMultiparter{failPart: failPart, parts: map[int][]byte{}}
+}
+
+func (m *fakeMultiparter) CreateMultipart(path string, pairs ...types.Pair) (*types.Object, error) {
+	return m.CreateMultipartWithContext(context.Background(), path, pairs...)
+}
+
+func (m *fakeMultiparter) CreateMultipartWithContext(_ context.Context, path string, _ ...types.Pair) (*types.Object, error) {
+	obj := types.NewObject(nil, true)
+	obj.Path = path
+	obj.SetMultipartID("upload")
+
+	return obj, nil
+}
+
+func (m *fakeMultiparter) WriteMultipart(o *types.Object, r io.Reader, size int64, index int, pairs ...types.Pair) (int64, *types.Part, error) {
+	return m.WriteMultipartWithContext(context.Background(), o, r, size, index, pairs...)
+}
+
+func (m *fakeMultiparter) WriteMultipartWithContext(ctx context.Context, _ *types.Object, r io.Reader, size int64, index int, _ ...types.Pair) (int64, *types.Part, error) {
+	m.mu.Lock()
+	m.inflight++
+	if m.inflight > m.maxFlight {
+		m.maxFlight = m.inflight
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.inflight--
+		m.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(time.Duration(10-index%10) * time.Millisecond):
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+	if index == m.failPart {
+		return 0, nil, errors.New("part failed")
+	}
+
+	content, err := io.ReadAll(r)
+	if err != nil || int64(len(content)) != size {
+		return 0, nil, errors.New("short part")
+	}
+
+	m.mu.Lock()
+	m.parts[index] = content
+	m.mu.Unlock()
+
+	return size, &types.Part{Index: index, Size: size}, nil
+}
+
+func (m *fakeMultiparter) CompleteMultipart(o *types.Object, parts []*types.Part, pairs ...types.Pair) error {
+	return m.CompleteMultipartWithContext(context.Background(), o, parts, pairs...)
+}
+
+func (m *fakeMultiparter) CompleteMultipartWithContext(_ context.Context, _ *types.Object, parts []*types.Part, _ ...types.Pair) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var content bytes.Buffer
+	for i, part := range parts {
+		if part.Index != i {
+			return errors.New("parts out of order")
+		}
+		content.Write(m.parts[part.Index])
+	}
+	m.completed = content.Bytes()
+
+	return nil
+}
+
+func (m *fakeMultiparter) ListMultipart(o *types.Object, pairs ...types.Pair) (*types.PartIterator, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *fakeMultiparter) ListMultipartWithContext(_ context.Context, _ *types.Object, _ ...types.Pair) (*types.PartIterator, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *fakeMultiparter) DeleteWithContext(_ context.Context, _ string, pairs ...types.Pair) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, pair := range pairs {
+		if pair.Key == "multipart_id" {
+			m.aborted = pair.Value.(string)
+		}
+	}
+
+	return nil
+}
+
+func (m *fakeMultiparter) result() ([]byte, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.completed, m.aborted
+}
+
+func write(w writers.Writer, chunks int) ([]byte, error) {
+	var content bytes.Buffer
+	for i := 0; i < chunks; i++ {
+		chunk := bytes.Repeat([]byte{byte('a' + i%26)}, 7)
+		content.Write(chunk)
+
+		_, err := w.Write(chunk)
+		if err != nil {
+			return content.Bytes(), err
+		}
+	}
+
+	return content.Bytes(), nil
+}
+
+func TestMultipartPartOrder(t *testing.T) {
+	m := newFakeMultiparter(-1)
+	w := writers.NewMultipart(context.Background(), m, m, "file.bin", writers.MultipartOptions{PartSize: 10, Concurrency: 3})
+
+	want, err := write(w, 50)
+	if err != nil {
+		t.Fatalf("write failed, %s", err.Error())
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("close failed, %s", err.Error())
+	}
+
+	completed, aborted := m.result()
+	if !bytes.Equal(completed, want) {
+		t.Fatalf("completed upload holds %q, want %q", completed, want)
+	}
+	if aborted != "" {
+		t.Fatalf("completed upload was aborted")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.maxFlight > 3 {
+		t.Fatalf("%d parts were uploaded at once, want at most 3", m.maxFlight)
+	}
+}
+
+func TestMultipartPartFailure(t *testing.T) {
+	m := newFakeMultiparter(2)
+	w := writers.NewMultipart(context.Background(), m, m, "file.bin", writers.MultipartOptions{PartSize: 10, Concurrency: 2})
+
+	_, _ = write(w, 20)
+	err := w.Close()
+	if err == nil {
+		t.Fatalf("close succeeded despite a failed part")
+	}
+
+	completed, aborted := m.result()
+	if completed != nil {
+		t.Fatalf("upload with a failed part was completed")
+	}
+	if aborted != "upload" {
+		t.Fatalf("upload with a failed part was not aborted")
+	}
+}
+
+func TestMultipartAbort(t *testing.T) {
+	m := newFakeMultiparter(-1)
+	w := writers.NewMultipart(context.Background(), m, m, "file.bin", writers.MultipartOptions{PartSize: 10, Concurrency: 2})
+
+	_, err := write(w, 5)
+	if err != nil {
+		t.Fatalf("write failed, %s", err.Error())
+	}
+	w.(writers.Aborter).Abort()
+
+	completed, aborted := m.result()
+	if completed != nil {
+		t.Fatalf("aborted upload was completed")
+	}
+	if aborted != "upload" {
+		t.Fatalf("aborted upload was not deleted")
+	}
+}
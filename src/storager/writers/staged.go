@@ -0,0 +1,135 @@
+package writers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.beyondstorage.io/v5/services"
+	"go.beyondstorage.io/v5/types"
+	"io/fs"
+	"time"
+)
+
+// abortTimeout bounds the removal of the staging object of an aborted write, which runs even when ctx is done.
+const abortTimeout = 30 * time.Second
+
+type staged struct {
+	ctx         context.Context
+	storager    types.Storager
+	path        string
+	stagingPath string
+	writer      Writer
+	written     bool
+	failed      bool
+}
+
+// NewStaged returns a writer of path writing through writer to stagingPath instead, the staging object is moved to path
+// once closed. The write is aborted and the staging object removed when any write failed or ctx is done by then, e.g.
+// when the client uploading the content disconnected, so path never holds partially written content. The storager
+// must be a types.Mover or a types.Copier.
+func NewStaged(ctx context.Context, storager types.Storager, path string, stagingPath string, writer Writer) Writer {
+	return &staged{
+		ctx:         ctx,
+		storager:    storager,
+		path:        path,
+		stagingPath: stagingPath,
+		writer:      writer,
+	}
+}
+
+func (f *staged) Write(p []byte) (int, error) {
+	f.written = true
+	n, err := f.writer.Write(p)
+	if err != nil {
+		f.failed = true
+	}
+
+	return n, err
+}
+
+func (f *staged) Close() error {
+	if !f.written {
+		return f.writer.Close()
+	}
+
+	err := f.ctx.Err()
+	if f.failed || err != nil {
+		if err == nil {
+			err = fmt.Errorf("a write failed")
+		}
+
+		f.Abort()
+		return fmt.Errorf("write of '%s' aborted, %w", f.path, err)
+	}
+
+	err = f.writer.Close()
+	if err != nil {
+		return f.abort(err)
+	}
+
+	err = f.commit()
+	if err != nil {
+		return f.abort(err)
+	}
+
+	return nil
+}
+
+// commit makes the staging object visible at path.
+func (f *staged) commit() error {
+	mover, ok := f.storager.(types.Mover)
+	if ok {
+		return mover.MoveWithContext(f.ctx, f.stagingPath, f.path)
+	}
+
+	copier, ok := f.storager.(types.Copier)
+	if !ok {
+		return fmt.Errorf("cannot commit '%s', storage is neither a mover nor a copier", f.path)
+	}
+
+	err := copier.CopyWithContext(f.ctx, f.stagingPath, f.path)
+	if err != nil {
+		return err
+	}
+
+	// The content is committed already, a leftover staging object is removed by the next orphan cleanup
+	_ = f.storager.DeleteWithContext(f.ctx, f.stagingPath)
+	return nil
+}
+
+// Abort discards the staging object, path is left untouched.
+func (f *staged) Abort() {
+	aborter, ok := f.writer.(Aborter)
+	if ok {
+		aborter.Abort()
+	} else {
+		_ = f.writer.Close()
+	}
+
+	_ = f.removeStaging()
+}
+
+func (f *staged) abort(cause error) error {
+	err := f.removeStaging()
+	if err != nil {
+		return fmt.Errorf("write of '%s' aborted, %s, failed to remove staging object '%s', %s", f.path, cause.Error(), f.stagingPath, err.Error())
+	}
+
+	return fmt.Errorf("write of '%s' aborted, %w", f.path, cause)
+}
+
+func (f *staged) removeStaging() error {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	err := f.storager.DeleteWithContext(ctx, f.stagingPath)
+	if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (f *staged) Stat() (fs.FileInfo, error) {
+	return f.writer.Stat()
+}
@@ -1,6 +1,7 @@
 package writers
 
 import (
+	"context"
 	"fmt"
 	"github.com/google/uuid"
 	"go.beyondstorage.io/v5/types"
@@ -9,22 +10,44 @@ import (
 )
 
 type tempbuffer struct {
+	ctx        context.Context
 	path       string
+	source     string
 	storager   types.Storager
 	bufferFile *os.File
 	offset     int64
 	written    bool
 	size       *int64
+	appending  bool
+	// err is the first write failure, after which nothing is written to path
+	err error
 }
 
-func NewTempBuffer(storager types.Storager, path string) Writer {
+func NewTempBuffer(ctx context.Context, storager types.Storager, path string) Writer {
 	return &tempbuffer{
+		ctx:      ctx,
 		path:     path,
 		storager: storager,
 	}
 }
 
+// NewAppendingTempBuffer returns a temp-buffer writer of path starting with the current content of source, so writes are
+// appended to it.
+func NewAppendingTempBuffer(ctx context.Context, storager types.Storager, source string, path string) Writer {
+	return &tempbuffer{
+		ctx:       ctx,
+		path:      path,
+		source:    source,
+		storager:  storager,
+		appending: true,
+	}
+}
+
 func (f *tempbuffer) Close() error {
+	if f.err != nil {
+		f.Abort()
+		return f.err
+	}
 	if f.bufferFile == nil {
 		return nil
 	}
@@ -42,11 +65,28 @@ func (f *tempbuffer) Close() error {
 	defer file.Close()
 	defer os.Remove(f.bufferFile.Name())
 
-	_, err = f.storager.Write(f.path, file, f.offset) // FIXME is using offset as length here safe?
+	_, err = f.storager.WriteWithContext(f.ctx, f.path, file, f.offset) // FIXME is using offset as length here safe?
 	return err
 }
 
+// Abort discards the temp file without writing it.
+func (f *tempbuffer) Abort() {
+	if f.bufferFile == nil {
+		return
+	}
+
+	_ = f.bufferFile.Close()
+	_ = os.Remove(f.bufferFile.Name())
+	f.bufferFile = nil
+}
+
+// Write writes p to the temp file, created on the first write with the content of source when appending. The writer
+// stays failed after an error so Close never writes an incomplete temp file over path.
 func (f *tempbuffer) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+
 	if f.bufferFile == nil {
 		tempName := fmt.Sprintf("aufs_%s", uuid.New().String())
 		file, err := os.CreateTemp("", tempName)
@@ -54,10 +94,25 @@ func (f *tempbuffer) Write(p []byte) (int, error) {
 			return 0, err
 		}
 		f.bufferFile = file
+
+		if f.appending {
+			n, err := f.storager.ReadWithContext(f.ctx, f.source, file)
+			if err != nil {
+				f.err = fmt.Errorf("failed to read '%s' to append to it, %s", f.source, err.Error())
+				f.Abort()
+				return 0, f.err
+			}
+			f.offset = n
+		}
+	}
+
+	n, err := f.bufferFile.Write(p)
+	f.offset = f.offset + int64(n)
+	if err != nil {
+		f.err = err
 	}
 
-	f.offset = f.offset + int64(len(p))
-	return f.bufferFile.Write(p)
+	return n, err
 }
 
 func (f *tempbuffer) Stat() (fs.FileInfo, error) {
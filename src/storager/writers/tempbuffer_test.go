@@ -0,0 +1,47 @@
+package writers_test
+
+import (
+	"context"
+	"errors"
+	"github.com/aulaga/aufs/src/storager/writers"
+	"go.beyondstorage.io/v5/types"
+	"io"
+	"testing"
+)
+
+// failingReadStorager fails every read and records the paths written.
+type failingReadStorager struct {
+	types.Storager
+	written []string
+}
+
+func (s *failingReadStorager) ReadWithContext(context.Context, string, io.Writer, ...types.Pair) (int64, error) {
+	return 0, errors.New("read failed")
+}
+
+func (s *failingReadStorager) WriteWithContext(_ context.Context, path string, r io.Reader, _ int64, _ ...types.Pair) (int64, error) {
+	s.written = append(s.written, path)
+	return io.Copy(io.Discard, r)
+}
+
+func TestAppendingTempBufferSourceReadFailure(t *testing.T) {
+	s := &failingReadStorager{}
+	w := writers.NewAppendingTempBuffer(context.Background(), s, "file.txt", "file.txt")
+
+	_, err := w.Write([]byte("appended"))
+	if err == nil {
+		t.Fatalf("write succeeded despite the failed read of its source")
+	}
+	_, err = w.Write([]byte("appended"))
+	if err == nil {
+		t.Fatalf("write after the failed read of its source succeeded")
+	}
+
+	err = w.Close()
+	if err == nil {
+		t.Fatalf("close succeeded despite the failed read of its source")
+	}
+	if len(s.written) != 0 {
+		t.Fatalf("close wrote %q over the source", s.written)
+	}
+}
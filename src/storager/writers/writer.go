@@ -3,9 +3,48 @@ package writers
 import (
 	"io"
 	"io/fs"
+	"path"
+	"time"
 )
 
 type Writer interface {
 	io.WriteCloser
 	Stat() (fs.FileInfo, error)
 }
+
+// writtenInfo describes the content written so far by writers whose objects cannot be stated before they are
+// committed.
+type writtenInfo struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (i writtenInfo) Name() string {
+	return path.Base(i.path)
+}
+
+func (i writtenInfo) Size() int64 {
+	return i.size
+}
+
+func (i writtenInfo) Mode() fs.FileMode {
+	return 0o644
+}
+
+func (i writtenInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i writtenInfo) IsDir() bool {
+	return false
+}
+
+func (i writtenInfo) Sys() interface{} {
+	return nil
+}
+
+// Aborter is optionally implemented by a Writer able to discard what was written instead of writing it on Close.
+type Aborter interface {
+	Abort()
+}
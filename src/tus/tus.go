@@ -0,0 +1,436 @@
+package tus
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/storager"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix is the path the handler is served under, uploads are created with a POST to Prefix/files/<path> and
+	// resumed at Prefix/uploads/<id>.
+	Prefix     = "/tus"
+	Version    = "1.0.0"
+	extensions = "creation,termination,expiration"
+
+	offsetContentType = "application/offset+octet-stream"
+)
+
+// UploadExpiration is how long an upload is kept after its last request, incomplete uploads are discarded once expired.
+var UploadExpiration = 24 * time.Hour
+
+// uploadStagingPrefix names the files uploads are written to, in the staging dir of the storage of their target so
+// they are hidden and renamed within that storage once complete. Staging files left behind by a restart are removed
+// when the storage is provided again.
+const uploadStagingPrefix = "tus-"
+
+// upload is the state of a resumable upload. Its data is written to a staging file kept open across the requests
+// resuming it, so each request only sends its own bytes to the storage, and the staging file is renamed over path once
+// the upload completes, so path is left as it was until then. The open staging file keeps its mount busy.
+type upload struct {
+	id          string
+	path        string
+	stagingPath string
+	fs          aufs.Filesystem
+	length      int64
+	metadata    string
+
+	// mu is held while a request works on the upload
+	mu      sync.Mutex
+	file    aufs.File // the staging file, open until the upload completes or is discarded
+	cancel  context.CancelFunc
+	offset  int64
+	expires time.Time
+	done    bool
+}
+
+// uploadWriter writes to the staging file of an upload, recording write failures apart from failures to read the
+// request body.
+type uploadWriter struct {
+	upload *upload
+	file   aufs.File
+	err    error
+}
+
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.upload.offset += int64(n)
+	if err != nil {
+		w.err = err
+	}
+
+	return n, err
+}
+
+// open creates the staging file, written with a context of the upload as it outlives the request creating it.
+func (u *upload) open() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	file, err := u.fs.OpenFileWithContext(ctx, u.stagingPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	u.file, u.cancel = file, cancel
+	return nil
+}
+
+// append appends body to the staging file until ctx is done, returning the error reading body and the error writing it
+// apart, the data of the upload is lost on writing failures. A body cut short by the client keeps what was received,
+// the upload is resumed from there.
+func (u *upload) append(ctx context.Context, body io.Reader) (readErr error, writeErr error) {
+	writer := &uploadWriter{upload: u, file: u.file}
+	_, readErr = io.Copy(writer, internal.ContextReader(ctx, io.LimitReader(body, u.length-u.offset)))
+	if writer.err != nil {
+		return nil, writer.err
+	}
+
+	return readErr, nil
+}
+
+// closeFile closes the staging file, committing what was written, or discards its writes when abort is set.
+func (u *upload) closeFile(abort bool) error {
+	if u.file == nil {
+		return nil
+	}
+	file := u.file
+	u.file = nil
+	defer u.cancel()
+
+	if abort {
+		aborter, ok := file.(aufs.Aborter)
+		if ok && aborter.Abort() == nil {
+			return nil
+		}
+	}
+
+	return file.Close()
+}
+
+// discard discards the writes of the staging file and deletes it, path is left as it was before the upload.
+func (u *upload) discard() {
+	_ = u.closeFile(true)
+	err := u.fs.DeleteWithContext(context.Background(), u.stagingPath)
+	if err != nil && aufs.CodeOf(err) != aufs.NotFound {
+		log.Printf("TUS: failed to delete staging file of upload '%s', %s\n", u.id, err)
+	}
+}
+
+type handler struct {
+	provider aufs.StorageProvider
+
+	mu      sync.Mutex
+	uploads map[string]*upload
+}
+
+func Handler() http.Handler {
+	return HandlerWithProvider(storager.Default())
+}
+
+// HandlerWithProvider returns a handler of the tus resumable upload protocol, writing to the filesystem of the spec in
+// the context of requests, see aufs.Context.
+func HandlerWithProvider(provider aufs.StorageProvider) http.Handler {
+	return &handler{
+		provider: provider,
+		uploads:  map[string]*upload{},
+	}
+}
+
+func (h *handler) fsFromContext(ctx context.Context) (aufs.Filesystem, error) {
+	fsSpec, ok := ctx.Value(aufs.SpecContextKey).(aufs.FileSystemSpec)
+	if !ok {
+		return nil, fmt.Errorf("aulaga filesystem not in context")
+	}
+
+	return h.provider.ProvideFileSystem(fsSpec)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", Version)
+	h.expire()
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", Version)
+		w.Header().Set("Tus-Extension", extensions)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != Version {
+		w.Header().Set("Tus-Version", Version)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	fs, err := h.fsFromContext(r.Context())
+	if err != nil {
+		h.fail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	route := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, Prefix), "/")
+	switch {
+	case r.Method == http.MethodPost && (route == "files" || strings.HasPrefix(route, "files/")):
+		h.create(w, r, fs, strings.TrimPrefix(route, "files"))
+		return
+	case strings.HasPrefix(route, "uploads/"):
+		u := h.upload(strings.TrimPrefix(route, "uploads/"), fs)
+		if u == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodHead:
+			h.head(w, u)
+			return
+		case http.MethodPatch:
+			h.patch(w, r, u)
+			return
+		case http.MethodDelete:
+			h.terminate(w, u)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// upload returns the upload with id, as long as it writes to fs.
+func (h *handler) upload(id string, fs aufs.Filesystem) *upload {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	u, ok := h.uploads[id]
+	if !ok || u.fs != fs {
+		return nil
+	}
+
+	return u
+}
+
+func (h *handler) remove(u *upload) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.uploads, u.id)
+}
+
+// expire discards the expired uploads no request is working on.
+func (h *handler) expire() {
+	h.mu.Lock()
+	var expired []*upload
+	now := time.Now()
+	for id, u := range h.uploads {
+		if !u.mu.TryLock() {
+			continue
+		}
+		if u.expires.Before(now) {
+			delete(h.uploads, id)
+			expired = append(expired, u)
+		}
+		u.mu.Unlock()
+	}
+	h.mu.Unlock()
+
+	for _, u := range expired {
+		u.mu.Lock()
+		if !u.done {
+			u.discard()
+		}
+		u.mu.Unlock()
+	}
+}
+
+func (h *handler) create(w http.ResponseWriter, r *http.Request, fs aufs.Filesystem, dir string) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		h.fail(w, r, http.StatusBadRequest, fmt.Errorf("deferred upload length not supported"))
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		h.fail(w, r, http.StatusBadRequest, fmt.Errorf("invalid Upload-Length '%s'", r.Header.Get("Upload-Length")))
+		return
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	target := path.Clean("/" + dir)
+	filename, err := metadataValue(metadata, "filename")
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if filename != "" {
+		target = path.Join(target, path.Base("/"+filename))
+	}
+	if target == "/" {
+		h.fail(w, r, http.StatusBadRequest, fmt.Errorf("upload path or filename is required"))
+		return
+	}
+
+	id := uuid.New().String()
+	mount, _ := fs.MountForPath(target)
+	u := &upload{
+		id:          id,
+		path:        target,
+		stagingPath: path.Join(mount.Point(), internal.NewStagingPath(uploadStagingPrefix+id)),
+		fs:          fs,
+		length:      length,
+		metadata:    metadata,
+		expires:     time.Now().Add(UploadExpiration),
+	}
+
+	// The staging file is created empty, the requests resuming the upload write to it
+	err = u.open()
+	if err == nil && length == 0 {
+		err = h.complete(r.Context(), u)
+	}
+	if err != nil {
+		u.discard()
+		h.fail(w, r, aufs.CodeOf(err).HTTPStatus(), err)
+		return
+	}
+
+	h.mu.Lock()
+	h.uploads[u.id] = u
+	h.mu.Unlock()
+
+	w.Header().Set("Location", Prefix+"/uploads/"+u.id)
+	w.Header().Set("Upload-Expires", u.expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *handler) head(w http.ResponseWriter, u *upload) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.length, 10))
+	w.Header().Set("Upload-Expires", u.expires.UTC().Format(http.TimeFormat))
+	if u.metadata != "" {
+		w.Header().Set("Upload-Metadata", u.metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) patch(w http.ResponseWriter, r *http.Request, u *upload) {
+	if r.Header.Get("Content-Type") != offsetContentType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, fmt.Errorf("invalid Upload-Offset '%s'", r.Header.Get("Upload-Offset")))
+		return
+	}
+
+	if !u.mu.TryLock() {
+		h.fail(w, r, http.StatusLocked, fmt.Errorf("upload '%s' is being resumed by another request", u.id))
+		return
+	}
+	defer u.mu.Unlock()
+
+	if u.done || offset != u.offset {
+		h.fail(w, r, http.StatusConflict, fmt.Errorf("upload '%s' is at offset %d, not %d", u.id, u.offset, offset))
+		return
+	}
+
+	readErr, writeErr := u.append(r.Context(), r.Body)
+	u.expires = time.Now().Add(UploadExpiration)
+	if writeErr != nil {
+		h.remove(u)
+		u.discard()
+		h.fail(w, r, aufs.CodeOf(writeErr).HTTPStatus(), writeErr)
+		return
+	}
+
+	if u.offset == u.length {
+		err = h.complete(r.Context(), u)
+		if err != nil {
+			h.remove(u)
+			u.discard()
+			h.fail(w, r, aufs.CodeOf(err).HTTPStatus(), err)
+			return
+		}
+	} else if readErr != nil {
+		h.fail(w, r, http.StatusBadRequest, fmt.Errorf("failed to read upload '%s', %s", u.id, readErr.Error()))
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	w.Header().Set("Upload-Expires", u.expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// complete closes the staging file and renames it over path, the upload is kept until expired so clients can still
+// check its offset.
+func (h *handler) complete(ctx context.Context, u *upload) error {
+	err := u.closeFile(false)
+	if err != nil {
+		return err
+	}
+
+	err = u.fs.MoveWithContext(ctx, u.stagingPath, u.path)
+	if err != nil {
+		return err
+	}
+
+	u.done = true
+	return nil
+}
+
+func (h *handler) terminate(w http.ResponseWriter, u *upload) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	h.remove(u)
+	if !u.done {
+		u.discard()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) fail(w http.ResponseWriter, r *http.Request, status int, err error) {
+	log.Printf("TUS [%s]: %s, ERROR: %s\n", r.Method, r.URL, err)
+	http.Error(w, err.Error(), status)
+}
+
+// metadataValue decodes the value of key in an Upload-Metadata header, a comma-separated list of keys followed by
+// their base64 encoded value.
+func metadataValue(metadata string, key string) (string, error) {
+	for _, pair := range strings.Split(metadata, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || fields[0] != key {
+			continue
+		}
+		if len(fields) == 1 {
+			return "", nil
+		}
+
+		value, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid Upload-Metadata value of '%s', %s", key, err.Error())
+		}
+
+		return string(value), nil
+	}
+
+	return "", nil
+}
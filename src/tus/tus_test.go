@@ -0,0 +1,238 @@
+package tus_test
+
+import (
+	"context"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/internal"
+	"github.com/aulaga/aufs/src/storager"
+	"github.com/aulaga/aufs/src/tus"
+	"go.beyondstorage.io/v5/services"
+	"go.beyondstorage.io/v5/types"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type testSpec struct {
+	uri string
+}
+
+func (s testSpec) Root() aufs.StorageSpec {
+	return aufs.StorageSpec{Id: s.uri, Uri: s.uri}
+}
+
+func (s testSpec) Mounts() []aufs.MountSpec {
+	return nil
+}
+
+func (s testSpec) Listener() aufs.EventListener {
+	return nil
+}
+
+// newServer serves a tus handler over a memory filesystem with "/file.txt" holding "original".
+func newServer(t *testing.T) (*httptest.Server, aufs.Filesystem) {
+	spec := testSpec{uri: "memory://"}
+	provider := storager.Provider()
+	fs, err := provider.ProvideFileSystem(spec)
+	if err != nil {
+		t.Fatalf("failed to provide filesystem, %s", err.Error())
+	}
+
+	err = internal.CreateFile(fs, "/file.txt", strings.NewReader("original"))
+	if err != nil {
+		t.Fatalf("failed to write '/file.txt', %s", err.Error())
+	}
+
+	handler := tus.HandlerWithProvider(provider)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(aufs.Context(r.Context(), spec)))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, fs
+}
+
+func do(t *testing.T, method string, url string, body string, header map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("invalid request, %s", err.Error())
+	}
+	req.Header.Set("Tus-Resumable", tus.Version)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s '%s' failed, %s", method, url, err.Error())
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	return resp
+}
+
+func patch(t *testing.T, url string, offset string, body string) {
+	t.Helper()
+	resp := do(t, http.MethodPatch, url, body, map[string]string{
+		"Upload-Offset": offset,
+		"Content-Type":  "application/offset+octet-stream",
+	})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PATCH at %s answered %d", offset, resp.StatusCode)
+	}
+}
+
+func expectContent(t *testing.T, fs aufs.Filesystem, want string) {
+	t.Helper()
+	file, err := fs.OpenFile("/file.txt", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("failed to open '/file.txt', %s", err.Error())
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil || string(content) != want {
+		t.Fatalf("'/file.txt' holds %q and %v, want %q", content, err, want)
+	}
+}
+
+func create(t *testing.T, server *httptest.Server, length string) string {
+	t.Helper()
+	resp := do(t, http.MethodPost, server.URL+tus.Prefix+"/files/file.txt", "", map[string]string{"Upload-Length": length})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST answered %d", resp.StatusCode)
+	}
+
+	return server.URL + resp.Header.Get("Location")
+}
+
+func TestUploadReplacesTargetOnceComplete(t *testing.T) {
+	server, fs := newServer(t)
+	url := create(t, server, "10")
+
+	patch(t, url, "0", "hello")
+	expectContent(t, fs, "original")
+
+	patch(t, url, "5", "world")
+	expectContent(t, fs, "helloworld")
+}
+
+func TestTerminatedUploadKeepsTarget(t *testing.T) {
+	server, fs := newServer(t)
+	url := create(t, server, "10")
+	patch(t, url, "0", "hello")
+
+	resp := do(t, http.MethodDelete, url, "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE answered %d", resp.StatusCode)
+	}
+
+	expectContent(t, fs, "original")
+	infos, err := fs.ListDir("/", false)
+	if err != nil {
+		t.Fatalf("failed to list '/', %s", err.Error())
+	}
+	if len(infos) != 1 {
+		t.Fatalf("terminated upload left %d files in '/'", len(infos))
+	}
+}
+
+// countingStorager counts the reads of the storager it wraps, which must be a mover.
+type countingStorager struct {
+	types.Storager
+	reads int64
+}
+
+func (s *countingStorager) Read(path string, w io.Writer, pairs ...types.Pair) (int64, error) {
+	atomic.AddInt64(&s.reads, 1)
+	return s.Storager.Read(path, w, pairs...)
+}
+
+func (s *countingStorager) ReadWithContext(ctx context.Context, path string, w io.Writer, pairs ...types.Pair) (int64, error) {
+	atomic.AddInt64(&s.reads, 1)
+	return s.Storager.ReadWithContext(ctx, path, w, pairs...)
+}
+
+func (s *countingStorager) Move(src string, dst string, pairs ...types.Pair) error {
+	return s.Storager.(types.Mover).Move(src, dst, pairs...)
+}
+
+func (s *countingStorager) MoveWithContext(ctx context.Context, src string, dst string, pairs ...types.Pair) error {
+	return s.Storager.(types.Mover).MoveWithContext(ctx, src, dst, pairs...)
+}
+
+// fsProvider provides the same filesystem for every spec.
+type fsProvider struct {
+	fs aufs.Filesystem
+}
+
+func (p fsProvider) ProvideFileSystem(aufs.FileSystemSpec) (aufs.Filesystem, error) {
+	return p.fs, nil
+}
+
+func (p fsProvider) ProvideStorage(aufs.StorageSpec) (aufs.Storage, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func TestPatchesDoNotReadStagingFile(t *testing.T) {
+	s, err := services.NewStoragerFromString("memory://")
+	if err != nil {
+		t.Fatalf("failed to create storager, %s", err.Error())
+	}
+	counting := &countingStorager{Storager: s}
+	fs, err := internal.NewFilesystem("fs", storager.NewStorager("counting", counting), nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create filesystem, %s", err.Error())
+	}
+
+	handler := tus.HandlerWithProvider(fsProvider{fs: fs})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(aufs.Context(r.Context(), testSpec{uri: "memory://"})))
+	}))
+	t.Cleanup(server.Close)
+
+	url := create(t, server, "20")
+	for i, chunk := range []string{"0123", "4567", "89ab", "cdef"} {
+		patch(t, url, fmt.Sprint(i*4), chunk)
+	}
+	if reads := atomic.LoadInt64(&counting.reads); reads != 0 {
+		t.Fatalf("patches read the storage %d times", reads)
+	}
+
+	patch(t, url, "16", "ghij")
+	expectContent(t, fs, "0123456789abcdefghij")
+}
+
+func TestStagingFileHidden(t *testing.T) {
+	server, fs := newServer(t)
+	var events []aufs.Event
+	fs.AddEventHandler(aufs.EventHandlerFunc(func(event aufs.Event) {
+		events = append(events, event)
+	}), aufs.DefaultListenerOptions())
+
+	url := create(t, server, "10")
+	patch(t, url, "0", "hello")
+	infos, err := fs.ListDir("/", true)
+	if err != nil {
+		t.Fatalf("failed to list '/', %s", err.Error())
+	}
+	if len(infos) != 1 {
+		t.Fatalf("upload in progress lists %d files in '/'", len(infos))
+	}
+
+	patch(t, url, "5", "world")
+	err = fs.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("shutdown failed, %s", err.Error())
+	}
+	if len(events) != 1 || events[0].Kind != aufs.EventModified || events[0].Path != "/file.txt" || events[0].OldPath != "" {
+		t.Fatalf("upload published %v, want only the modification of '/file.txt'", events)
+	}
+}
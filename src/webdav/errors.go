@@ -0,0 +1,191 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"golang.org/x/net/webdav"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+)
+
+type errorRecorderKey struct{}
+
+// errorRecorder keeps the error of the last call of the webdav handler during a request, cleared by calls that
+// succeed. The webdav handler only reports generic statuses so the recorded error is used to answer with a more
+// accurate one.
+type errorRecorder struct {
+	mu  sync.Mutex
+	err error
+}
+
+func withErrorRecorder(ctx context.Context) (context.Context, *errorRecorder) {
+	recorder := &errorRecorder{}
+	return context.WithValue(ctx, errorRecorderKey{}, recorder), recorder
+}
+
+// recordError records the outcome of a call, err is nil when it succeeded.
+func recordError(ctx context.Context, err error) error {
+	recorder, ok := ctx.Value(errorRecorderKey{}).(*errorRecorder)
+	if ok {
+		recorder.mu.Lock()
+		recorder.err = err
+		recorder.mu.Unlock()
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	return osError(err)
+}
+
+// osError makes missing and existing paths recognizable by os.IsNotExist and os.IsExist, which the webdav handler
+// relies on and which do not follow wrapped errors.
+func osError(err error) error {
+	if os.IsNotExist(err) || os.IsExist(err) {
+		return err
+	}
+
+	var sentinel error
+	switch aufs.CodeOf(err) {
+	case aufs.NotFound:
+		sentinel = fs.ErrNotExist
+	case aufs.AlreadyExists:
+		sentinel = fs.ErrExist
+	default:
+		return err
+	}
+
+	pathErr := &fs.PathError{Err: sentinel}
+	var typed *aufs.Error
+	if errors.As(err, &typed) {
+		pathErr.Op, pathErr.Path = typed.Op, typed.Path
+	}
+
+	return pathErr
+}
+
+func (r *errorRecorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// statusForError returns the HTTP status err should be answered with instead of the handler's status, or 0 to keep
+// it. The handler already answers missing and existing paths the way WebDAV expects, e.g. 409 for a PUT in a missing
+// collection, so those errors only replace the generic 500.
+func statusForError(err error, status int) int {
+	if err == nil {
+		return 0
+	}
+
+	switch code := aufs.CodeOf(err); code {
+	case aufs.Unknown:
+		return 0
+	case aufs.NotFound:
+		if status == http.StatusInternalServerError {
+			return http.StatusNotFound
+		}
+		return 0
+	case aufs.AlreadyExists:
+		if status == http.StatusInternalServerError {
+			return http.StatusPreconditionFailed
+		}
+		return 0
+	default:
+		return code.HTTPStatus()
+	}
+}
+
+// statusWriter replaces error statuses written by the webdav handler with the status of the recorded error, and
+// remembers the status sent.
+type statusWriter struct {
+	http.ResponseWriter
+	recorder   *errorRecorder
+	status     int
+	overridden bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+
+	if status >= http.StatusBadRequest {
+		mapped := statusForError(w.recorder.Err(), status)
+		if mapped != 0 && mapped != status {
+			w.status = mapped
+			w.overridden = true
+			w.ResponseWriter.WriteHeader(mapped)
+			_, _ = w.ResponseWriter.Write([]byte(webdav.StatusText(mapped)))
+			return
+		}
+	}
+
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.overridden {
+		// The handler's error body belongs to the replaced status
+		return len(p), nil
+	}
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+// Status returns the status sent to the client, http.StatusOK when the handler did not write anything.
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
+
+// errorFile records errors of file operations happening after OpenFile returned. A failed write stays recorded when
+// the file is closed afterwards, the handler closes files whether their copy succeeded or not.
+type errorFile struct {
+	webdav.File
+	ctx      context.Context
+	writeErr error
+}
+
+func (f *errorFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil && f.writeErr == nil {
+		f.writeErr = err
+	}
+	return n, recordError(f.ctx, err)
+}
+
+// Close commits the file, unless it was written from a request body that did not arrive in full. Its writes are then
+// discarded when the file can abort them, so a truncated upload never replaces the content of the file. Files written
+// in place, by storages without atomic writes, keep what was received.
+func (f *errorFile) Close() error {
+	body, ok := f.ctx.Value(requestBodyKey{}).(*requestBody)
+	if ok && body.Err() != nil {
+		err := fmt.Errorf("upload incomplete, %s", body.Err().Error())
+		aborter, ok := f.File.(aufs.Aborter)
+		if ok && aborter.Abort() == nil {
+			return recordError(f.ctx, err)
+		}
+	}
+
+	err := f.File.Close()
+	if err == nil && f.writeErr != nil {
+		_ = recordError(f.ctx, f.writeErr)
+		return nil
+	}
+	return recordError(f.ctx, err)
+}
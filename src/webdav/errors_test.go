@@ -0,0 +1,41 @@
+package webdav
+
+import (
+	"context"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"net/http"
+	"testing"
+)
+
+func TestErrorRecorderClearedBySuccess(t *testing.T) {
+	ctx, recorder := withErrorRecorder(context.Background())
+
+	_ = recordError(ctx, aufs.NewError(aufs.StorageUnavailable, "stat", "/a", nil))
+	if recorder.Err() == nil {
+		t.Fatalf("failed call not recorded")
+	}
+
+	_ = recordError(ctx, nil)
+	if recorder.Err() != nil {
+		t.Fatalf("successful call kept the error %v", recorder.Err())
+	}
+}
+
+func TestStatusForError(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{aufs.NewPermissionError("write", "/a", aufs.MountReadOnly), http.StatusForbidden},
+		{fmt.Errorf("wrapped, %w", aufs.NewPermissionError("delete", "/a", aufs.MountAppendOnly)), http.StatusForbidden},
+		{aufs.NewError(aufs.StorageUnavailable, "stat", "/a", nil), http.StatusServiceUnavailable},
+		{aufs.NewError(aufs.NotFound, "stat", "/a", nil), http.StatusNotFound},
+		{nil, 0},
+	} {
+		status := statusForError(test.err, http.StatusInternalServerError)
+		if status != test.status {
+			t.Fatalf("status for %v is %d, want %d", test.err, status, test.status)
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	aufs "github.com/aulaga/aufs/src"
 	"github.com/aulaga/aufs/src/storager"
+	"github.com/google/uuid"
 	"golang.org/x/net/webdav"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -31,61 +33,108 @@ func (f FileSystem) fsFromContext(ctx context.Context) (aufs.Filesystem, error)
 	return f.storageProvider.ProvideFileSystem(fsSpec)
 }
 
+type transactionKey struct{}
+
+// storageFromContext returns the transaction of the request when there is one, so events are scoped to it.
+func (f FileSystem) storageFromContext(ctx context.Context) (aufs.ContextStorage, error) {
+	tx, ok := ctx.Value(transactionKey{}).(aufs.Transaction)
+	if ok {
+		return tx, nil
+	}
+
+	return f.fsFromContext(ctx)
+}
+
 func (f FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
-	fs, err := f.fsFromContext(ctx)
+	fs, err := f.storageFromContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	file, err := fs.Open(name)
+	file, err := fs.OpenFileWithContext(ctx, name, flag)
+	err = recordError(ctx, err)
 	if err != nil {
 		return nil, err
 	}
 
-	return file, err
+	return &errorFile{File: file, ctx: ctx}, nil
 }
 
 func (f FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
-	fs, err := f.fsFromContext(ctx)
+	fs, err := f.storageFromContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	fileInfo, err := fs.Stat(name)
+	fileInfo, err := fs.StatWithContext(ctx, name)
+	err = recordError(ctx, err)
 	if err != nil {
-		return nil, os.ErrNotExist
+		return nil, err
 	}
 
 	return fileInfo, nil
 }
 
 func (f FileSystem) RemoveAll(ctx context.Context, name string) error {
-	fs, err := f.fsFromContext(ctx)
+	fs, err := f.storageFromContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	return fs.Delete(name)
+	return recordError(ctx, fs.DeleteWithContext(ctx, name))
 }
 
 func (f FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
-	fs, err := f.fsFromContext(ctx)
+	fs, err := f.storageFromContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	_, err = fs.MkDir(name)
-	return err
+	_, err = fs.MkDirWithContext(ctx, name)
+	return recordError(ctx, err)
 }
 
 func (f FileSystem) Rename(ctx context.Context, oldName, newName string) error {
-	fs, err := f.fsFromContext(ctx)
+	fs, err := f.storageFromContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = fs.Move(oldName, newName)
-	return err
+	err = fs.MoveWithContext(ctx, oldName, newName)
+	return recordError(ctx, err)
+}
+
+type requestBodyKey struct{}
+
+// requestBody is the body of a PUT request, remembering when it failed or ended before its announced length. The
+// webdav handler closes the file it copies the body to regardless, so the file is aborted instead of committed then.
+type requestBody struct {
+	io.ReadCloser
+	length int64
+	read   int64
+	err    error
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+
+	return n, err
+}
+
+// Err returns why the body is incomplete, nil when it was read in full.
+func (b *requestBody) Err() error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.length >= 0 && b.read < b.length {
+		return fmt.Errorf("body ended after %d of %d bytes", b.read, b.length)
+	}
+
+	return nil
 }
 
 type MyHandler struct {
@@ -94,17 +143,51 @@ type MyHandler struct {
 }
 
 func (m MyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	m.h.ServeHTTP(w, r)
+	ctx, recorder := withErrorRecorder(r.Context())
+
+	if aufs.RequestIdFromContext(ctx) == "" {
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" {
+			requestId = uuid.New().String()
+		}
+		ctx = aufs.WithRequestId(ctx, requestId)
+	}
 
-	aulagaFs, err := m.fs.fsFromContext(r.Context())
+	var tx aufs.Transaction
+	aulagaFs, err := m.fs.fsFromContext(ctx)
 	if err == nil {
-		aulagaFs.FlushEvents()
+		tx = aulagaFs.Begin(ctx)
+		ctx = context.WithValue(ctx, transactionKey{}, tx)
+	}
+
+	var body *requestBody
+	if r.Method == http.MethodPut {
+		body = &requestBody{ReadCloser: r.Body, length: r.ContentLength}
+		ctx = context.WithValue(ctx, requestBodyKey{}, body)
+	}
+
+	req := r.WithContext(ctx)
+	if body != nil {
+		req.Body = body
+	}
+
+	sw := &statusWriter{ResponseWriter: w, recorder: recorder}
+	m.h.ServeHTTP(sw, req)
+
+	if tx == nil {
+		return
+	}
+
+	// Only requests that succeeded report their changes
+	if sw.Status() < http.StatusBadRequest {
+		tx.Commit()
+	} else {
+		tx.Discard()
 	}
 }
 
 func Handler() http.Handler {
-	defaultProvider := storager.Provider()
-	return HandlerWithProvider(defaultProvider)
+	return HandlerWithProvider(storager.Default())
 }
 
 func HandlerWithProvider(provider aufs.StorageProvider) http.Handler {
@@ -0,0 +1,164 @@
+package webdav_test
+
+import (
+	"bufio"
+	"context"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/storager"
+	"github.com/aulaga/aufs/src/webdav"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type testSpec struct {
+	uri    string
+	atomic bool
+}
+
+func (s testSpec) Root() aufs.StorageSpec {
+	return aufs.StorageSpec{Id: s.uri, Uri: s.uri, AtomicWrites: s.atomic}
+}
+
+func (s testSpec) Mounts() []aufs.MountSpec {
+	return nil
+}
+
+func (s testSpec) Listener() aufs.EventListener {
+	return nil
+}
+
+// newServer serves a webdav handler over the filesystem of spec, with a provider of its own.
+func newServer(t *testing.T, spec aufs.FileSystemSpec) *httptest.Server {
+	handler := webdav.HandlerWithProvider(storager.Provider())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(aufs.Context(r.Context(), spec)))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func do(t *testing.T, method string, url string, body string, header map[string]string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("invalid request, %s", err.Error())
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s '%s' failed, %s", method, url, err.Error())
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response of %s '%s', %s", method, url, err.Error())
+	}
+
+	return resp.StatusCode, string(content)
+}
+
+func TestRangeRequests(t *testing.T) {
+	server := newServer(t, testSpec{uri: "memory://"})
+	url := server.URL + "/dav/file.txt"
+
+	status, _ := do(t, http.MethodPut, url, "0123456789", nil)
+	if status != http.StatusCreated {
+		t.Fatalf("PUT answered %d", status)
+	}
+
+	for _, test := range []struct {
+		ranges string
+		status int
+		body   string
+	}{
+		{"bytes=-3", http.StatusPartialContent, "789"},
+		{"bytes=-10", http.StatusPartialContent, "0123456789"},
+		{"bytes=-20", http.StatusPartialContent, "0123456789"},
+		{"bytes=7-", http.StatusPartialContent, "789"},
+		{"bytes=2-4", http.StatusPartialContent, "234"},
+		{"bytes=10-", http.StatusRequestedRangeNotSatisfiable, ""},
+	} {
+		status, body := do(t, http.MethodGet, url, "", map[string]string{"Range": test.ranges})
+		if status != test.status || (test.body != "" && body != test.body) {
+			t.Fatalf("GET of %s answered %d with %q, want %d with %q", test.ranges, status, body, test.status, test.body)
+		}
+	}
+}
+
+func TestErrorStatuses(t *testing.T) {
+	for _, test := range []struct {
+		op     string
+		error  string
+		method string
+		status int
+	}{
+		{"open", "unavailable", http.MethodPut, http.StatusServiceUnavailable},
+		{"write", "quota", http.MethodPut, http.StatusInsufficientStorage},
+		{"close", "conflict", http.MethodPut, http.StatusConflict},
+		{"open", "denied", http.MethodGet, http.StatusForbidden},
+		{"delete", "unavailable", http.MethodDelete, http.StatusServiceUnavailable},
+		{"mkdir", "unsupported", "MKCOL", http.StatusMethodNotAllowed},
+	} {
+		uri := "faulty://?storage=" + url.QueryEscape("memory://") + "&op=" + test.op + "&error=" + test.error
+		server := newServer(t, testSpec{uri: uri})
+
+		if test.method == http.MethodGet || test.method == http.MethodDelete {
+			status, _ := do(t, http.MethodPut, server.URL+"/dav/file.txt", "content", nil)
+			if status != http.StatusCreated && test.op != "open" {
+				t.Fatalf("PUT before %s answered %d", test.method, status)
+			}
+		}
+
+		body := ""
+		if test.method == http.MethodPut {
+			body = "content"
+		}
+		status, _ := do(t, test.method, server.URL+"/dav/file.txt", body, nil)
+		if status != test.status {
+			t.Fatalf("%s with a %s fault on %s answered %d, want %d", test.method, test.error, test.op, status, test.status)
+		}
+	}
+}
+
+func TestTruncatedPutKeepsTarget(t *testing.T) {
+	server := newServer(t, testSpec{uri: "memory://", atomic: true})
+	url := server.URL + "/dav/file.txt"
+
+	status, _ := do(t, http.MethodPut, url, "original", nil)
+	if status != http.StatusCreated {
+		t.Fatalf("PUT answered %d", status)
+	}
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect, %s", err.Error())
+	}
+	defer conn.Close()
+
+	// The body breaks off with an invalid chunk while the connection, and so the request context, stay alive
+	_, err = io.WriteString(conn, "PUT /dav/file.txt HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n9\r\ntruncated\r\nzz\r\n")
+	if err != nil {
+		t.Fatalf("failed to send PUT, %s", err.Error())
+	}
+
+	// The response is only read to wait for the handler to be done
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+
+	status, body := do(t, http.MethodGet, url, "", nil)
+	if status != http.StatusOK || body != "original" {
+		t.Fatalf("GET after a truncated PUT answered %d with %q", status, body)
+	}
+}
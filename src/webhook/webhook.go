@@ -0,0 +1,388 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureHeader holds the hex encoded HMAC-SHA256 of the request body, keyed with the webhook secret.
+	SignatureHeader = "X-Aufs-Signature"
+	// DeliveryHeader holds the id of the batch, the same on every retry of a batch.
+	DeliveryHeader = "X-Aufs-Delivery"
+
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultMaxRetries    = 5
+	defaultMaxPending    = 10000
+	initialBackoff       = 500 * time.Millisecond
+	maxBackoff           = 30 * time.Second
+	spoolExtension       = ".json"
+)
+
+// Payload is the body posted to webhooks.
+type Payload struct {
+	Id     string       `json:"id"`
+	Events []aufs.Event `json:"events"`
+}
+
+// Sign returns the signature of body as sent in the SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sink is an aufs.EventHandler posting batches of events to a webhook.
+type Sink struct {
+	spec   aufs.WebhookSpec
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []aufs.Event
+	dropped uint64
+	flush   chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	closed  bool
+
+	// spoolBackoff is the delay before the spool is retried after a failed delivery, 0 while the spool is known empty.
+	// It is only used by the run goroutine, like spoolRetry.
+	spoolBackoff time.Duration
+	spoolRetry   time.Time
+}
+
+var _ aufs.EventHandler = &Sink{}
+
+// New starts a sink for spec, batches spooled by a previous run are delivered first.
+func New(spec aufs.WebhookSpec) (*Sink, error) {
+	if spec.Url == "" {
+		return nil, fmt.Errorf("webhook url is required")
+	}
+	if spec.BatchSize <= 0 {
+		spec.BatchSize = defaultBatchSize
+	}
+	if spec.FlushInterval <= 0 {
+		spec.FlushInterval = defaultFlushInterval
+	}
+	if spec.MaxRetries == 0 {
+		spec.MaxRetries = defaultMaxRetries
+	}
+	if spec.MaxRetries < 0 {
+		spec.MaxRetries = 0
+	}
+	if spec.MaxPending <= 0 {
+		spec.MaxPending = defaultMaxPending
+	}
+	if spec.MaxPending < spec.BatchSize {
+		spec.MaxPending = spec.BatchSize
+	}
+	if spec.SpoolDir != "" {
+		err := os.MkdirAll(spec.SpoolDir, 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create webhook spool dir '%s', %s", spec.SpoolDir, err.Error())
+		}
+	}
+
+	s := &Sink{
+		spec:   spec,
+		client: &http.Client{Timeout: 30 * time.Second},
+		flush:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+
+	return s, nil
+}
+
+// HandleEvent queues event for delivery. With spec.MaxPending events already waiting, the oldest batch is spooled to
+// make room, or event is dropped when there is no spool.
+func (s *Sink) HandleEvent(event aufs.Event) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+
+	var overflow []aufs.Event
+	if len(s.pending) >= s.spec.MaxPending {
+		if s.spec.SpoolDir == "" {
+			s.dropped++
+			s.mu.Unlock()
+			return
+		}
+		overflow = s.takeBatchLocked()
+	}
+
+	s.pending = append(s.pending, event)
+	if len(s.pending) >= s.spec.BatchSize {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+	s.mu.Unlock()
+
+	if overflow != nil {
+		body, err := encodeBatch(overflow)
+		if err != nil {
+			log.Printf("WEBHOOK [%s]: failed to encode %d events, %s\n", s.spec.Url, len(overflow), err)
+			return
+		}
+		s.spoolBatch(body, fmt.Errorf("too many events pending"))
+	}
+}
+
+// Dropped returns how many events were discarded because too many were pending and there was no spool.
+func (s *Sink) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// Shutdown delivers the pending events, spooling them if delivery fails, the spool is still backing off or ctx is done
+// first.
+func (s *Sink) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.spec.FlushInterval)
+	defer ticker.Stop()
+
+	s.deliverSpooled()
+	for {
+		select {
+		case <-s.flush:
+			s.deliverAll()
+		case <-ticker.C:
+			s.deliverAll()
+		case <-s.stop:
+			s.deliverAll()
+			return
+		}
+	}
+}
+
+// deliverAll delivers the spooled batches then the pending events. While the spool cannot be delivered the pending
+// events are spooled behind it instead, so batches are delivered in order.
+func (s *Sink) deliverAll() {
+	if !s.deliverSpooled() {
+		s.spoolPending(fmt.Errorf("spooled batches are not delivered yet"))
+		return
+	}
+
+	s.deliverPending()
+}
+
+func (s *Sink) takeBatch() []aufs.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.takeBatchLocked()
+}
+
+// takeBatchLocked takes the oldest pending events, up to a batch. It must be called with the lock held.
+func (s *Sink) takeBatchLocked() []aufs.Event {
+	n := len(s.pending)
+	if n > s.spec.BatchSize {
+		n = s.spec.BatchSize
+	}
+
+	batch := s.pending[:n:n]
+	s.pending = s.pending[n:]
+	return batch
+}
+
+func (s *Sink) deliverPending() {
+	for batch := s.takeBatch(); len(batch) > 0; batch = s.takeBatch() {
+		body, err := encodeBatch(batch)
+		if err != nil {
+			log.Printf("WEBHOOK [%s]: failed to encode %d events, %s\n", s.spec.Url, len(batch), err)
+			continue
+		}
+
+		err = s.deliverWithRetries(body)
+		if err != nil {
+			s.spoolBatch(body, err)
+			if s.spec.SpoolDir != "" {
+				// The batches after it are spooled behind it and retried once the spool backed off
+				s.backoffSpool()
+				s.spoolPending(err)
+				return
+			}
+		}
+	}
+}
+
+// spoolPending spools the pending events as batches.
+func (s *Sink) spoolPending(cause error) {
+	for batch := s.takeBatch(); len(batch) > 0; batch = s.takeBatch() {
+		body, err := encodeBatch(batch)
+		if err != nil {
+			log.Printf("WEBHOOK [%s]: failed to encode %d events, %s\n", s.spec.Url, len(batch), err)
+			continue
+		}
+
+		s.spoolBatch(body, cause)
+	}
+}
+
+func encodeBatch(batch []aufs.Event) ([]byte, error) {
+	return json.Marshal(Payload{Id: uuid.New().String(), Events: batch})
+}
+
+func (s *Sink) deliverWithRetries(body []byte) error {
+	backoff := initialBackoff
+
+	var err error
+	for attempt := 0; attempt <= s.spec.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				// Shutting down, leave the batch to the spool instead of holding the shutdown
+				return fmt.Errorf("shutdown before delivery, last error: %w", err)
+			}
+
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+
+		err = s.deliver(body)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (s *Sink) deliver(body []byte) error {
+	var payload struct {
+		Id string `json:"id"`
+	}
+	_ = json.Unmarshal(body, &payload)
+
+	req, err := http.NewRequest(http.MethodPost, s.spec.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, payload.Id)
+	if s.spec.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(s.spec.Secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *Sink) spoolBatch(body []byte, cause error) {
+	if s.spec.SpoolDir == "" {
+		log.Printf("WEBHOOK [%s]: dropping undelivered batch, %s\n", s.spec.Url, cause)
+		return
+	}
+
+	name := fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), uuid.New().String(), spoolExtension)
+	tmpPath := filepath.Join(s.spec.SpoolDir, "."+name)
+	err := os.WriteFile(tmpPath, body, 0o600)
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(s.spec.SpoolDir, name))
+	}
+	if err != nil {
+		log.Printf("WEBHOOK [%s]: failed to spool undelivered batch, %s\n", s.spec.Url, err)
+	}
+}
+
+// backoffSpool delays the next retry of the spool, doubling the delay after each failure like deliverWithRetries.
+func (s *Sink) backoffSpool() {
+	if s.spoolBackoff == 0 {
+		s.spoolBackoff = initialBackoff
+	} else {
+		s.spoolBackoff *= 2
+		if s.spoolBackoff > maxBackoff {
+			s.spoolBackoff = maxBackoff
+		}
+	}
+
+	s.spoolRetry = time.Now().Add(s.spoolBackoff)
+}
+
+// deliverSpooled retries the spooled batches oldest first, stopping at the first failure to keep them in order, and
+// returns whether the spool is empty. Once a retry failed, the spool is not retried before its backoff elapsed.
+func (s *Sink) deliverSpooled() bool {
+	if s.spec.SpoolDir == "" {
+		return true
+	}
+	if time.Now().Before(s.spoolRetry) {
+		return false
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.spec.SpoolDir, "*"+spoolExtension))
+	if err != nil {
+		return true
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		body, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+
+		err = s.deliver(body)
+		if err != nil {
+			s.backoffSpool()
+			return false
+		}
+
+		_ = os.Remove(name)
+	}
+
+	s.spoolBackoff = 0
+	return true
+}
@@ -0,0 +1,201 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	aufs "github.com/aulaga/aufs/src"
+	"github.com/aulaga/aufs/src/webhook"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder answers webhook requests with the statuses queued, 200 once none is left, and records the payloads of the
+// requests answered with 200.
+type recorder struct {
+	mu       sync.Mutex
+	statuses []int
+	requests int
+	payloads []webhook.Payload
+	secret   string
+	t        *testing.T
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	if req.Header.Get(webhook.SignatureHeader) != webhook.Sign(r.secret, body) {
+		r.t.Errorf("request signature %q does not match its body", req.Header.Get(webhook.SignatureHeader))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests++
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	if status == http.StatusOK {
+		var payload webhook.Payload
+		_ = json.Unmarshal(body, &payload)
+		if payload.Id != req.Header.Get(webhook.DeliveryHeader) {
+			r.t.Errorf("delivery header %q does not match payload %q", req.Header.Get(webhook.DeliveryHeader), payload.Id)
+		}
+		r.payloads = append(r.payloads, payload)
+	}
+	w.WriteHeader(status)
+}
+
+func (r *recorder) delivered() []webhook.Payload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]webhook.Payload(nil), r.payloads...)
+}
+
+func newRecorder(t *testing.T, statuses ...int) (*recorder, string) {
+	r := &recorder{statuses: statuses, secret: "secret", t: t}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return r, server.URL
+}
+
+func newSink(t *testing.T, spec aufs.WebhookSpec) *webhook.Sink {
+	spec.Secret = "secret"
+	spec.FlushInterval = 10 * time.Millisecond
+	sink, err := webhook.New(spec)
+	if err != nil {
+		t.Fatalf("failed to create sink, %s", err.Error())
+	}
+
+	return sink
+}
+
+func shutdown(t *testing.T, sink *webhook.Sink) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := sink.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutdown failed, %s", err.Error())
+	}
+}
+
+func event(path string) aufs.Event {
+	return aufs.Event{Kind: aufs.EventCreated, Path: path}
+}
+
+func spooled(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatalf("failed to list spool, %s", err.Error())
+	}
+
+	return names
+}
+
+func TestDeliveryRetried(t *testing.T) {
+	r, url := newRecorder(t, http.StatusInternalServerError)
+	sink := newSink(t, aufs.WebhookSpec{Url: url})
+
+	sink.HandleEvent(event("/a.txt"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.delivered()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdown(t, sink)
+
+	payloads := r.delivered()
+	if r.requests != 2 || len(payloads) != 1 || len(payloads[0].Events) != 1 || payloads[0].Events[0].Path != "/a.txt" {
+		t.Fatalf("delivered %d payloads in %d requests, want the event in 2 requests", len(payloads), r.requests)
+	}
+}
+
+func TestFailedDeliverySpooled(t *testing.T) {
+	dir := t.TempDir()
+	r, url := newRecorder(t, http.StatusInternalServerError)
+	sink := newSink(t, aufs.WebhookSpec{Url: url, MaxRetries: -1, SpoolDir: dir})
+
+	sink.HandleEvent(event("/a.txt"))
+	shutdown(t, sink)
+
+	if r.requests != 1 {
+		t.Fatalf("batch was sent %d times without retries", r.requests)
+	}
+	if len(spooled(t, dir)) != 1 {
+		t.Fatalf("undelivered batch was not spooled")
+	}
+
+	// The next sink delivers the spooled batch before new events
+	sink = newSink(t, aufs.WebhookSpec{Url: url, SpoolDir: dir})
+	sink.HandleEvent(event("/b.txt"))
+	shutdown(t, sink)
+
+	payloads := r.delivered()
+	if len(payloads) != 2 || payloads[0].Events[0].Path != "/a.txt" || payloads[1].Events[0].Path != "/b.txt" {
+		t.Fatalf("delivered %d payloads, want the spooled one then the new one", len(payloads))
+	}
+	if len(spooled(t, dir)) != 0 {
+		t.Fatalf("delivered batch is still spooled")
+	}
+}
+
+func TestPendingEventsBounded(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+
+	sink := newSink(t, aufs.WebhookSpec{Url: server.URL, BatchSize: 1, MaxPending: 1})
+	for i := 0; i < 3; i++ {
+		sink.HandleEvent(event("/a.txt"))
+	}
+
+	if sink.Dropped() == 0 {
+		t.Fatalf("events past the pending limit were not dropped")
+	}
+
+	close(release)
+	shutdown(t, sink)
+}
+
+func TestSpoolRetryBacksOff(t *testing.T) {
+	dir := t.TempDir()
+	r, url := newRecorder(t, http.StatusInternalServerError)
+	sink := newSink(t, aufs.WebhookSpec{Url: url, MaxRetries: -1, SpoolDir: dir})
+
+	sink.HandleEvent(event("/a.txt"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spooled(t, dir)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Events arriving while the spool backs off are spooled behind it instead of being delivered first
+	sink.HandleEvent(event("/b.txt"))
+	time.Sleep(100 * time.Millisecond)
+	r.mu.Lock()
+	requests := r.requests
+	r.mu.Unlock()
+	if requests != 1 {
+		t.Fatalf("spool was retried %d times within its backoff", requests-1)
+	}
+	if len(spooled(t, dir)) != 2 {
+		t.Fatalf("spool holds %d batches, want the new batch spooled behind the failed one", len(spooled(t, dir)))
+	}
+
+	for len(r.delivered()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdown(t, sink)
+
+	payloads := r.delivered()
+	if len(payloads) != 2 || payloads[0].Events[0].Path != "/a.txt" || payloads[1].Events[0].Path != "/b.txt" {
+		t.Fatalf("delivered %d payloads, want the spooled batches in order", len(payloads))
+	}
+}